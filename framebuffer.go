@@ -0,0 +1,819 @@
+package i2vnc
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"io"
+
+	"github.com/kward/go-vnc"
+	"github.com/kward/go-vnc/rfbflags"
+)
+
+// RFB encodings and messages, see RFC 6143 §7.5 to §7.8.
+const (
+	encodingRaw         = int32(0)
+	encodingCopyRect    = int32(1)
+	encodingHextile     = int32(5)
+	encodingTight       = int32(7)
+	encodingZRLE        = int32(16)
+	encodingDesktopSize = int32(-223)
+	encodingLastRect    = int32(-224)
+	encodingPointerPos  = int32(-232)
+	encodingCursor      = int32(-239)
+
+	encodingExtendedDesktopSize = int32(-308)
+	// encodingLEDState is the QEMU LED state pseudo-encoding
+	encodingLEDState = int32(-261)
+
+	messageSetEncodings             = uint8(2)
+	messageFramebufferUpdateRequest = uint8(3)
+
+	messageFramebufferUpdate  = uint8(0)
+	messageSetColorMapEntries = uint8(1)
+	messageBell               = uint8(2)
+	messageServerCutText      = uint8(3)
+)
+
+const (
+	bytesPerPixel  = 4
+	bytesPerCPixel = 3
+	maxDataLength  = 1 << 28
+	zrleTileSize   = 64
+	hextileSize    = 16
+
+	hextileRaw              = 0x01
+	hextileBackground       = 0x02
+	hextileForeground       = 0x04
+	hextileAnySubrects      = 0x08
+	hextileSubrectsColoured = 0x10
+
+	tightCompressionFill = 0x08
+	tightCompressionJPEG = 0x09
+	tightExplicitFilter  = 0x04
+	tightFilterCopy      = 0
+	tightFilterPalette   = 1
+	tightFilterGradient  = 2
+	tightMinToCompress   = 12
+)
+
+// framebufferEncodings are requested from the server, the preferred first.
+var framebufferEncodings = []int32{encodingZRLE, encodingTight, encodingHextile, encodingCopyRect, encodingRaw,
+	encodingExtendedDesktopSize, encodingDesktopSize, encodingLastRect}
+
+// cursorEncodings are requested to track the remote pointer. With the Cursor
+// pseudo-encoding the server no longer draws the cursor into the framebuffer.
+var cursorEncodings = []int32{encodingCursor, encodingPointerPos}
+
+// QEMU LED state bits
+const (
+	ledScrollLock = 1 << iota
+	ledNumLock
+	ledCapsLock
+)
+
+// FramebufferPixelFormat is requested from the server, 32 bit true color
+// in little endian, so the pixel bytes are blue, green, red and padding.
+var FramebufferPixelFormat = vnc.PixelFormat{
+	BPP:        32,
+	Depth:      24,
+	BigEndian:  rfbflags.RFBFalse,
+	TrueColor:  rfbflags.RFBTrue,
+	RedMax:     255,
+	GreenMax:   255,
+	BlueMax:    255,
+	RedShift:   16,
+	GreenShift: 8,
+	BlueShift:  0,
+}
+
+// framebuffer is the client side copy of the remote framebuffer, updated
+// from the framebuffer updates sent in FramebufferPixelFormat.
+type framebuffer struct {
+	r   *bufio.Reader
+	img *image.RGBA
+	// the zlib streams live as long as the connection
+	zrle  zlibStream
+	tight [4]zlibStream
+	// cursor is the remote cursor shape, nil until the server sends it,
+	// cursorChanged is set when it's sent
+	cursor        *image.RGBA
+	cursorHotspot image.Point
+	cursorChanged bool
+	// pointer is the remote pointer position,
+	// pointerMoved is set when the server reports it
+	pointer      image.Point
+	pointerMoved bool
+	// screens are the remote monitors, if the server reports them
+	screens []image.Rectangle
+	// locks are the remote lock states, nil until the server reports them
+	locks *Locks
+}
+
+func newFramebuffer(r io.Reader, width, height uint16) *framebuffer {
+	return &framebuffer{
+		r:   bufio.NewReader(r),
+		img: image.NewRGBA(image.Rect(0, 0, int(width), int(height))),
+	}
+}
+
+// setEncodings sends a SetEncodings message with the encodings,
+// which the framebuffer must be able to decode.
+func setEncodings(w io.Writer, encodings []int32) error {
+	msg := struct {
+		Type  uint8
+		_     uint8
+		Count uint16
+	}{messageSetEncodings, 0, uint16(len(encodings))}
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, msg)
+	binary.Write(&buf, binary.BigEndian, encodings)
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// requestUpdate sends a FramebufferUpdateRequest for the rectangle,
+// an incremental update only has the changes since the last update.
+func requestUpdate(w io.Writer, incremental bool, r image.Rectangle) error {
+	msg := struct {
+		Type                uint8
+		Incremental         rfbflags.RFBFlag
+		X, Y, Width, Height uint16
+	}{messageFramebufferUpdateRequest, rfbflags.BoolToRFBFlag(incremental),
+		uint16(r.Min.X), uint16(r.Min.Y), uint16(r.Dx()), uint16(r.Dy())}
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, msg)
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// readUpdate reads server messages until a framebuffer update was applied,
+// returning the part of the framebuffer the update changed.
+func (fb *framebuffer) readUpdate() (image.Rectangle, error) {
+	for {
+		var msgType uint8
+		if err := fb.read(&msgType); err != nil {
+			return image.Rectangle{}, err
+		}
+		switch msgType {
+		case messageFramebufferUpdate:
+			return fb.readRectangles()
+		case messageSetColorMapEntries:
+			var msg struct {
+				_          uint8
+				FirstColor uint16
+				Colors     uint16
+			}
+			if err := fb.read(&msg); err != nil {
+				return image.Rectangle{}, err
+			}
+			if err := fb.skip(int(msg.Colors) * 6); err != nil {
+				return image.Rectangle{}, err
+			}
+		case messageBell:
+		case messageServerCutText:
+			var msg struct {
+				_      [3]byte
+				Length uint32
+			}
+			if err := fb.read(&msg); err != nil {
+				return image.Rectangle{}, err
+			}
+			if err := fb.skip(int(msg.Length)); err != nil {
+				return image.Rectangle{}, err
+			}
+		default:
+			return image.Rectangle{}, fmt.Errorf("unsupported server message type %v", msgType)
+		}
+	}
+}
+
+func (fb *framebuffer) readRectangles() (image.Rectangle, error) {
+	var msg struct {
+		_     uint8
+		Rects uint16
+	}
+	if err := fb.read(&msg); err != nil {
+		return image.Rectangle{}, err
+	}
+	var damage image.Rectangle
+	for n := 0; n < int(msg.Rects); n++ {
+		var rect struct {
+			X, Y, Width, Height uint16
+			Encoding            int32
+		}
+		if err := fb.read(&rect); err != nil {
+			return damage, err
+		}
+		r := image.Rect(int(rect.X), int(rect.Y), int(rect.X)+int(rect.Width), int(rect.Y)+int(rect.Height))
+		switch rect.Encoding {
+		case encodingLastRect:
+			return damage, nil
+		case encodingDesktopSize:
+			fb.resize(r.Size())
+			fb.screens = nil
+			damage = fb.img.Bounds()
+			continue
+		case encodingExtendedDesktopSize:
+			screens, err := fb.readScreens()
+			if err != nil {
+				return damage, fmt.Errorf("failed reading screens: %s", err)
+			}
+			fb.screens = screens
+			if r.Size() != fb.img.Bounds().Size() {
+				fb.resize(r.Size())
+				damage = fb.img.Bounds()
+			}
+			continue
+		case encodingPointerPos:
+			fb.pointer, fb.pointerMoved = r.Min, true
+			continue
+		case encodingCursor:
+			if err := fb.readCursor(r); err != nil {
+				return damage, fmt.Errorf("failed reading cursor: %s", err)
+			}
+			continue
+		case encodingLEDState:
+			var leds uint8
+			if err := fb.read(&leds); err != nil {
+				return damage, fmt.Errorf("failed reading led state: %s", err)
+			}
+			fb.locks = &Locks{CapsLock: leds&ledCapsLock != 0, NumLock: leds&ledNumLock != 0,
+				ScrollLock: leds&ledScrollLock != 0}
+			continue
+		}
+		if !r.In(fb.img.Bounds()) {
+			return damage, fmt.Errorf("rectangle %v is outside of the framebuffer %v", r, fb.img.Bounds())
+		}
+		var err error
+		switch rect.Encoding {
+		case encodingRaw:
+			err = fb.readRaw(r)
+		case encodingCopyRect:
+			err = fb.readCopyRect(r)
+		case encodingHextile:
+			err = fb.readHextile(r)
+		case encodingZRLE:
+			err = fb.readZRLE(r)
+		case encodingTight:
+			err = fb.readTight(r)
+		default:
+			err = fmt.Errorf("unsupported encoding %v", rect.Encoding)
+		}
+		if err != nil {
+			return damage, fmt.Errorf("failed reading rectangle %v: %s", r, err)
+		}
+		damage = damage.Union(r)
+	}
+	return damage, nil
+}
+
+func (fb *framebuffer) readRaw(r image.Rectangle) error {
+	data, err := fb.readN(r.Dx() * r.Dy() * bytesPerPixel)
+	if err != nil {
+		return err
+	}
+	fb.setPixels(r, data, bytesPerPixel)
+	return nil
+}
+
+func (fb *framebuffer) readCopyRect(r image.Rectangle) error {
+	var src struct{ X, Y uint16 }
+	if err := fb.read(&src); err != nil {
+		return err
+	}
+	sp := image.Pt(int(src.X), int(src.Y))
+	if !r.Sub(r.Min).Add(sp).In(fb.img.Bounds()) {
+		return fmt.Errorf("copy source %v is outside of the framebuffer", sp)
+	}
+	// the source may overlap the rectangle
+	tmp := image.NewRGBA(r)
+	draw.Draw(tmp, r, fb.img, sp, draw.Src)
+	draw.Draw(fb.img, r, tmp, r.Min, draw.Src)
+	return nil
+}
+
+// resize replaces the framebuffer with an empty one of the size,
+// the server sends its contents after resizing.
+func (fb *framebuffer) resize(size image.Point) {
+	fb.img = image.NewRGBA(image.Rectangle{Max: size})
+}
+
+// readScreens reads the screens of an ExtendedDesktopSize rectangle,
+// the rectangle size is the framebuffer size.
+func (fb *framebuffer) readScreens() ([]image.Rectangle, error) {
+	var header struct {
+		Screens uint8
+		_       [3]byte
+	}
+	if err := fb.read(&header); err != nil {
+		return nil, err
+	}
+	screens := make([]image.Rectangle, header.Screens)
+	for i := range screens {
+		var screen struct {
+			ID                  uint32
+			X, Y, Width, Height uint16
+			Flags               uint32
+		}
+		if err := fb.read(&screen); err != nil {
+			return nil, err
+		}
+		screens[i] = image.Rect(int(screen.X), int(screen.Y), int(screen.X)+int(screen.Width), int(screen.Y)+int(screen.Height))
+	}
+	return screens, nil
+}
+
+// readCursor reads the cursor shape, the rectangle position is its hotspot.
+// The pixels are followed by a bitmask of the opaque pixels.
+func (fb *framebuffer) readCursor(r image.Rectangle) error {
+	pixels, err := fb.readN(r.Dx() * r.Dy() * bytesPerPixel)
+	if err != nil {
+		return err
+	}
+	rowBytes := (r.Dx() + 7) / 8
+	mask, err := fb.readN(rowBytes * r.Dy())
+	if err != nil {
+		return err
+	}
+	cursor := image.NewRGBA(image.Rect(0, 0, r.Dx(), r.Dy()))
+	for y := 0; y < r.Dy(); y++ {
+		for x := 0; x < r.Dx(); x++ {
+			if mask[y*rowBytes+x/8]&(0x80>>uint(x%8)) == 0 {
+				continue
+			}
+			p := pixels[(y*r.Dx()+x)*bytesPerPixel:]
+			cursor.SetRGBA(x, y, color.RGBA{p[2], p[1], p[0], 0xff})
+		}
+	}
+	fb.cursor, fb.cursorHotspot, fb.cursorChanged = cursor, r.Min, true
+	return nil
+}
+
+// readHextile reads a Hextile rectangle, see RFC 6143 §7.7.4.
+func (fb *framebuffer) readHextile(r image.Rectangle) error {
+	// the colors carry over to the following tiles
+	var bg, fg color.RGBA
+	for y := r.Min.Y; y < r.Max.Y; y += hextileSize {
+		for x := r.Min.X; x < r.Max.X; x += hextileSize {
+			tile := image.Rect(x, y, x+hextileSize, y+hextileSize).Intersect(r)
+			sub, err := fb.r.ReadByte()
+			if err != nil {
+				return err
+			}
+			if sub&hextileRaw != 0 {
+				if err := fb.readRaw(tile); err != nil {
+					return err
+				}
+				continue
+			}
+			if sub&hextileBackground != 0 {
+				if bg, err = fb.readPixel(); err != nil {
+					return err
+				}
+			}
+			if sub&hextileForeground != 0 {
+				if fg, err = fb.readPixel(); err != nil {
+					return err
+				}
+			}
+			draw.Draw(fb.img, tile, image.NewUniform(bg), image.Point{}, draw.Src)
+			if sub&hextileAnySubrects == 0 {
+				continue
+			}
+			subrects, err := fb.r.ReadByte()
+			if err != nil {
+				return err
+			}
+			for n := 0; n < int(subrects); n++ {
+				c := fg
+				if sub&hextileSubrectsColoured != 0 {
+					if c, err = fb.readPixel(); err != nil {
+						return err
+					}
+				}
+				var geometry [2]byte
+				if err := fb.read(&geometry); err != nil {
+					return err
+				}
+				min := tile.Min.Add(image.Pt(int(geometry[0]>>4), int(geometry[0]&0x0f)))
+				sr := image.Rectangle{min, min.Add(image.Pt(int(geometry[1]>>4)+1, int(geometry[1]&0x0f)+1))}
+				if !sr.In(tile) {
+					return fmt.Errorf("subrectangle %v is outside of the tile %v", sr, tile)
+				}
+				draw.Draw(fb.img, sr, image.NewUniform(c), image.Point{}, draw.Src)
+			}
+		}
+	}
+	return nil
+}
+
+// readZRLE reads a ZRLE rectangle, see RFC 6143 §7.7.6.
+func (fb *framebuffer) readZRLE(r image.Rectangle) error {
+	var length uint32
+	if err := fb.read(&length); err != nil {
+		return err
+	}
+	data, err := fb.readN(int(length))
+	if err != nil {
+		return err
+	}
+	z := fb.zrle.reader(data)
+	for y := r.Min.Y; y < r.Max.Y; y += zrleTileSize {
+		for x := r.Min.X; x < r.Max.X; x += zrleTileSize {
+			tile := image.Rect(x, y, x+zrleTileSize, y+zrleTileSize).Intersect(r)
+			if err := fb.readZRLETile(z, tile); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (fb *framebuffer) readZRLETile(z io.Reader, tile image.Rectangle) error {
+	sub, err := readByte(z)
+	if err != nil {
+		return err
+	}
+	area := tile.Dx() * tile.Dy()
+	switch {
+	case sub == 0:
+		data, err := readFull(z, area*bytesPerCPixel)
+		if err != nil {
+			return err
+		}
+		fb.setPixels(tile, data, bytesPerCPixel)
+	case sub == 1:
+		c, err := readCPixel(z)
+		if err != nil {
+			return err
+		}
+		draw.Draw(fb.img, tile, image.NewUniform(c), image.Point{}, draw.Src)
+	case sub <= 16:
+		palette, err := readPalette(z, int(sub), readCPixel)
+		if err != nil {
+			return err
+		}
+		bits := 4
+		if sub == 2 {
+			bits = 1
+		} else if sub <= 4 {
+			bits = 2
+		}
+		rowBytes := (tile.Dx()*bits + 7) / 8
+		data, err := readFull(z, rowBytes*tile.Dy())
+		if err != nil {
+			return err
+		}
+		return fb.setPacked(tile, data, bits, palette)
+	case sub == 128 || sub >= 130:
+		var palette []color.RGBA
+		if sub >= 130 {
+			if palette, err = readPalette(z, int(sub)-128, readCPixel); err != nil {
+				return err
+			}
+		}
+		for n := 0; n < area; {
+			var c color.RGBA
+			run := 1
+			if palette == nil {
+				if c, err = readCPixel(z); err != nil {
+					return err
+				}
+				if run, err = readRunLength(z); err != nil {
+					return err
+				}
+			} else {
+				index, err := readByte(z)
+				if err != nil {
+					return err
+				}
+				if int(index&0x7f) >= len(palette) {
+					return fmt.Errorf("palette index %v out of range", index&0x7f)
+				}
+				c = palette[index&0x7f]
+				if index&0x80 != 0 {
+					if run, err = readRunLength(z); err != nil {
+						return err
+					}
+				}
+			}
+			if n+run > area {
+				return fmt.Errorf("run of %v pixels overflows the tile", run)
+			}
+			for ; run > 0; run-- {
+				fb.img.SetRGBA(tile.Min.X+n%tile.Dx(), tile.Min.Y+n/tile.Dx(), c)
+				n++
+			}
+		}
+	default:
+		return fmt.Errorf("unsupported ZRLE subencoding %v", sub)
+	}
+	return nil
+}
+
+// readTight reads a Tight rectangle, as described by the RFB community wiki.
+func (fb *framebuffer) readTight(r image.Rectangle) error {
+	control, err := fb.r.ReadByte()
+	if err != nil {
+		return err
+	}
+	for stream := 0; stream < len(fb.tight); stream++ {
+		if control&(1<<uint(stream)) != 0 {
+			fb.tight[stream].reset()
+		}
+	}
+	compression := control >> 4
+	switch {
+	case compression == tightCompressionFill:
+		c, err := readTPixel(fb.r)
+		if err != nil {
+			return err
+		}
+		draw.Draw(fb.img, r, image.NewUniform(c), image.Point{}, draw.Src)
+		return nil
+	case compression == tightCompressionJPEG:
+		length, err := fb.readCompactLength()
+		if err != nil {
+			return err
+		}
+		data, err := fb.readN(length)
+		if err != nil {
+			return err
+		}
+		img, err := jpeg.Decode(bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		draw.Draw(fb.img, r, img, img.Bounds().Min, draw.Src)
+		return nil
+	case compression&0x08 != 0:
+		return fmt.Errorf("unsupported Tight compression %#x", compression)
+	}
+
+	stream := int(compression & 0x03)
+	filter := byte(tightFilterCopy)
+	if compression&tightExplicitFilter != 0 {
+		if filter, err = fb.r.ReadByte(); err != nil {
+			return err
+		}
+	}
+	var palette []color.RGBA
+	bits := 8 * bytesPerCPixel
+	switch filter {
+	case tightFilterCopy, tightFilterGradient:
+	case tightFilterPalette:
+		colors, err := fb.r.ReadByte()
+		if err != nil {
+			return err
+		}
+		if palette, err = readPalette(fb.r, int(colors)+1, readTPixel); err != nil {
+			return err
+		}
+		bits = 8
+		if len(palette) == 2 {
+			bits = 1
+		}
+	default:
+		return fmt.Errorf("unsupported Tight filter %v", filter)
+	}
+	size := (r.Dx()*bits + 7) / 8 * r.Dy()
+	var data []byte
+	if size < tightMinToCompress {
+		if data, err = fb.readN(size); err != nil {
+			return err
+		}
+	} else {
+		length, err := fb.readCompactLength()
+		if err != nil {
+			return err
+		}
+		compressed, err := fb.readN(length)
+		if err != nil {
+			return err
+		}
+		if data, err = readFull(fb.tight[stream].reader(compressed), size); err != nil {
+			return err
+		}
+	}
+	switch filter {
+	case tightFilterPalette:
+		if len(palette) == 2 {
+			return fb.setPacked(r, data, 1, palette)
+		}
+		return fb.setPacked(r, data, 8, palette)
+	case tightFilterGradient:
+		fb.setGradient(r, data)
+	default:
+		fb.setRGB(r, data)
+	}
+	return nil
+}
+
+// readCompactLength reads the 1 to 3 byte Tight data length.
+func (fb *framebuffer) readCompactLength() (int, error) {
+	length := 0
+	for n := uint(0); n < 3; n++ {
+		b, err := fb.r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		if n == 2 {
+			return length | int(b)<<14, nil
+		}
+		length |= int(b&0x7f) << (7 * n)
+		if b&0x80 == 0 {
+			break
+		}
+	}
+	return length, nil
+}
+
+// setPixels sets the pixels of the rectangle from little endian pixel data
+// of bpp bytes per pixel, the CPIXELs of ZRLE are 3 bytes long.
+func (fb *framebuffer) setPixels(r image.Rectangle, data []byte, bpp int) {
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			fb.img.SetRGBA(x, y, color.RGBA{data[2], data[1], data[0], 0xff})
+			data = data[bpp:]
+		}
+	}
+}
+
+// setRGB sets the pixels of the rectangle from Tight red, green, blue pixel data.
+func (fb *framebuffer) setRGB(r image.Rectangle, data []byte) {
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			fb.img.SetRGBA(x, y, color.RGBA{data[0], data[1], data[2], 0xff})
+			data = data[3:]
+		}
+	}
+}
+
+// setGradient sets the pixels of the rectangle from Tight gradient filtered data,
+// which are the differences to the values predicted from the neighbour pixels.
+func (fb *framebuffer) setGradient(r image.Rectangle, data []byte) {
+	prev := make([]int, (r.Dx()+1)*3)
+	row := make([]int, (r.Dx()+1)*3)
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for i := 0; i < 3; i++ {
+			row[i] = 0
+		}
+		for x := 0; x < r.Dx(); x++ {
+			var c [3]byte
+			for i := 0; i < 3; i++ {
+				predicted := prev[(x+1)*3+i] + row[x*3+i] - prev[x*3+i]
+				if predicted < 0 {
+					predicted = 0
+				} else if predicted > 0xff {
+					predicted = 0xff
+				}
+				c[i] = data[0] + byte(predicted)
+				row[(x+1)*3+i] = int(c[i])
+				data = data[1:]
+			}
+			fb.img.SetRGBA(r.Min.X+x, y, color.RGBA{c[0], c[1], c[2], 0xff})
+		}
+		prev, row = row, prev
+	}
+}
+
+// setPacked sets the pixels of the rectangle from palette indexes
+// of 1, 2, 4 or 8 bits, every row starts at a new byte.
+func (fb *framebuffer) setPacked(r image.Rectangle, data []byte, bits int, palette []color.RGBA) error {
+	rowBytes := (r.Dx()*bits + 7) / 8
+	mask := byte(1<<uint(bits) - 1)
+	for y := 0; y < r.Dy(); y++ {
+		row := data[y*rowBytes:]
+		for x := 0; x < r.Dx(); x++ {
+			bit := x * bits
+			index := int(row[bit/8] >> uint(8-bits-bit%8) & mask)
+			if index >= len(palette) {
+				return fmt.Errorf("palette index %v out of range", index)
+			}
+			fb.img.SetRGBA(r.Min.X+x, r.Min.Y+y, palette[index])
+		}
+	}
+	return nil
+}
+
+// readPixel reads a single pixel in FramebufferPixelFormat.
+func (fb *framebuffer) readPixel() (color.RGBA, error) {
+	var b [bytesPerPixel]byte
+	if _, err := io.ReadFull(fb.r, b[:]); err != nil {
+		return color.RGBA{}, err
+	}
+	return color.RGBA{b[2], b[1], b[0], 0xff}, nil
+}
+
+func (fb *framebuffer) read(data interface{}) error {
+	return binary.Read(fb.r, binary.BigEndian, data)
+}
+
+func (fb *framebuffer) readN(n int) ([]byte, error) {
+	return readFull(fb.r, n)
+}
+
+func (fb *framebuffer) skip(n int) error {
+	_, err := fb.r.Discard(n)
+	return err
+}
+
+func readFull(r io.Reader, n int) ([]byte, error) {
+	if n < 0 || n > maxDataLength {
+		return nil, fmt.Errorf("bad data length %v", n)
+	}
+	data := make([]byte, n)
+	_, err := io.ReadFull(r, data)
+	return data, err
+}
+
+func readByte(r io.Reader) (byte, error) {
+	var b [1]byte
+	_, err := io.ReadFull(r, b[:])
+	return b[0], err
+}
+
+// readRunLength reads a ZRLE run length, which is the sum of its bytes plus one,
+// continued as long as the bytes are 255.
+func readRunLength(r io.Reader) (int, error) {
+	run := 1
+	for {
+		b, err := readByte(r)
+		if err != nil {
+			return 0, err
+		}
+		run += int(b)
+		if b != 0xff {
+			return run, nil
+		}
+	}
+}
+
+// readCPixel reads a 3 byte little endian ZRLE pixel.
+func readCPixel(r io.Reader) (color.RGBA, error) {
+	var b [3]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return color.RGBA{}, err
+	}
+	return color.RGBA{b[2], b[1], b[0], 0xff}, nil
+}
+
+// readTPixel reads a 3 byte red, green, blue Tight pixel.
+func readTPixel(r io.Reader) (color.RGBA, error) {
+	var b [3]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return color.RGBA{}, err
+	}
+	return color.RGBA{b[0], b[1], b[2], 0xff}, nil
+}
+
+func readPalette(r io.Reader, n int, readPixel func(io.Reader) (color.RGBA, error)) ([]color.RGBA, error) {
+	palette := make([]color.RGBA, n)
+	for i := range palette {
+		c, err := readPixel(r)
+		if err != nil {
+			return nil, err
+		}
+		palette[i] = c
+	}
+	return palette, nil
+}
+
+// zlibStream is a zlib stream continued over multiple rectangles,
+// the compressed data of every rectangle is appended to the stream.
+type zlibStream struct {
+	in bytes.Buffer
+	z  io.ReadCloser
+}
+
+func (s *zlibStream) reader(data []byte) io.Reader {
+	s.in.Write(data)
+	return s
+}
+
+func (s *zlibStream) Read(p []byte) (int, error) {
+	if s.z == nil {
+		// the stream header is in the first data
+		z, err := zlib.NewReader(&s.in)
+		if err != nil {
+			return 0, err
+		}
+		s.z = z
+	}
+	return s.z.Read(p)
+}
+
+func (s *zlibStream) reset() {
+	if s.z != nil {
+		s.z.Close()
+	}
+	s.in.Reset()
+	s.z = nil
+}
@@ -0,0 +1,230 @@
+package i2vnc
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"reflect"
+	"testing"
+)
+
+// rect writes a framebuffer update rectangle header.
+func rect(buf *bytes.Buffer, x, y, w, h uint16, enc int32) {
+	binary.Write(buf, binary.BigEndian, []uint16{x, y, w, h})
+	binary.Write(buf, binary.BigEndian, enc)
+}
+
+func compress(t *testing.T, data []byte) []byte {
+	var buf bytes.Buffer
+	z := zlib.NewWriter(&buf)
+	if _, err := z.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	z.Flush()
+	return buf.Bytes()
+}
+
+func Test_framebuffer_readUpdate(t *testing.T) {
+	red := color.RGBA{0xff, 0, 0, 0xff}
+	green := color.RGBA{0, 0xff, 0, 0xff}
+	blue := color.RGBA{0, 0, 0xff, 0xff}
+	gray := color.RGBA{0x80, 0x80, 0x80, 0xff}
+	tests := []struct {
+		name   string
+		rects  int
+		update func(buf *bytes.Buffer)
+		want   map[image.Point]color.RGBA
+		// lossy allows small differences from the wanted colors
+		lossy bool
+	}{
+		{"zrle plain rle", 1, func(buf *bytes.Buffer) {
+			rect(buf, 0, 0, 4, 2, encodingZRLE)
+			// 3 red, 5 blue pixels
+			data := compress(t, []byte{128, 0, 0, 0xff, 2, 0xff, 0, 0, 4})
+			binary.Write(buf, binary.BigEndian, uint32(len(data)))
+			buf.Write(data)
+		}, map[image.Point]color.RGBA{{0, 0}: red, {2, 0}: red, {3, 0}: blue, {3, 1}: blue}, false},
+		{"zrle palette rle", 1, func(buf *bytes.Buffer) {
+			rect(buf, 0, 0, 4, 2, encodingZRLE)
+			// green, run of 6 gray, green
+			data := compress(t, []byte{130, 0, 0xff, 0, 0x80, 0x80, 0x80, 0, 0x81, 5, 0})
+			binary.Write(buf, binary.BigEndian, uint32(len(data)))
+			buf.Write(data)
+		}, map[image.Point]color.RGBA{{0, 0}: green, {1, 0}: gray, {2, 1}: gray, {3, 1}: green}, false},
+		{"tight palette", 1, func(buf *bytes.Buffer) {
+			rect(buf, 0, 0, 3, 1, encodingTight)
+			// explicit palette filter with 3 colors, uncompressed indexes
+			buf.Write([]byte{0x40, tightFilterPalette, 2, 0xff, 0, 0, 0, 0xff, 0, 0, 0, 0xff, 2, 1, 0})
+		}, map[image.Point]color.RGBA{{0, 0}: blue, {1, 0}: green, {2, 0}: red}, false},
+		{"tight mono palette", 1, func(buf *bytes.Buffer) {
+			rect(buf, 0, 0, 10, 10, encodingTight)
+			// 2 colors, 2 bytes per row, compressed on stream 1
+			buf.Write([]byte{0x50, tightFilterPalette, 1, 0xff, 0, 0, 0, 0, 0xff})
+			rows := bytes.Repeat([]byte{0x80, 0x40}, 10)
+			data := compress(t, rows)
+			buf.WriteByte(byte(len(data)))
+			buf.Write(data)
+		}, map[image.Point]color.RGBA{{0, 0}: blue, {1, 0}: red, {9, 9}: blue, {8, 9}: red}, false},
+		{"tight gradient", 1, func(buf *bytes.Buffer) {
+			rect(buf, 0, 0, 3, 1, encodingTight)
+			// each pixel adds 0x40 gray to the one before
+			buf.Write([]byte{0x40, tightFilterGradient, 0x40, 0x40, 0x40, 0x40, 0x40, 0x40, 0x40, 0x40, 0x40})
+		}, map[image.Point]color.RGBA{{0, 0}: {0x40, 0x40, 0x40, 0xff}, {2, 0}: {0xc0, 0xc0, 0xc0, 0xff}}, false},
+		{"tight jpeg", 1, func(buf *bytes.Buffer) {
+			rect(buf, 0, 0, 8, 8, encodingTight)
+			img := image.NewRGBA(image.Rect(0, 0, 8, 8))
+			for i := range img.Pix {
+				img.Pix[i] = 0x80
+			}
+			var data bytes.Buffer
+			if err := jpeg.Encode(&data, img, nil); err != nil {
+				t.Fatal(err)
+			}
+			buf.Write([]byte{0x90, byte(data.Len()) | 0x80, byte(data.Len() >> 7)})
+			buf.Write(data.Bytes())
+		}, map[image.Point]color.RGBA{{0, 0}: gray, {7, 7}: gray}, true},
+		{"hextile", 1, func(buf *bytes.Buffer) {
+			rect(buf, 0, 0, 20, 2, encodingHextile)
+			// blue background with a red 2x2 subrectangle at 1,0
+			buf.Write([]byte{hextileBackground | hextileForeground | hextileAnySubrects,
+				0xff, 0, 0, 0, 0, 0, 0xff, 0, 1, 0x10, 0x11})
+			// the colors carry over, a green coloured subrectangle at 2,1
+			buf.Write([]byte{hextileAnySubrects | hextileSubrectsColoured, 1, 0, 0xff, 0, 0, 0x21, 0x00})
+		}, map[image.Point]color.RGBA{{0, 0}: blue, {1, 0}: red, {2, 1}: red, {3, 1}: blue,
+			{16, 0}: blue, {18, 1}: green, {19, 1}: blue}, false},
+		{"hextile raw", 1, func(buf *bytes.Buffer) {
+			rect(buf, 0, 0, 1, 1, encodingHextile)
+			buf.Write([]byte{hextileRaw, 0, 0xff, 0, 0})
+		}, map[image.Point]color.RGBA{{0, 0}: green}, false},
+		{"desktop size and last rect", 0xffff, func(buf *bytes.Buffer) {
+			rect(buf, 0, 0, 2, 1, encodingDesktopSize)
+			rect(buf, 0, 0, 2, 1, encodingRaw)
+			buf.Write([]byte{0, 0, 0xff, 0, 0xff, 0, 0, 0})
+			rect(buf, 0, 0, 0, 0, encodingLastRect)
+		}, map[image.Point]color.RGBA{{0, 0}: red, {1, 0}: blue}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			// a bell before the update is skipped
+			buf.Write([]byte{messageBell, messageFramebufferUpdate, 0})
+			binary.Write(&buf, binary.BigEndian, uint16(tt.rects))
+			tt.update(&buf)
+			fb := newFramebuffer(&buf, 32, 16)
+			if _, err := fb.readUpdate(); err != nil {
+				t.Fatalf("readUpdate() error = %v", err)
+			}
+			for p, want := range tt.want {
+				got := fb.img.RGBAAt(p.X, p.Y)
+				if tt.lossy {
+					if d := int(got.R) - int(want.R); d < -2 || d > 2 {
+						t.Errorf("pixel %v = %v, want %v", p, got, want)
+					}
+					continue
+				}
+				if got != want {
+					t.Errorf("pixel %v = %v, want %v", p, got, want)
+				}
+			}
+		})
+	}
+}
+
+func Test_framebuffer_desktopSize(t *testing.T) {
+	var buf bytes.Buffer
+	buf.Write([]byte{messageFramebufferUpdate, 0, 0, 1})
+	rect(&buf, 0, 0, 1920, 1080, encodingDesktopSize)
+	fb := newFramebuffer(&buf, 16, 16)
+	if _, err := fb.readUpdate(); err != nil {
+		t.Fatalf("readUpdate() error = %v", err)
+	}
+	if got := fb.img.Bounds().Size(); got != image.Pt(1920, 1080) {
+		t.Errorf("readUpdate() size = %v, want 1920x1080", got)
+	}
+}
+
+func Test_framebuffer_readUpdate_errors(t *testing.T) {
+	tests := []struct {
+		name   string
+		update []byte
+	}{
+		{"unknown message", []byte{0x7f}},
+		{"outside of the framebuffer", []byte{0, 0, 0, 1, 0, 0, 0, 0, 0, 17, 0, 1, 0, 0, 0, 0}},
+		{"unknown encoding", []byte{0, 0, 0, 1, 0, 0, 0, 0, 0, 1, 0, 1, 0, 0, 0, 5}},
+		{"truncated", []byte{0, 0, 0, 1, 0, 0, 0, 0, 0, 1, 0, 1, 0, 0, 0, 0, 0xff}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fb := newFramebuffer(bytes.NewReader(tt.update), 16, 16)
+			if _, err := fb.readUpdate(); err == nil {
+				t.Error("readUpdate() expected an error")
+			}
+		})
+	}
+}
+
+func Test_framebuffer_extendedDesktopSize(t *testing.T) {
+	var buf bytes.Buffer
+	buf.Write([]byte{messageFramebufferUpdate, 0, 0, 1})
+	rect(&buf, 0, 0, 3840, 1080, encodingExtendedDesktopSize)
+	buf.Write([]byte{2, 0, 0, 0})
+	binary.Write(&buf, binary.BigEndian, []uint16{0, 1, 0, 0, 1920, 1080, 0, 0})
+	binary.Write(&buf, binary.BigEndian, []uint16{0, 2, 1920, 0, 1920, 1080, 0, 0})
+	fb := newFramebuffer(&buf, 16, 16)
+	damage, err := fb.readUpdate()
+	if err != nil {
+		t.Fatalf("readUpdate() error = %v", err)
+	}
+	if want := image.Rect(0, 0, 3840, 1080); fb.img.Bounds() != want || damage != want {
+		t.Errorf("readUpdate() bounds = %v, damage = %v, want %v", fb.img.Bounds(), damage, want)
+	}
+	want := []image.Rectangle{image.Rect(0, 0, 1920, 1080), image.Rect(1920, 0, 3840, 1080)}
+	if !reflect.DeepEqual(fb.screens, want) {
+		t.Errorf("readUpdate() screens = %v, want %v", fb.screens, want)
+	}
+}
+
+func Test_framebuffer_cursor(t *testing.T) {
+	var buf bytes.Buffer
+	buf.Write([]byte{messageFramebufferUpdate, 0, 0, 2})
+	rect(&buf, 1, 0, 2, 1, encodingCursor)
+	buf.Write([]byte{0, 0, 0xff, 0, 0, 0xff, 0, 0, 0x80})
+	rect(&buf, 5, 6, 0, 0, encodingPointerPos)
+	fb := newFramebuffer(&buf, 16, 16)
+	damage, err := fb.readUpdate()
+	if err != nil {
+		t.Fatalf("readUpdate() error = %v", err)
+	}
+	if !damage.Empty() {
+		t.Errorf("readUpdate() damage = %v, want none", damage)
+	}
+	if !fb.cursorChanged || fb.cursorHotspot != image.Pt(1, 0) {
+		t.Errorf("cursor changed = %v with hotspot %v, want hotspot 1,0", fb.cursorChanged, fb.cursorHotspot)
+	}
+	if got := fb.cursor.RGBAAt(0, 0); got != (color.RGBA{0xff, 0, 0, 0xff}) {
+		t.Errorf("cursor pixel 0,0 = %v, want opaque red", got)
+	}
+	if got := fb.cursor.RGBAAt(1, 0); got.A != 0 {
+		t.Errorf("cursor pixel 1,0 = %v, want transparent", got)
+	}
+	if !fb.pointerMoved || fb.pointer != image.Pt(5, 6) {
+		t.Errorf("pointer moved = %v to %v, want 5,6", fb.pointerMoved, fb.pointer)
+	}
+}
+
+func Test_framebuffer_ledState(t *testing.T) {
+	var buf bytes.Buffer
+	buf.Write([]byte{messageFramebufferUpdate, 0, 0, 1})
+	rect(&buf, 0, 0, 0, 0, encodingLEDState)
+	buf.WriteByte(ledCapsLock | ledScrollLock)
+	fb := newFramebuffer(&buf, 16, 16)
+	if _, err := fb.readUpdate(); err != nil {
+		t.Fatalf("readUpdate() error = %v", err)
+	}
+	if want := (Locks{CapsLock: true, ScrollLock: true}); fb.locks == nil || *fb.locks != want {
+		t.Errorf("readUpdate() locks = %v, want %v", fb.locks, want)
+	}
+}
@@ -0,0 +1,121 @@
+package i2vnc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	HookPreConnect     = "preConnect"
+	HookPostConnect    = "postConnect"
+	HookPostDisconnect = "postDisconnect"
+	HookConnectFailed  = "connectFailed"
+
+	defaultHookTimeoutMs = 5000
+	// hookWaitDelay is how long the output of an exited hook command is read
+	hookWaitDelay = 100 * time.Millisecond
+)
+
+// hooksConfig are the commands run on the connection lifecycle events.
+// The global hooks run before the ones of the remote.
+type hooksConfig struct {
+	PreConnect     []hookConfig `yaml:"preConnect"`
+	PostConnect    []hookConfig `yaml:"postConnect"`
+	PostDisconnect []hookConfig `yaml:"postDisconnect"`
+	ConnectFailed  []hookConfig `yaml:"connectFailed"`
+}
+
+// hookConfig is a command run with sh -c. It gets the event, the remote and
+// its address in the I2VNC_EVENT, I2VNC_REMOTE, I2VNC_SERVER and I2VNC_PORT
+// environment variables, and the connect error in I2VNC_ERROR.
+type hookConfig struct {
+	Command string `yaml:"command"`
+	// TimeoutMs kills the command when it runs longer, 5000 if unset.
+	TimeoutMs int `yaml:"timeoutMs"`
+	// Abort aborts the switch when a preConnect command fails,
+	// the failures are only logged otherwise.
+	Abort bool `yaml:"abort"`
+}
+
+func (c hooksConfig) get(event string) []hookConfig {
+	switch event {
+	case HookPreConnect:
+		return c.PreConnect
+	case HookPostConnect:
+		return c.PostConnect
+	case HookPostDisconnect:
+		return c.PostDisconnect
+	case HookConnectFailed:
+		return c.ConnectFailed
+	}
+	return nil
+}
+
+func (c hooksConfig) validate() error {
+	for _, event := range []string{HookPreConnect, HookPostConnect, HookPostDisconnect, HookConnectFailed} {
+		for _, h := range c.get(event) {
+			if strings.TrimSpace(h.Command) == "" {
+				return fmt.Errorf("%v hook without a command", event)
+			}
+			if h.TimeoutMs < 0 {
+				return fmt.Errorf("%v hook %q timeout can't be negative", event, h.Command)
+			}
+			if h.Abort && event != HookPreConnect {
+				return fmt.Errorf("only %v hooks can abort, %v hook %q can't", HookPreConnect, event, h.Command)
+			}
+		}
+	}
+	return nil
+}
+
+func (c hookConfig) timeout() time.Duration {
+	if c.TimeoutMs == 0 {
+		return defaultHookTimeoutMs * time.Millisecond
+	}
+	return time.Duration(c.TimeoutMs) * time.Millisecond
+}
+
+// hookEnv returns the environment variables passed to the hooks of the event.
+func hookEnv(event string, ci configItem, err error) []string {
+	env := []string{
+		"I2VNC_EVENT=" + event,
+		"I2VNC_REMOTE=" + ci.Name,
+		"I2VNC_SERVER=" + ci.Server,
+		"I2VNC_PORT=" + strconv.Itoa(ci.Port),
+	}
+	if err != nil {
+		env = append(env, "I2VNC_ERROR="+err.Error())
+	}
+	return env
+}
+
+// runHook runs the hook command, killing it after its timeout.
+func runHook(h hookConfig, env []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), h.timeout())
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "sh", "-c", h.Command)
+	cmd.Env = append(os.Environ(), env...)
+	// background processes started by the command, like ssh tunnels,
+	// keep its output open after it exits
+	cmd.WaitDelay = hookWaitDelay
+	out, err := cmd.CombinedOutput()
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("timed out after %v", h.timeout())
+	}
+	if errors.Is(err, exec.ErrWaitDelay) {
+		return nil
+	}
+	if err != nil {
+		if out := strings.TrimSpace(string(out)); out != "" {
+			return fmt.Errorf("%s: %s", err, out)
+		}
+		return err
+	}
+	return nil
+}
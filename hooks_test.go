@@ -0,0 +1,114 @@
+package i2vnc
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_hooksConfig_validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		c       hooksConfig
+		wantErr bool
+	}{
+		{"empty", hooksConfig{}, false},
+		{"aborting preConnect", hooksConfig{PreConnect: []hookConfig{{Command: "true", Abort: true}}}, false},
+		{"no command", hooksConfig{PostConnect: []hookConfig{{Command: " "}}}, true},
+		{"negative timeout", hooksConfig{PostConnect: []hookConfig{{Command: "true", TimeoutMs: -1}}}, true},
+		{"aborting postConnect", hooksConfig{PostConnect: []hookConfig{{Command: "true", Abort: true}}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.c.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_runHook(t *testing.T) {
+	env := hookEnv(HookConnectFailed, configItem{Name: "mac", Server: "10.0.0.1", Port: 5900}, errors.New("refused"))
+	tests := []struct {
+		name    string
+		h       hookConfig
+		wantErr string
+	}{
+		{"success", hookConfig{Command: "true"}, ""},
+		{"env", hookConfig{Command: `test "$I2VNC_EVENT $I2VNC_REMOTE $I2VNC_SERVER:$I2VNC_PORT $I2VNC_ERROR" = "connectFailed mac 10.0.0.1:5900 refused"`}, ""},
+		{"failure with output", hookConfig{Command: "echo no input; exit 3"}, "exit status 3: no input"},
+		{"timeout", hookConfig{Command: "sleep 5", TimeoutMs: 50}, "timed out after 50ms"},
+		{"background process", hookConfig{Command: "sleep 5 &", TimeoutMs: 2000}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start := time.Now()
+			err := runHook(tt.h, env)
+			if (err == nil && tt.wantErr != "") || (err != nil && err.Error() != tt.wantErr) {
+				t.Errorf("runHook() error = %v, want %q", err, tt.wantErr)
+			}
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Errorf("runHook() took %v", elapsed)
+			}
+		})
+	}
+}
+
+func Test_pipeline_hooks(t *testing.T) {
+	log := filepath.Join(t.TempDir(), "hooks.log")
+	record := hookConfig{Command: `echo "$I2VNC_EVENT $I2VNC_REMOTE $I2VNC_ERROR" >> ` + log}
+	global := hooksConfig{
+		PreConnect:     []hookConfig{record},
+		PostConnect:    []hookConfig{record},
+		PostDisconnect: []hookConfig{record},
+		ConnectFailed:  []hookConfig{record},
+	}
+	i, r := newTestPipeline(Config{
+		"mac":   {Hotkey: "F9"},
+		"linux": {Hotkey: "F10", Hooks: hooksConfig{PreConnect: []hookConfig{{Command: "exit 1", Abort: true}}}},
+		"win":   {Hotkey: "F8"},
+	}, false)
+	i.SetHooks(global)
+	press(i, "F9")
+	release(i, "F9")
+	// aborted by the linux hook, mac stays connected
+	press(i, "F10")
+	release(i, "F10")
+	r.SetConnectError(errors.New("refused"))
+	press(i, "F8")
+	release(i, "F8")
+	r.SetConnectError(nil)
+	press(i, "F8")
+	release(i, "F8")
+	press(i, "F8")
+
+	if got := r.Connects(); !reflect.DeepEqual(got, []string{"mac", "win", "win"}) {
+		t.Errorf("connects = %v", got)
+	}
+	data, err := os.ReadFile(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"preConnect mac",
+		"postConnect mac",
+		"preConnect linux",
+		"preConnect win",
+		"postDisconnect mac",
+		"connectFailed win refused",
+		"preConnect win",
+		"postConnect win",
+		"postDisconnect win",
+	}
+	got := strings.Split(strings.TrimSpace(string(data)), "\n")
+	for n := range got {
+		got[n] = strings.TrimSpace(got[n])
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("hooks = %q, want %q", got, want)
+	}
+}
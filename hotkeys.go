@@ -0,0 +1,334 @@
+package i2vnc
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"reflect"
+	"strings"
+)
+
+const (
+	ActionNext        = "next"
+	ActionPrevious    = "previous"
+	ActionDisconnect  = "disconnect"
+	ActionRelease     = "release"
+	ActionQuit        = "quit"
+	ActionReload      = "reload"
+	ActionPointerMode = "pointerMode"
+	ActionCommand     = "command"
+	ActionSend        = "send"
+)
+
+// hotkeyConfig binds a key combination to an action.
+type hotkeyConfig struct {
+	Keys   string `yaml:"keys"`
+	Action string `yaml:"action"`
+	// Command is run with sh -c by the command action.
+	Command string `yaml:"command,omitempty"`
+	// Send is the key combination the send action sends to the remote.
+	Send string `yaml:"send,omitempty"`
+}
+
+// hotkeyAction handles an action, the hotkey holds its arguments.
+type hotkeyAction func(i *inputHandler, h hotkeyConfig) error
+
+// hotkeyActions are the actions by name.
+var hotkeyActions = map[string]hotkeyAction{
+	ActionNext:        func(i *inputHandler, h hotkeyConfig) error { return i.switchBy(1) },
+	ActionPrevious:    func(i *inputHandler, h hotkeyConfig) error { return i.switchBy(-1) },
+	ActionDisconnect:  actionDisconnect,
+	ActionRelease:     actionRelease,
+	ActionQuit:        actionQuit,
+	ActionReload:      actionReload,
+	ActionPointerMode: func(i *inputHandler, h hotkeyConfig) error { i.togglePointerMode(); return nil },
+	ActionCommand:     actionCommand,
+	ActionSend:        actionSend,
+}
+
+func (h hotkeyConfig) validate() error {
+	if err := validateHotkey(h.Keys); err != nil {
+		return err
+	}
+	return h.validateAction()
+}
+
+// validateAction validates the action and its arguments.
+func (h hotkeyConfig) validateAction() error {
+	if _, ok := hotkeyActions[h.Action]; !ok {
+		return fmt.Errorf("unknown hotkey action %q", h.Action)
+	}
+	switch h.Action {
+	case ActionRelease:
+		if err := validateHotkey(h.Keys); err != nil {
+			return err
+		}
+		// the input grabs again on the key press
+		if isSequence(h.Keys) {
+			return fmt.Errorf("%v hotkey %q can't be a sequence", h.Action, h.Keys)
+		}
+	case ActionCommand:
+		if strings.TrimSpace(h.Command) == "" {
+			return fmt.Errorf("%v hotkey %q without a command", h.Action, h.Keys)
+		}
+	case ActionSend:
+		defs, err := getConfigDefs(h.Send, false)
+		if err != nil {
+			return err
+		}
+		for _, def := range defs {
+			if !def.IsKey {
+				return fmt.Errorf("%v hotkey %q can only send keys, not %v", h.Action, h.Keys, def.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// SetHotkeys handles the hotkeys from now on, ahead of the hotkeys of the remotes.
+func (i *inputHandler) SetHotkeys(hotkeys []hotkeyConfig) {
+	i.hotkeys = hotkeys
+}
+
+// SetConfigLoader loads the config again on the reload action.
+func (i *inputHandler) SetConfigLoader(load func() (Config, Settings, error)) {
+	i.loadConfig = load
+}
+
+// RunAction runs the action, as if its hotkey was pressed. The arg is the
+// command of the command action, the key combination sent by the send action
+// and the keys grabbing the input again after the release action. The action
+// runs on the event loop of the input, if it has one.
+func (i *inputHandler) RunAction(action, arg string) error {
+	h := hotkeyConfig{Action: action}
+	switch action {
+	case ActionCommand:
+		h.Command = arg
+	case ActionSend:
+		h.Send = arg
+	case ActionRelease:
+		h.Keys = arg
+	}
+	if err := h.validateAction(); err != nil {
+		return err
+	}
+	p, ok := i.in.(eventPoster)
+	if !ok {
+		return i.runAction(h)
+	}
+	done := make(chan error, 1)
+	if !p.post(func() { done <- i.runAction(h) }) {
+		return fmt.Errorf("the input isn't running")
+	}
+	return <-done
+}
+
+// runAction runs the action of the hotkey.
+func (i *inputHandler) runAction(h hotkeyConfig) error {
+	action, ok := hotkeyActions[h.Action]
+	if !ok {
+		return fmt.Errorf("unknown hotkey action %q", h.Action)
+	}
+	i.l.Infof("running %v action", h.Action)
+	return action(i, h)
+}
+
+// remoteNames returns the names of the remotes, sorted.
+func (i *inputHandler) remoteNames() []string {
+	return i.c.names()
+}
+
+// switchBy switches to the remote n places after the current one, in the
+// order of their names. Without a connection the first or last one is next.
+func (i *inputHandler) switchBy(n int) error {
+	names := i.remoteNames()
+	if len(names) == 0 {
+		return fmt.Errorf("no remotes configured")
+	}
+	current := -1
+	if i.r.IsConnected() {
+		for k, name := range names {
+			if name == i.ci.Name {
+				current = k
+			}
+		}
+	}
+	next := current + n
+	if current < 0 && n < 0 {
+		next = len(names) + n
+	}
+	next = (next%len(names) + len(names)) % len(names)
+	return i.switchTo(names[next])
+}
+
+// switchTo switches to the remote and shows the outcome.
+func (i *inputHandler) switchTo(cname string) error {
+	if err := i.switchRemote(cname); err != nil {
+		// fmt.Print("\a") // bell terminal ring
+		i.l.WithField(LoggerFieldRemote, cname).Warn(err)
+		i.notify(Status{Grabbed: true, Remote: cname, Connected: i.r.IsConnected(), Err: err})
+		return err
+	}
+	i.notify(Status{Grabbed: true, Remote: cname, Connected: true, Switched: true})
+	return nil
+}
+
+func actionDisconnect(i *inputHandler, h hotkeyConfig) error {
+	if !i.r.IsConnected() {
+		return fmt.Errorf("not connected")
+	}
+	cname := i.ci.Name
+	if err := i.disconnect(); err != nil {
+		return err
+	}
+	i.notify(Status{Grabbed: true, Remote: cname})
+	return nil
+}
+
+// releaser is implemented by inputs that can release the grab
+// until the keys are pressed again.
+type releaser interface {
+	release(keys string) error
+}
+
+func actionRelease(i *inputHandler, h hotkeyConfig) error {
+	r, ok := i.in.(releaser)
+	if !ok {
+		return fmt.Errorf("the input can't release the grab")
+	}
+	if h.Keys == "" {
+		return fmt.Errorf("%v needs the keys grabbing the input again", h.Action)
+	}
+	if err := r.release(h.Keys); err != nil {
+		return err
+	}
+	// the keys released meanwhile aren't seen
+	i.held = nil
+	s := i.grabbedStatus()
+	s.Grabbed, s.Released = false, true
+	i.notify(s)
+	return nil
+}
+
+func actionQuit(i *inputHandler, h hotkeyConfig) error {
+	s := Status{}
+	if i.r.IsConnected() {
+		s.Remote = i.ci.Name
+	}
+	if err := i.disconnect(); err != nil {
+		i.l.WithError(err).Warn("failed disconnecting")
+	}
+	i.notify(s)
+	return i.in.Ungrab()
+}
+
+func actionReload(i *inputHandler, h hotkeyConfig) error {
+	if i.loadConfig == nil {
+		return fmt.Errorf("the config can't be reloaded")
+	}
+	c, s, err := i.loadConfig()
+	e := TraceEvent{Source: traceSourceConfig, Type: traceTypeReload}
+	if err != nil {
+		e.Error = err.Error()
+		i.t.write(e)
+		return fmt.Errorf("failed reloading config: %s", err)
+	}
+	e.Config, e.Hotkeys, e.Panic, e.Sequences = stripPasswords(c), s.Hotkeys, &s.Panic, &s.Sequences
+	i.t.write(e)
+	if err := i.reload(c, s); err != nil {
+		return fmt.Errorf("failed reloading config: %s", err)
+	}
+	i.l.Infof("reloaded %v remotes", len(c))
+	return nil
+}
+
+// configSetter is implemented by remotes connecting with a config of their own.
+type configSetter interface {
+	SetConfig(c Config)
+}
+
+// reload uses the config and settings from now on, the connected remote
+// stays connected if it's still configured.
+func (i *inputHandler) reload(c Config, s Settings) error {
+	if err := i.SetPanic(s.Panic); err != nil {
+		return err
+	}
+	restart := []struct {
+		section           string
+		started, reloaded interface{}
+	}{
+		{"grab", i.started.Grab, s.Grab},
+		{"overlay", i.started.Overlay, s.Overlay},
+		{"notifications", i.started.Notifications, s.Notifications},
+		{"metrics", i.started.Metrics, s.Metrics},
+		{"logging", i.started.Logging, s.Logging},
+	}
+	for _, r := range restart {
+		if !reflect.DeepEqual(r.started, r.reloaded) {
+			i.l.Warnf("the %v settings changed, they take effect after a restart", r.section)
+		}
+	}
+	i.c = c
+	i.hotkeys = s.Hotkeys
+	i.SetSequences(s.Sequences)
+	i.SetHooks(s.Hooks)
+	if cs, ok := i.r.(configSetter); ok {
+		cs.SetConfig(c)
+	}
+	if pi, ok := i.in.(passiveInput); ok && pi.passive() {
+		if err := pi.grabHotkeys(); err != nil {
+			i.l.WithError(err).Error("failed grabbing the reloaded hotkeys")
+		}
+	}
+	if !i.r.IsConnected() {
+		return nil
+	}
+	ci, ok := c[i.ci.Name]
+	if !ok {
+		cname := i.ci.Name
+		i.l.Infof("%q is no longer configured, disconnecting", cname)
+		i.disconnect()
+		i.notify(Status{Grabbed: true, Remote: cname})
+		return nil
+	}
+	remote := i.e.remote
+	i.setItem(ci)
+	i.e.remote = remote
+	return nil
+}
+
+func actionCommand(i *inputHandler, h hotkeyConfig) error {
+	return i.startCommand(h.Command, hookEnv(h.Action, i.ci, nil))
+}
+
+// startCommand starts the command with sh -c, without waiting for it to exit.
+func startCommand(command string, env []string) error {
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Env = append(os.Environ(), env...)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	go cmd.Wait()
+	return nil
+}
+
+// actionSend presses the keys of the combination in order and releases them
+// in reverse, the keymap isn't applied.
+func actionSend(i *inputHandler, h hotkeyConfig) error {
+	defs, err := getConfigDefs(h.Send, true)
+	if err != nil {
+		return err
+	}
+	for _, def := range defs {
+		if err := i.r.SendKeyEvent(def.Name, def.Key, true); err != nil {
+			return err
+		}
+		i.lockToggled(def.Name)
+	}
+	for k := len(defs) - 1; k >= 0; k-- {
+		if err := i.r.SendKeyEvent(defs[k].Name, defs[k].Key, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,369 @@
+package i2vnc
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+func Test_hotkeyConfig_validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		h       hotkeyConfig
+		wantErr bool
+	}{
+		{"next", hotkeyConfig{Keys: "Control_L+n", Action: ActionNext}, false},
+		{"unknown key", hotkeyConfig{Keys: "Control_L+nope", Action: ActionNext}, true},
+		{"unknown action", hotkeyConfig{Keys: "F8", Action: "explode"}, true},
+		{"command", hotkeyConfig{Keys: "F8", Action: ActionCommand, Command: "xterm"}, false},
+		{"command without command", hotkeyConfig{Keys: "F8", Action: ActionCommand}, true},
+		{"send", hotkeyConfig{Keys: "F8", Action: ActionSend, Send: "Control_L+Alt_L+Delete"}, false},
+		{"send without keys", hotkeyConfig{Keys: "F8", Action: ActionSend}, true},
+		{"send button", hotkeyConfig{Keys: "F8", Action: ActionSend, Send: "Button_Left"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.h.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func threeRemotes() Config {
+	return Config{
+		"linux": {Hotkey: "F8"},
+		"mac":   {Hotkey: "F9"},
+		"win":   {Hotkey: "F10"},
+	}
+}
+
+func Test_pipeline_hotkeyCombo(t *testing.T) {
+	i, r := newTestPipeline(Config{"mac": {Hotkey: "Control_L+F9"}}, false)
+	press(i, "F9")
+	release(i, "F9")
+	if len(r.Connects()) != 0 {
+		t.Fatalf("connected without Control_L")
+	}
+	press(i, "Control_L", "F9")
+	release(i, "F9", "Control_L")
+	if got := r.Connects(); !reflect.DeepEqual(got, []string{"mac"}) {
+		t.Errorf("connects = %v", got)
+	}
+}
+
+func Test_pipeline_switchActions(t *testing.T) {
+	i, r := newTestPipeline(threeRemotes(), false)
+	i.SetHotkeys([]hotkeyConfig{
+		{Keys: "Control_L+n", Action: ActionNext},
+		{Keys: "Control_L+p", Action: ActionPrevious},
+	})
+	for _, key := range []string{"n", "n", "n", "n", "p"} {
+		press(i, "Control_L", key)
+		release(i, key, "Control_L")
+	}
+	if got, want := r.Connects(), []string{"linux", "mac", "win", "linux", "win"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("connects = %v, want %v", got, want)
+	}
+
+	// without a connection previous is the last one
+	i, r = newTestPipeline(threeRemotes(), false)
+	i.SetHotkeys([]hotkeyConfig{{Keys: "F7", Action: ActionPrevious}})
+	press(i, "F7")
+	if got := r.Connects(); !reflect.DeepEqual(got, []string{"win"}) {
+		t.Errorf("connects = %v", got)
+	}
+}
+
+func Test_pipeline_actions(t *testing.T) {
+	tests := []struct {
+		name string
+		h    hotkeyConfig
+		// after connecting to mac and pressing the hotkey
+		wantConnected bool
+		wantGrabbed   bool
+		wantEvents    []RemoteEvent
+	}{
+		{"disconnect", hotkeyConfig{Action: ActionDisconnect}, false, true, nil},
+		{"quit", hotkeyConfig{Action: ActionQuit}, false, false, nil},
+		{"release", hotkeyConfig{Action: ActionRelease}, true, false, nil},
+		{"send", hotkeyConfig{Action: ActionSend, Send: "Control_L+Alt_L+Delete"}, true, true, []RemoteEvent{
+			keyEv("Control_L", true), keyEv("Alt_L", true), keyEv("Delete", true),
+			keyEv("Delete", false), keyEv("Alt_L", false), keyEv("Control_L", false),
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			i, r := newTestPipeline(threeRemotes(), false)
+			tt.h.Keys = "Super_L+F7"
+			i.SetHotkeys([]hotkeyConfig{tt.h})
+			press(i, "F9")
+			release(i, "F9")
+			r.Reset()
+			press(i, "Super_L", "F7")
+			if got := r.IsConnected(); got != tt.wantConnected {
+				t.Errorf("connected = %v, want %v", got, tt.wantConnected)
+			}
+			if got := i.IsGrabbed(); got != tt.wantGrabbed {
+				t.Errorf("grabbed = %v, want %v", got, tt.wantGrabbed)
+			}
+			want := append([]RemoteEvent{keyEv("Super_L", true)}, tt.wantEvents...)
+			if got := stripTime(r.Events()); !reflect.DeepEqual(got, want) {
+				t.Errorf("events = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func Test_inputHandler_RunAction(t *testing.T) {
+	tests := []struct {
+		name        string
+		action, arg string
+		wantErr     bool
+		wantEvents  []RemoteEvent
+	}{
+		{"next", ActionNext, "", false, nil},
+		{"send", ActionSend, "Control_L+Delete", false, []RemoteEvent{
+			keyEv("Control_L", true), keyEv("Delete", true), keyEv("Delete", false), keyEv("Control_L", false),
+		}},
+		{"unknown action", "nope", "", true, nil},
+		{"command without a command", ActionCommand, " ", true, nil},
+		{"release without keys", ActionRelease, "", true, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			i, r := newTestPipeline(threeRemotes(), false)
+			press(i, "F9")
+			release(i, "F9")
+			r.Reset()
+			// the action runs in between the events fed in meanwhile
+			done := make(chan error)
+			go func() { done <- i.RunAction(tt.action, tt.arg) }()
+			press(i, "a")
+			release(i, "a")
+			if err := <-done; (err != nil) != tt.wantErr {
+				t.Fatalf("RunAction() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			var got []RemoteEvent
+			for _, re := range keyEvents(r.Events()) {
+				if re.Name != "a" {
+					got = append(got, re)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.wantEvents) {
+				t.Errorf("events = %v, want %v", got, tt.wantEvents)
+			}
+		})
+	}
+}
+
+func Test_pipeline_release(t *testing.T) {
+	i, r := newTestPipeline(threeRemotes(), false)
+	var statuses statusRecorder
+	i.AddIndicator(&statuses)
+	i.SetHotkeys([]hotkeyConfig{{Keys: "Super_L+F7", Action: ActionRelease}})
+	press(i, "F9")
+	release(i, "F9")
+	press(i, "Super_L", "F7")
+	release(i, "F7", "Super_L")
+	r.Reset()
+	// the keys go to the local desktop until the hotkey is pressed again
+	press(i, "a")
+	release(i, "a")
+	press(i, "Super_L", "F7")
+	release(i, "F7", "Super_L")
+	if !i.IsGrabbed() {
+		t.Fatal("not grabbed again")
+	}
+	press(i, "a")
+	want := []RemoteEvent{keyEv("F7", false), keyEv("Super_L", false), keyEv("a", true)}
+	if got := stripTime(r.Events()); !reflect.DeepEqual(got, want) {
+		t.Errorf("events = %v, want %v", got, want)
+	}
+	wantStatuses := statusRecorder{
+		{Grabbed: true, Remote: "mac", Connected: true, Switched: true},
+		{Remote: "mac", Connected: true, Released: true},
+		{Grabbed: true, Remote: "mac", Connected: true},
+	}
+	if !reflect.DeepEqual(statuses, wantStatuses) {
+		t.Errorf("statuses = %+v, want %+v", statuses, wantStatuses)
+	}
+}
+
+func Test_pipeline_releaseDisconnected(t *testing.T) {
+	i, _ := newTestPipeline(threeRemotes(), false)
+	i.SetHotkeys([]hotkeyConfig{
+		{Keys: "Super_L+F6", Action: ActionDisconnect},
+		{Keys: "Super_L+F7", Action: ActionRelease},
+	})
+	press(i, "F9")
+	release(i, "F9")
+	press(i, "Super_L", "F6")
+	release(i, "F6", "Super_L")
+	var statuses statusRecorder
+	i.AddIndicator(&statuses)
+	// the remote disconnected from isn't shown again
+	for n := 0; n < 2; n++ {
+		press(i, "Super_L", "F7")
+		release(i, "F7", "Super_L")
+	}
+	want := statusRecorder{{Released: true}, {Grabbed: true}}
+	if !reflect.DeepEqual(statuses, want) {
+		t.Errorf("statuses = %+v, want %+v", statuses, want)
+	}
+}
+
+func Test_pipeline_commandAction(t *testing.T) {
+	i, _ := newTestPipeline(threeRemotes(), false)
+	i.SetHotkeys([]hotkeyConfig{{Keys: "F7", Action: ActionCommand, Command: "xterm"}})
+	var got []string
+	i.startCommand = func(command string, env []string) error {
+		got = append(append(got, command), env...)
+		return nil
+	}
+	press(i, "F9")
+	release(i, "F9")
+	press(i, "F7")
+	want := []string{"xterm", "I2VNC_EVENT=command", "I2VNC_REMOTE=mac", "I2VNC_SERVER=", "I2VNC_PORT=0"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("started %q, want %q", got, want)
+	}
+}
+
+func Test_pipeline_reloadAction(t *testing.T) {
+	i, r := newTestPipeline(threeRemotes(), false)
+	i.SetHotkeys([]hotkeyConfig{{Keys: "F7", Action: ActionReload}})
+	reloaded := Config{"mac": {Name: "mac", Hotkey: "F11"}, "win": {Name: "win", Hotkey: "F12"}}
+	loadErr := errors.New("invalid config")
+	i.SetConfigLoader(func() (Config, Settings, error) {
+		if loadErr != nil {
+			return nil, Settings{}, loadErr
+		}
+		return reloaded, Settings{Hotkeys: []hotkeyConfig{{Keys: "F6", Action: ActionNext}}}, nil
+	})
+	press(i, "F9")
+	release(i, "F9")
+	// a failed reload keeps the config
+	press(i, "F7")
+	release(i, "F7")
+	loadErr = nil
+	press(i, "F7")
+	release(i, "F7")
+	// mac stays connected, F9 is sent to it and F6 switches
+	r.Reset()
+	press(i, "F9")
+	release(i, "F9")
+	press(i, "F6")
+	if got, want := r.Connects(), []string{"mac", "win"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("connects = %v, want %v", got, want)
+	}
+	if got := stripTime(r.Events())[:2]; !reflect.DeepEqual(got, []RemoteEvent{keyEv("F9", true), keyEv("F9", false)}) {
+		t.Errorf("events = %v", got)
+	}
+}
+
+// configRemote is a MockRemote with the config pushed to it.
+type configRemote struct {
+	*MockRemote
+	config Config
+}
+
+func (r *configRemote) SetConfig(c Config) {
+	r.config = c
+}
+
+func Test_pipeline_reloadSettings(t *testing.T) {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	logger.SetLevel(logrus.WarnLevel)
+	warnings := test.NewLocal(logger)
+	r := &configRemote{MockRemote: NewMockRemote(logrus.NewEntry(logger), testRemoteScreen)}
+	i := NewMockInput(logger, r, Config{"mac": {Name: "mac", Hotkey: "F9"}}, testLocalScreen, false)
+	i.Grab()
+	hotkeys := []hotkeyConfig{{Keys: "F7", Action: ActionReload}}
+	if err := i.SetSettings(Settings{Hotkeys: hotkeys}); err != nil {
+		t.Fatal(err)
+	}
+	log := filepath.Join(t.TempDir(), "hooks.log")
+	reloaded := Config{"mac": {Name: "mac", Hotkey: "F9"}, "win": {Name: "win", Hotkey: "F10"}}
+	i.SetConfigLoader(func() (Config, Settings, error) {
+		return reloaded, Settings{
+			Hotkeys: hotkeys,
+			Panic:   panicConfig{Keys: "Scroll_Lock"},
+			Hooks:   hooksConfig{PreConnect: []hookConfig{{Command: `echo "$I2VNC_REMOTE" >> ` + log}}},
+			Overlay: overlayConfig{Enabled: true},
+		}, nil
+	})
+	press(i, "F7")
+	release(i, "F7")
+	if !reflect.DeepEqual(r.config, reloaded) {
+		t.Errorf("remote config = %v, want %v", r.config, reloaded)
+	}
+	var got []string
+	for _, e := range warnings.AllEntries() {
+		got = append(got, e.Message)
+	}
+	if want := []string{"the overlay settings changed, they take effect after a restart"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("warnings = %q, want %q", got, want)
+	}
+	// the reloaded hooks run, and the reloaded panic key idles the input
+	press(i, "F10")
+	release(i, "F10")
+	press(i, "Scroll_Lock")
+	press(i, "F9")
+	if got, want := r.Connects(), []string{"win"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("connects = %v, want %v", got, want)
+	}
+	data, err := os.ReadFile(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.TrimSpace(string(data)); got != "win" {
+		t.Errorf("hooks ran for %q, want win", got)
+	}
+}
+
+func TestReplay_reload(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.PanicLevel)
+	config := Config{"mac": {Name: "mac", Hotkey: "F9"}}
+	var trace bytes.Buffer
+	tracer := NewTracer(logger, &trace)
+	mock := NewMockRemote(logrus.NewEntry(logger), testRemoteScreen)
+	i := NewMockInput(logger, NewTraceRemote(mock, tracer), config, testLocalScreen, false)
+	i.SetHotkeys([]hotkeyConfig{{Keys: "F7", Action: ActionReload}})
+	i.SetConfigLoader(func() (Config, Settings, error) {
+		return Config{"mac": {Name: "mac", Hotkey: "F9"}, "linux": {Name: "linux", Hotkey: "F10"}}, Settings{}, nil
+	})
+	i.SetTracer(tracer)
+	i.Grab()
+
+	press(i, "F9")
+	release(i, "F9")
+	press(i, "F7")
+	release(i, "F7")
+	// only configured by the reload
+	press(i, "F10")
+	release(i, "F10")
+	press(i, "a")
+	release(i, "a")
+
+	result, err := Replay(logger, bytes.NewReader(trace.Bytes()), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := result.Diff(); len(diff) != 0 {
+		t.Errorf("Replay() differs from the trace:\n%v", strings.Join(diff, "\n"))
+	}
+	if got := mock.Connects(); !reflect.DeepEqual(got, []string{"mac", "linux"}) {
+		t.Errorf("connects = %v", got)
+	}
+}
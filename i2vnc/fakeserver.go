@@ -0,0 +1,46 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+
+	"github.com/runz0rd/i2vnc/vnctest"
+	"github.com/sirupsen/logrus"
+)
+
+func fakeServer(args []string) {
+	fs := flag.NewFlagSet("fakeserver", flag.ExitOnError)
+	var (
+		port   = fs.Int("port", 5900, "port to listen on")
+		host   = fs.String("host", "127.0.0.1", "host to listen on")
+		pw     = fs.String("pw", "", "password, enables vnc authentication")
+		width  = fs.Uint("width", 1920, "framebuffer width")
+		height = fs.Uint("height", 1080, "framebuffer height")
+		name   = fs.String("name", "i2vnc fakeserver", "desktop name")
+		proto  = fs.String("proto", "3.8", "protocol version, 3.3 or 3.8")
+	)
+	fs.Parse(args)
+	logger := logrus.New()
+
+	version := vnctest.ProtocolVersion38
+	if *proto == "3.3" {
+		version = vnctest.ProtocolVersion33
+	}
+	s := vnctest.NewServer(logger, vnctest.Config{
+		Width:           uint16(*width),
+		Height:          uint16(*height),
+		Name:            *name,
+		ProtocolVersion: version,
+		Password:        *pw,
+	})
+	if err := s.Listen(fmt.Sprintf("%v:%v", *host, *port)); err != nil {
+		logger.WithError(err).Fatalf("failed starting fake server")
+	}
+	// serve until interrupted
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt)
+	<-sig
+	s.Close()
+}
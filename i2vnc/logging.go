@@ -0,0 +1,56 @@
+package main
+
+import (
+	"flag"
+	"strings"
+
+	"github.com/runz0rd/i2vnc"
+)
+
+// logFlags override the logging settings of the config file.
+type logFlags struct {
+	debug  *bool
+	format *string
+	level  *string
+	levels *string
+	output *string
+	file   *string
+}
+
+func addLogFlags(fs *flag.FlagSet) logFlags {
+	return logFlags{
+		debug:  fs.Bool("d", false, "debug mode, same as -log-level=debug"),
+		format: fs.String("log-format", "", "log format, text or json"),
+		level:  fs.String("log-level", "", "log level of all subsystems"),
+		levels: fs.String("log-levels", "", "log levels by subsystem, like input=debug,remote=warn"),
+		output: fs.String("log-output", "", "log output, stderr, file or journald"),
+		file:   fs.String("log-file", "", "path of the log file, rotated when it grows too big"),
+	}
+}
+
+func (f logFlags) apply(s *i2vnc.Settings) {
+	if *f.format != "" {
+		s.Logging.Format = *f.format
+	}
+	if *f.level != "" {
+		s.Logging.Level = *f.level
+	}
+	if *f.debug {
+		s.Logging.Level = "debug"
+	}
+	if *f.levels != "" {
+		if s.Logging.Levels == nil {
+			s.Logging.Levels = map[string]string{}
+		}
+		for _, sl := range strings.Split(*f.levels, ",") {
+			subsystem, level, _ := strings.Cut(sl, "=")
+			s.Logging.Levels[strings.TrimSpace(subsystem)] = strings.TrimSpace(level)
+		}
+	}
+	if *f.output != "" {
+		s.Logging.Output = *f.output
+	}
+	if *f.file != "" {
+		s.Logging.File = *f.file
+	}
+}
@@ -2,35 +2,133 @@ package main
 
 import (
 	"flag"
+	"os"
 
 	"github.com/runz0rd/i2vnc"
 	"github.com/sirupsen/logrus"
 )
 
+// commands are run instead of the input grabber
+// when their name is the first argument
+var commands = map[string]func(args []string){
+	"fakeserver": fakeServer,
+	"replay":     replay,
+	"screenshot": screenshot,
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			command(os.Args[2:])
+			return
+		}
+	}
 	var (
-		debug   = flag.Bool("d", false, "debug mode")
 		cfile   = flag.String("cfile", "~/.config/i2vnc.yaml", "path to the config file")
 		forever = flag.Bool("forever", false, "run forever")
+		metrics = flag.String("metrics", "", "listen address of the metrics endpoint, overrides the config")
+		trace   = flag.String("trace", "", "path to write the input and remote event trace to")
+		overlay = flag.Bool("overlay", false, "show the active remote on screen, same as enabling the overlay in the config")
+		notify  = flag.Bool("notify", false, "send desktop notifications, same as enabling notifications in the config")
+		view    = flag.Bool("view", false, "show the remote screen in a window and read the input from it, instead of grabbing it")
+		passive = flag.Bool("passive", false, "only grab the hotkeys until one is pressed, same as enabling passive grabbing in the config")
+		lf      = addLogFlags(flag.CommandLine)
 	)
 	flag.Parse()
-	logger := logrus.New()
-	if *debug {
-		logger.SetLevel(logrus.DebugLevel)
+	// the flags override the loaded settings, also the reloaded ones
+	applyFlags := func(s *i2vnc.Settings) {
+		lf.apply(s)
+		if *metrics != "" {
+			s.Metrics.Listen = *metrics
+		}
+		if *overlay {
+			s.Overlay.Enabled = true
+		}
+		if *notify {
+			s.Notifications.Enabled = true
+		}
+		if *passive {
+			s.Grab.Passive = true
+		}
+	}
+	// logs config loading failures, before the logging config is known
+	var bootstrap i2vnc.Settings
+	lf.apply(&bootstrap)
+	loggers, err := i2vnc.NewLoggers(bootstrap.Logging)
+	if err != nil {
+		logrus.WithError(err).Fatalf("failed initializing logging")
 	}
 
-	config, err := i2vnc.LoadConfig(*cfile)
+	config, settings, err := i2vnc.LoadConfig(*cfile)
 	if err != nil {
-		logger.WithField(logrus.FieldKeyFile, *cfile).WithError(err).Fatalf("failed loading configuration")
+		loggers.Config.WithField(i2vnc.LoggerFieldPath, *cfile).WithError(err).Fatalf("failed loading configuration")
+	}
+	loggers.Close()
+	applyFlags(&settings)
+	if loggers, err = i2vnc.NewLoggers(settings.Logging); err != nil {
+		logrus.WithError(err).Fatalf("failed initializing logging")
 	}
+	defer loggers.Close()
+	loggers.Config.WithField(i2vnc.LoggerFieldPath, *cfile).Infof("loaded %v remotes", len(config))
 
-	remote := i2vnc.NewVncRemote(logger, config)
+	var tracer *i2vnc.Tracer
+	vncRemote := i2vnc.NewVncRemote(loggers.Remote, config)
+	var remote i2vnc.Remote = vncRemote
+	if *trace != "" {
+		file, err := os.Create(*trace)
+		if err != nil {
+			loggers.Input.WithField(i2vnc.LoggerFieldPath, *trace).WithError(err).Fatalf("failed creating trace")
+		}
+		defer file.Close()
+		tracer = i2vnc.NewTracer(loggers.Input, file)
+		remote = i2vnc.NewTraceRemote(remote, tracer)
+	}
+	remote, err = i2vnc.WithMetrics(loggers.Remote, settings.Metrics, remote)
+	if err != nil {
+		loggers.Remote.WithError(err).Fatalf("failed starting metrics listener")
+	}
 
-	input, err := i2vnc.NewX11Input(logger, remote, config, *forever)
+	input, err := i2vnc.NewX11Input(loggers.Input, remote, config, *forever)
 	if err != nil {
-		logger.WithError(err).Fatalf("failed initializing input")
+		loggers.Input.WithError(err).Fatalf("failed initializing input")
+	}
+	if *view {
+		viewer, err := input.View()
+		if err != nil {
+			loggers.Input.WithError(err).Fatalf("failed opening view window")
+		}
+		vncRemote.SetViewer(viewer)
+	}
+	input.SetPassive(settings.Grab.Passive)
+	if settings.Grab.Monitor != "" {
+		input.SetMonitor(settings.Grab.Monitor)
+	}
+	if err := input.SetSettings(settings); err != nil {
+		loggers.Input.WithError(err).Fatalf("failed setting panic sequence")
+	}
+	if tracer != nil {
+		input.SetTracer(tracer)
+	}
+	input.SetConfigLoader(func() (i2vnc.Config, i2vnc.Settings, error) {
+		config, settings, err := i2vnc.LoadConfig(*cfile)
+		applyFlags(&settings)
+		return config, settings, err
+	})
+	if settings.Overlay.Enabled {
+		if err := input.ShowOverlay(settings.Overlay); err != nil {
+			loggers.Input.WithError(err).Warn("failed showing overlay")
+		}
+	}
+	if settings.Notifications.Enabled {
+		notifier, err := i2vnc.NewDBusNotifier(loggers.Input, settings.Notifications)
+		if err != nil {
+			loggers.Input.WithError(err).Warn("failed enabling notifications")
+		} else {
+			defer notifier.Close()
+			input.AddIndicator(notifier)
+		}
 	}
 	if err := input.Grab(); err != nil {
-		logger.WithError(err).Fatalf("failed grabbing input")
+		loggers.Input.WithError(err).Fatalf("failed grabbing input")
 	}
 }
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/runz0rd/i2vnc"
+	"github.com/sirupsen/logrus"
+)
+
+func replay(args []string) {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	var (
+		debug = fs.Bool("d", false, "debug mode")
+		cfile = fs.String("cfile", "", "path to the config file, the traced config is used by default")
+	)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: i2vnc replay [flags] trace.jsonl\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	logger := logrus.New()
+	if *debug {
+		logger.SetLevel(logrus.DebugLevel)
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	var config i2vnc.Config
+	if *cfile != "" {
+		var err error
+		if config, _, err = i2vnc.LoadConfig(*cfile); err != nil {
+			logger.WithField(logrus.FieldKeyFile, *cfile).WithError(err).Fatalf("failed loading configuration")
+		}
+	}
+	file, err := os.Open(fs.Arg(0))
+	if err != nil {
+		logger.WithError(err).Fatalf("failed opening trace")
+	}
+	defer file.Close()
+	result, err := i2vnc.Replay(logger, file, config)
+	if err != nil {
+		logger.WithError(err).Fatalf("failed replaying trace")
+	}
+	diff := result.Diff()
+	for _, line := range diff {
+		fmt.Println(line)
+	}
+	if len(diff) > 0 {
+		logger.Errorf("replay differs from the trace in %v of %v events", len(diff), len(result.Want))
+		os.Exit(1)
+	}
+	logger.Infof("replay matches all %v traced events", len(result.Want))
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"image/png"
+	"os"
+	"strings"
+
+	"github.com/runz0rd/i2vnc"
+	"github.com/sirupsen/logrus"
+)
+
+func screenshot(args []string) {
+	fs := flag.NewFlagSet("screenshot", flag.ExitOnError)
+	var (
+		debug = fs.Bool("d", false, "debug mode")
+		cfile = fs.String("cfile", "~/.config/i2vnc.yaml", "path to the config file")
+		out   = fs.String("o", "", "path of the PNG to write, <remote>.png by default")
+	)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: i2vnc screenshot <remote> [flags]\n")
+		fs.PrintDefaults()
+	}
+	// the remote may come before the flags
+	var cname string
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cname, args = args[0], args[1:]
+	}
+	fs.Parse(args)
+	if cname == "" && fs.NArg() == 1 {
+		cname = fs.Arg(0)
+	} else if cname == "" || fs.NArg() > 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	logger := logrus.New()
+	if *debug {
+		logger.SetLevel(logrus.DebugLevel)
+	}
+	if *out == "" {
+		*out = cname + ".png"
+	}
+
+	config, _, err := i2vnc.LoadConfig(*cfile)
+	if err != nil {
+		logger.WithField(i2vnc.LoggerFieldPath, *cfile).WithError(err).Fatalf("failed loading configuration")
+	}
+	img, err := i2vnc.Screenshot(logger, config, cname)
+	if err != nil {
+		logger.WithField(i2vnc.LoggerFieldRemote, cname).WithError(err).Fatalf("failed taking screenshot")
+	}
+	file, err := os.Create(*out)
+	if err != nil {
+		logger.WithField(i2vnc.LoggerFieldPath, *out).WithError(err).Fatalf("failed creating screenshot")
+	}
+	defer file.Close()
+	if err := png.Encode(file, img); err != nil {
+		logger.WithField(i2vnc.LoggerFieldPath, *out).WithError(err).Fatalf("failed writing screenshot")
+	}
+	logger.WithField(i2vnc.LoggerFieldPath, *out).Infof("wrote screenshot of %q", cname)
+}
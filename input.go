@@ -0,0 +1,566 @@
+package i2vnc
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/runz0rd/i2vnc/x11"
+	"github.com/sirupsen/logrus"
+)
+
+// inputHandler is the window system independent part of the input pipeline.
+// It resolves raw key and button events, catches hotkeys and forwards
+// the resolved events to the remote.
+type inputHandler struct {
+	l       *logrus.Entry
+	in      Input
+	r       Remote
+	c       Config
+	ci      configItem
+	e       *event
+	forever bool
+	t       *Tracer
+	// remoteScreen is the remote screen size the pointer position is on
+	remoteScreen Screen
+	// remoteMonitors is the monitor layout reported by the remote
+	remoteMonitors []Monitor
+	// indicators are shown every status change
+	indicators []Indicator
+	// hooks runs the hooks of a connection lifecycle event, returning
+	// the error aborting the switch. No hooks run while it's nil.
+	hooks     func(event string, ci configItem, err error) error
+	hooksConf hooksConfig
+	// held are the resolved keys held down, for the hotkey combinations
+	held map[string]bool
+	// hotkeys are the global hotkeys, bound to actions
+	hotkeys []hotkeyConfig
+	// loadConfig loads the config again on the reload action
+	loadConfig func() (Config, Settings, error)
+	// started are the settings the input started with, the reload
+	// action warns about the changes only taking effect after a restart
+	started Settings
+	// startCommand starts the commands of the command action
+	startCommand func(command string, env []string) error
+	// panicSeq detects the panic sequence of panicConf
+	panicSeq  *panicDetector
+	panicConf panicConfig
+	// idle ignores the events after the panic sequence
+	idle bool
+	// now is the time of the event handled, for the timed key sequences
+	now func() time.Time
+	// seq is the sequence hotkey being typed
+	seq     sequenceState
+	seqConf sequencesConfig
+	// afterFunc times out the sequences, they only time out
+	// on the next key event while it's nil
+	afterFunc func(d time.Duration, f func()) *time.Timer
+	// remoteLocks are the lock states of the remotes by name, as tracked
+	// from the lock keys sent to them
+	remoteLocks map[string]Locks
+	// locksPending syncs the lock states of the remote switched to
+	locksPending bool
+}
+
+func newInputHandler(l *logrus.Entry, in Input, r Remote, c Config, forever bool) *inputHandler {
+	ci := configItem{}
+	// the default panic sequence is valid
+	panicSeq, _ := newPanicDetector(panicConfig{})
+	return &inputHandler{l: l, in: in, r: r, c: c, ci: ci, e: ci.newEvent(), forever: forever,
+		held: map[string]bool{}, startCommand: startCommand, panicSeq: panicSeq, now: time.Now,
+		afterFunc: time.AfterFunc}
+}
+
+func (i *inputHandler) switchRemote(cname string) error {
+	ci, err := i.c.getItem(cname)
+	if err != nil {
+		return err
+	}
+	// the current remote stays connected when the switch is aborted
+	if err := i.hook(HookPreConnect, ci, nil); err != nil {
+		return err
+	}
+	if err := i.disconnect(); err != nil {
+		return err
+	}
+	if ci.Wol.enabled() {
+		// waking the remote up takes a while
+		i.notify(Status{Grabbed: true, Remote: cname, Connecting: true})
+	}
+	if err := i.r.Connect(cname, ci.timeout()); err != nil {
+		i.hook(HookConnectFailed, ci, err)
+		return err
+	}
+	i.remoteScreen = i.r.Screen()
+	i.remoteMonitors = i.r.Monitors()
+	i.setItem(ci)
+	i.locksPending = ci.Locks.Sync
+	// set coords to middle of remote screen
+	i.e.remote = Screen{i.remoteScreen.X / 2, i.remoteScreen.Y / 2}
+	// set the remote pointer to the middle of remote screen,
+	// the local pointer is kept in the middle of local screen
+	localScreen := i.in.Screen()
+	i.pointerEvent(0, i.e.getButtonForMotion(), int16(localScreen.X/2), int16(localScreen.Y/2), false)
+	i.hook(HookPostConnect, ci, nil)
+	return nil
+}
+
+// setItem handles the events with the config of the remote from now on.
+func (i *inputHandler) setItem(ci configItem) {
+	i.ci = ci
+	i.e = ci.newEvent()
+	if ai, ok := i.in.(absoluteInput); ok && ai.absolutePointer() {
+		i.e.absolute = true
+	}
+	i.e.monitors = i.monitors()
+}
+
+// disconnect disconnects from the remote,
+// running the postDisconnect hooks if it was connected.
+func (i *inputHandler) disconnect() error {
+	connected := i.r.IsConnected()
+	if err := i.r.Disconnect(); err != nil {
+		return err
+	}
+	if connected {
+		i.hook(HookPostDisconnect, i.ci, nil)
+	}
+	return nil
+}
+
+// SetHooks runs the global hooks, followed by the ones of the remote,
+// on the connection lifecycle events from now on.
+func (i *inputHandler) SetHooks(c hooksConfig) {
+	i.hooksConf = c
+	// the hooks replaced by a replay stay replaced
+	if i.hooks == nil {
+		i.hooks = i.configHooks
+	}
+}
+
+func (i *inputHandler) configHooks(event string, ci configItem, err error) error {
+	hooks := append(append([]hookConfig(nil), i.hooksConf.get(event)...), ci.Hooks.get(event)...)
+	return i.runHooks(hooks, event, ci, err)
+}
+
+// SetSettings uses the hotkeys, key sequences, panic sequence and hooks
+// of the settings from now on. The other sections are only used when
+// starting, reloading warns about their changes.
+func (i *inputHandler) SetSettings(s Settings) error {
+	if err := i.SetPanic(s.Panic); err != nil {
+		return err
+	}
+	i.SetHotkeys(s.Hotkeys)
+	i.SetSequences(s.Sequences)
+	i.SetHooks(s.Hooks)
+	i.started = s
+	return nil
+}
+
+// hook runs the hooks of the event and traces whether they aborted the switch.
+func (i *inputHandler) hook(event string, ci configItem, err error) error {
+	if i.hooks == nil {
+		return nil
+	}
+	abort := i.hooks(event, ci, err)
+	e := TraceEvent{Source: traceSourceHook, Type: event, Name: ci.Name}
+	if abort != nil {
+		e.Error = abort.Error()
+	}
+	i.t.write(e)
+	return abort
+}
+
+func (i *inputHandler) runHooks(hooks []hookConfig, event string, ci configItem, err error) error {
+	env := hookEnv(event, ci, err)
+	for _, h := range hooks {
+		l := i.l.WithField(LoggerFieldRemote, ci.Name)
+		l.Debugf("running %v hook %q", event, h.Command)
+		if err := runHook(h, env); err != nil {
+			if h.Abort {
+				l.WithError(err).Warnf("%v hook %q failed, aborting the switch", event, h.Command)
+				return fmt.Errorf("%v hook %q failed: %s", event, h.Command, err)
+			}
+			l.WithError(err).Warnf("%v hook %q failed", event, h.Command)
+		}
+	}
+	return nil
+}
+
+// grabbedStatus is the status of the grabbed input, with the remote
+// while it's connected.
+func (i *inputHandler) grabbedStatus() Status {
+	s := Status{Grabbed: true}
+	if i.r.IsConnected() {
+		s.Remote, s.Connected = i.ci.Name, true
+	}
+	return s
+}
+
+// AddIndicator shows the status changes with the indicator from now on.
+func (i *inputHandler) AddIndicator(ind Indicator) {
+	i.indicators = append(i.indicators, ind)
+}
+
+func (i *inputHandler) notify(s Status) {
+	for _, ind := range i.indicators {
+		ind.Show(s)
+	}
+}
+
+// SetTracer traces the events fed into the pipeline from now on,
+// starting with the trace header. The hotkeys, the panic sequence and
+// the sequences config are set before it.
+func (i *inputHandler) SetTracer(t *Tracer) {
+	i.t = t
+	local, panicConf, seqConf := i.in.Screen(), i.panicConf, i.seqConf
+	t.start(TraceEvent{Local: &local, Config: i.c, Hotkeys: i.hotkeys, Panic: &panicConf, Sequences: &seqConf,
+		Forever: i.forever})
+}
+
+// handleKeysym handles a key event, state and keycode are only traced.
+func (i *inputHandler) handleKeysym(state uint16, keycode uint8, keysym uint32, isPress bool) {
+	if i.idle {
+		return
+	}
+	// the trace has the time the sequences are timed by
+	now := i.now()
+	te := TraceEvent{Time: now, Type: traceTypeKey, State: state, Keycode: keycode, Key: keysym, IsPress: isPress}
+	// the panic sequence goes first, nothing is sent to the remote before it
+	if i.panicSeq.handle(keysym, isPress, now) {
+		i.t.input(te)
+		i.panicked()
+		return
+	}
+	i.syncRemote()
+	i.t.input(te)
+	kdef, err := newEventDef(keysym, 0, true, isPress)
+	if err != nil {
+		i.l.WithError(err).Error("handleKeyEvent failed")
+		return
+	}
+	i.e.handle(*kdef)
+	i.holdKeys()
+	pending := i.seq.pending()
+	if i.handleSequence(now) || i.handleHotkeys() {
+		i.deactivateUnconnected()
+		return
+	}
+	i.sendEvent()
+	if pending {
+		// the sequence was aborted
+		i.deactivateUnconnected()
+	}
+}
+
+func (i *inputHandler) handlePointerEvent(state uint16, button uint8, x, y int16, isPress bool) {
+	if i.idle {
+		return
+	}
+	i.syncRemote()
+	i.t.input(TraceEvent{Type: traceTypePointer, State: state, Button: button, X: int32(x), Y: int32(y), IsPress: isPress})
+	i.pointerEvent(state, button, x, y, isPress)
+}
+
+func (i *inputHandler) pointerEvent(state uint16, button uint8, x, y int16, isPress bool) {
+	// DebugX11Event(i.l, "X11Input", state, 0, button, x, y, isPress)
+	bdef, err := newEventDef(0, button, false, isPress)
+	if err != nil {
+		i.l.WithError(err).Error("handlePointerEvent failed")
+		return
+	}
+	i.e.handle(*bdef)
+
+	i.e.setCoords(uint16(x), uint16(y), i.in.Screen(), i.r.Screen())
+	i.sendEvent()
+}
+
+// syncRemote catches up with the changes of the remote, before handling
+// input events. It continues from where the remote moved its pointer to,
+// so the pointer events don't move it back, and keeps the pointer on
+// the same spot of a resized remote screen. The lock states of a remote
+// switched to are synced before the first event sent to it.
+func (i *inputHandler) syncRemote() {
+	if !i.r.IsConnected() {
+		return
+	}
+	screen, monitors := i.r.Screen(), i.r.Monitors()
+	if screen != i.remoteScreen || !monitorsEqual(monitors, i.remoteMonitors) {
+		i.remoteResized(screen, monitors)
+	}
+	if pos, ok := i.r.PointerPos(); ok {
+		i.remotePointerMoved(pos)
+	}
+	i.syncLocksPending()
+}
+
+func (i *inputHandler) remotePointerMoved(pos Screen) {
+	i.t.input(TraceEvent{Type: traceTypePointerPos, X: int32(pos.X), Y: int32(pos.Y)})
+	i.e.remote = pos
+}
+
+// localResized traces a change of the local screen size,
+// the input reports the new size from now on.
+func (i *inputHandler) localResized(screen Screen) {
+	i.t.input(TraceEvent{Type: traceTypeLocalResize, Local: &screen})
+	i.l.Infof("local screen resized to %vx%v", screen.X, screen.Y)
+}
+
+func (i *inputHandler) remoteResized(screen Screen, monitors []Monitor) {
+	i.t.input(TraceEvent{Type: traceTypeResize, Screen: &screen, Monitors: monitors})
+	if screen != i.remoteScreen {
+		i.l.Infof("remote screen resized from %vx%v to %vx%v", i.remoteScreen.X, i.remoteScreen.Y, screen.X, screen.Y)
+		i.e.remote = rescaleCoords(i.e.remote, i.remoteScreen, screen)
+	}
+	if !monitorsEqual(monitors, i.remoteMonitors) {
+		i.l.Infof("remote monitors changed to %v", monitors)
+	}
+	i.remoteScreen = screen
+	i.remoteMonitors = monitors
+	i.e.monitors = i.monitors()
+}
+
+// monitors returns the monitors of the remote, the configured ones
+// take precedence over the ones reported by the remote.
+func (i *inputHandler) monitors() []Monitor {
+	if len(i.ci.Monitors) > 0 {
+		return i.ci.Monitors
+	}
+	return i.remoteMonitors
+}
+
+// jumpToMonitor moves the remote pointer to the center of the nth monitor.
+func (i *inputHandler) jumpToMonitor(n int) {
+	monitors := i.monitors()
+	if n >= len(monitors) {
+		i.l.Warnf("can't move the pointer to monitor %v, the remote has %v", n+1, len(monitors))
+		return
+	}
+	i.l.Infof("moving the pointer to monitor %v", monitors[n])
+	i.e.remote = monitors[n].center()
+	if err := i.r.SendPointerEvent("Motion", x11.Buttons["Motion"], i.e.remote.X, i.e.remote.Y, false); err != nil {
+		i.l.Trace(err)
+	}
+}
+
+// handleScroll turns high resolution scroll deltas, in wheel clicks,
+// into wheel button clicks. Positive deltas scroll down and right.
+func (i *inputHandler) handleScroll(dx, dy float64) {
+	if i.idle {
+		return
+	}
+	i.syncRemote()
+	i.t.input(TraceEvent{Type: traceTypeScroll, DX: dx, DY: dy})
+	x, y := i.e.smooth.clicks(dx, dy)
+	i.clickButtons(x, x11.Buttons["Button_7"], x11.Buttons["Button_6"])
+	i.clickButtons(y, x11.Buttons["Button_Down"], x11.Buttons["Button_Up"])
+}
+
+// handleClick presses and releases the button without moving the pointer.
+func (i *inputHandler) handleClick(button uint8) {
+	if i.idle {
+		return
+	}
+	i.syncRemote()
+	i.t.input(TraceEvent{Type: traceTypeClick, Button: button})
+	i.clickButtons(1, button, button)
+}
+
+// clickButtons presses and releases the positive button n times,
+// or the negative button -n times, without moving the pointer.
+func (i *inputHandler) clickButtons(n int, positive, negative uint8) {
+	button := positive
+	if n < 0 {
+		n, button = -n, negative
+	}
+	for ; n > 0; n-- {
+		for _, isPress := range []bool{true, false} {
+			bdef, err := newEventDef(0, button, false, isPress)
+			if err != nil {
+				i.l.WithError(err).Error("clickButtons failed")
+				return
+			}
+			i.e.handle(*bdef)
+			i.sendEvent()
+		}
+	}
+}
+
+func (i *inputHandler) sendEvent() {
+	i.sendDefs(i.e.resolve())
+}
+
+func (i *inputHandler) sendDefs(defs []EventDef) {
+	for _, def := range defs {
+		if def.IsKey {
+			if err := i.r.SendKeyEvent(def.Name, def.Key, def.IsPress); err != nil {
+				i.l.Trace(err)
+			} else if def.IsPress {
+				i.lockToggled(def.Name)
+			}
+		} else {
+			if err := i.r.SendPointerEvent(def.Name, def.Button, i.e.remote.X, i.e.remote.Y, def.IsPress); err != nil {
+				i.l.Trace(err)
+			}
+		}
+	}
+}
+
+// holdKeys keeps track of the resolved keys held down.
+func (i *inputHandler) holdKeys() {
+	if i.held == nil {
+		i.held = map[string]bool{}
+	}
+	for _, def := range i.e.resolve() {
+		if !def.IsKey {
+			continue
+		}
+		if def.IsPress {
+			i.held[def.Name] = true
+		} else {
+			delete(i.held, def.Name)
+		}
+	}
+}
+
+// hotkeyPressed reports whether the current event presses a key of the
+// hotkey while the other keys of the hotkey are held down.
+func (i *inputHandler) hotkeyPressed(cname, hotkey string) bool {
+	hotkeyDefs, err := getConfigDefs(hotkey, true)
+	if err != nil {
+		i.l.WithError(err).Warnf("failed getting hotkey for %q", cname)
+		return false
+	}
+	current := i.e.resolve()
+	if len(edIntersection(hotkeyDefs, current)) == 0 {
+		return false
+	}
+	for _, def := range hotkeyDefs {
+		if !i.held[def.Name] && len(edIntersection([]EventDef{def}, current)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// passiveInput is implemented by inputs that can grab only the hotkeys,
+// grabbing the whole input once one is pressed.
+type passiveInput interface {
+	passive() bool
+	// grabHotkeys grabs the hotkeys again after they changed
+	grabHotkeys() error
+	// deactivate ungrabs the input, leaving the hotkeys grabbed,
+	// unless it's ungrabbed already
+	deactivate()
+}
+
+// deactivateUnconnected gives the input back to the local desktop in passive
+// grab mode, when a hotkey or sequence didn't end with a connected remote.
+func (i *inputHandler) deactivateUnconnected() {
+	pi, ok := i.in.(passiveInput)
+	if !ok || !pi.passive() || i.r.IsConnected() || i.seq.pending() {
+		return
+	}
+	pi.deactivate()
+	// the keys released meanwhile aren't seen
+	i.held = nil
+}
+
+// holdHotkey holds down the keys of the hotkey, as pressed
+// while the input wasn't grabbed.
+func (i *inputHandler) holdHotkey(keys string) {
+	defs, err := getConfigDefs(keys, true)
+	if err != nil {
+		return
+	}
+	if i.held == nil {
+		i.held = map[string]bool{}
+	}
+	for _, def := range defs {
+		i.held[def.Name] = true
+	}
+}
+
+// ungrab gives the input back to the local desktop. In passive grab mode
+// the hotkeys stay grabbed, other inputs stop.
+func (i *inputHandler) ungrab() error {
+	if pi, ok := i.in.(passiveInput); ok && pi.passive() {
+		pi.deactivate()
+		// the keys released meanwhile aren't seen
+		i.held = nil
+		return nil
+	}
+	return i.in.Ungrab()
+}
+
+// eventPoster is implemented by inputs handling the events on an event loop,
+// post runs f on it, and reports false when the loop isn't running.
+type eventPoster interface {
+	post(f func()) bool
+}
+
+// pointerCenterer is implemented by inputs that keep the local pointer
+// in the screen center while in relative pointer mode.
+type pointerCenterer interface {
+	centerPointer()
+}
+
+func (i *inputHandler) togglePointerMode() {
+	if ai, ok := i.in.(absoluteInput); ok && ai.absolutePointer() {
+		i.l.Info("the pointer is always absolute in view mode")
+		return
+	}
+	mode := PointerModeRelative
+	if i.e.toggleAbsolute() {
+		mode = PointerModeAbsolute
+	} else if pc, ok := i.in.(pointerCenterer); ok {
+		pc.centerPointer()
+	}
+	i.l.Infof("switched to %v pointer mode", mode)
+}
+
+func (i *inputHandler) handleHotkeys() bool {
+	if i.r.IsConnected() && i.ci.Pointer.ModeHotkey != "" &&
+		i.hotkeyPressed(i.ci.Name, i.ci.Pointer.ModeHotkey) {
+		i.togglePointerMode()
+		return true
+	}
+	if i.r.IsConnected() {
+		for n, hotkey := range i.ci.Pointer.MonitorHotkeys {
+			if i.hotkeyPressed(i.ci.Name, hotkey) {
+				i.jumpToMonitor(n)
+				return true
+			}
+		}
+	}
+	for _, h := range i.hotkeys {
+		if !isSequence(h.Keys) && i.hotkeyPressed(h.Action, h.Keys) {
+			i.l.Infof("caught %q", h.Keys)
+			if err := i.runAction(h); err != nil {
+				i.l.WithError(err).Warnf("%v action failed", h.Action)
+				i.notify(Status{Grabbed: true, Remote: i.ci.Name, Connected: i.r.IsConnected(), Err: err})
+			}
+			return true
+		}
+	}
+	for cname, ci := range i.c {
+		if ci.Hotkey != "" && !isSequence(ci.Hotkey) && i.hotkeyPressed(cname, ci.Hotkey) {
+			i.remoteHotkey(cname, ci)
+			return true
+		}
+	}
+	return false
+}
+
+// remoteHotkey switches to the remote, or disconnects from it
+// when it's connected already, unless running forever.
+func (i *inputHandler) remoteHotkey(cname string, ci configItem) {
+	if !i.forever && i.r.IsConnected() && cname == i.ci.Name {
+		i.l.Infof("caught %q, disconnecting fom %q", ci.Hotkey, cname)
+		i.ungrab()
+		i.disconnect()
+		i.notify(Status{Remote: cname})
+		return
+	}
+	i.l.Infof("caught %q, switching to %q", ci.Hotkey, cname)
+	i.switchTo(cname)
+}
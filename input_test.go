@@ -0,0 +1,535 @@
+package i2vnc
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/runz0rd/i2vnc/x11"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	testLocalScreen  = Screen{1000, 800}
+	testRemoteScreen = Screen{2000, 1000}
+)
+
+func keyEv(name string, isPress bool) RemoteEvent {
+	ed := makeEd(name, isPress)
+	return RemoteEvent{Name: ed.Name, Key: ed.Key, IsKey: true, IsPress: isPress}
+}
+
+func pointerEv(name string, x, y uint16, isPress bool) RemoteEvent {
+	ed := makeEd(name, isPress)
+	return RemoteEvent{Name: ed.Name, Button: ed.Button, X: x, Y: y, IsPress: isPress}
+}
+
+func stripTime(events []RemoteEvent) []RemoteEvent {
+	var stripped []RemoteEvent
+	for _, re := range events {
+		re.Time = time.Time{}
+		stripped = append(stripped, re)
+	}
+	return stripped
+}
+
+func newTestPipeline(c Config, forever bool) (*MockInput, *MockRemote) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.PanicLevel)
+	for name, ci := range c {
+		ci.Name = name
+		c[name] = ci
+	}
+	r := NewMockRemote(logrus.NewEntry(logger), testRemoteScreen)
+	i := NewMockInput(logger, r, c, testLocalScreen, forever)
+	i.Grab()
+	return i, r
+}
+
+func press(i *MockInput, names ...string) {
+	for _, name := range names {
+		i.KeyEvent(name, true)
+	}
+}
+
+func release(i *MockInput, names ...string) {
+	for _, name := range names {
+		i.KeyEvent(name, false)
+	}
+}
+
+func Test_pipeline_events(t *testing.T) {
+	macConfig := func() Config {
+		return Config{"mac": {
+			Hotkey:      "F9",
+			ScrollSpeed: 3,
+			Keymap: map[string]string{
+				"Alt_L":    "Meta_L",
+				"Home":     "Super_R+Left",
+				"Button_8": "Super_R+Right",
+			},
+		}}
+	}
+	tests := []struct {
+		name  string
+		steps func(i *MockInput)
+		want  []RemoteEvent
+	}{
+		{
+			name:  "hotkey connects and centers pointer",
+			steps: func(i *MockInput) { press(i, "F9") },
+			want:  []RemoteEvent{pointerEv("Motion", 1000, 500, false)},
+		},
+		{
+			name: "hotkey release is forwarded",
+			steps: func(i *MockInput) {
+				press(i, "F9")
+				release(i, "F9")
+			},
+			want: []RemoteEvent{pointerEv("Motion", 1000, 500, false), keyEv("F9", false)},
+		},
+		{
+			name: "unmapped key",
+			steps: func(i *MockInput) {
+				press(i, "F9", "a")
+				release(i, "a")
+			},
+			want: []RemoteEvent{pointerEv("Motion", 1000, 500, false), keyEv("a", true), keyEv("a", false)},
+		},
+		{
+			name: "mapped mod",
+			steps: func(i *MockInput) {
+				press(i, "F9", "Alt_L")
+				release(i, "Alt_L")
+			},
+			want: []RemoteEvent{pointerEv("Motion", 1000, 500, false), keyEv("Meta_L", true), keyEv("Meta_L", false)},
+		},
+		{
+			name: "key mapped to combination",
+			steps: func(i *MockInput) {
+				press(i, "F9", "Home")
+				release(i, "Home")
+			},
+			want: []RemoteEvent{
+				pointerEv("Motion", 1000, 500, false),
+				keyEv("Super_R", true), keyEv("Left", true),
+				keyEv("Left", false), keyEv("Super_R", false),
+			},
+		},
+		{
+			name: "button mapped to combination",
+			steps: func(i *MockInput) {
+				press(i, "F9")
+				i.ButtonEvent("Button_8", true)
+				i.ButtonEvent("Button_8", false)
+			},
+			want: []RemoteEvent{
+				pointerEv("Motion", 1000, 500, false),
+				keyEv("Super_R", true), keyEv("Right", true),
+				keyEv("Right", false), keyEv("Super_R", false),
+			},
+		},
+		{
+			name: "scroll speed",
+			steps: func(i *MockInput) {
+				press(i, "F9")
+				i.ButtonEvent("Button_Up", true)
+			},
+			want: []RemoteEvent{
+				pointerEv("Motion", 1000, 500, false),
+				pointerEv("Button_Up", 1000, 500, true),
+				pointerEv("Button_Up", 1000, 500, true),
+				pointerEv("Button_Up", 1000, 500, true),
+			},
+		},
+		{
+			name: "motion",
+			steps: func(i *MockInput) {
+				press(i, "F9")
+				i.Motion(10, -5)
+				i.Motion(10, 0)
+			},
+			want: []RemoteEvent{
+				pointerEv("Motion", 1000, 500, false),
+				pointerEv("Motion", 1010, 495, false),
+				pointerEv("Motion", 1020, 495, false),
+			},
+		},
+		{
+			name: "motion clamped to remote screen",
+			steps: func(i *MockInput) {
+				press(i, "F9")
+				i.Motion(-400, 400)
+				i.Motion(-400, 400)
+				i.Motion(-400, 400)
+			},
+			want: []RemoteEvent{
+				pointerEv("Motion", 1000, 500, false),
+				pointerEv("Motion", 600, 900, false),
+				pointerEv("Motion", 200, 1000, false),
+				pointerEv("Motion", 0, 1000, false),
+			},
+		},
+		{
+			name: "drag",
+			steps: func(i *MockInput) {
+				press(i, "F9")
+				i.ButtonEvent("Button_Left", true)
+				i.Motion(5, 5)
+				i.ButtonEvent("Button_Left", false)
+			},
+			want: []RemoteEvent{
+				pointerEv("Motion", 1000, 500, false),
+				pointerEv("Button_Left", 1000, 500, true),
+				pointerEv("Button_Left", 1005, 505, true),
+				pointerEv("Button_Left", 1005, 505, false),
+			},
+		},
+		{
+			name:  "nothing is sent before connecting",
+			steps: func(i *MockInput) { press(i, "a") },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			i, r := newTestPipeline(macConfig(), false)
+			tt.steps(i)
+			if got := stripTime(r.Events()); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("events = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_pipeline_pointerMode(t *testing.T) {
+	config := func(mode string) Config {
+		return Config{"mac": {
+			Hotkey:  "F9",
+			Pointer: pointerConfig{Mode: mode, Letterbox: LetterboxStretch, ModeHotkey: "Scroll_Lock"},
+		}}
+	}
+	tests := []struct {
+		name  string
+		mode  string
+		steps func(i *MockInput)
+		want  []RemoteEvent
+	}{
+		{
+			name: "absolute",
+			mode: PointerModeAbsolute,
+			steps: func(i *MockInput) {
+				press(i, "F9")
+				i.MoveTo(250, 200)
+				i.MoveTo(250, 200)
+				i.ButtonEvent("Button_Left", true)
+			},
+			want: []RemoteEvent{
+				pointerEv("Motion", 1000, 500, false),
+				pointerEv("Motion", 500, 250, false),
+				pointerEv("Motion", 500, 250, false),
+				pointerEv("Button_Left", 500, 250, true),
+			},
+		},
+		{
+			name: "toggle to absolute",
+			mode: PointerModeRelative,
+			steps: func(i *MockInput) {
+				press(i, "F9")
+				i.Motion(10, 10)
+				press(i, "Scroll_Lock")
+				release(i, "Scroll_Lock")
+				i.MoveTo(0, 0)
+			},
+			want: []RemoteEvent{
+				pointerEv("Motion", 1000, 500, false),
+				pointerEv("Motion", 1010, 510, false),
+				keyEv("Scroll_Lock", false),
+				pointerEv("Motion", 0, 0, false),
+			},
+		},
+		{
+			name: "toggle to relative",
+			mode: PointerModeAbsolute,
+			steps: func(i *MockInput) {
+				press(i, "F9")
+				i.MoveTo(0, 0)
+				press(i, "Scroll_Lock")
+				release(i, "Scroll_Lock")
+				i.Motion(10, 10)
+			},
+			want: []RemoteEvent{
+				pointerEv("Motion", 1000, 500, false),
+				pointerEv("Motion", 0, 0, false),
+				keyEv("Scroll_Lock", false),
+				pointerEv("Motion", 10, 10, false),
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			i, r := newTestPipeline(config(tt.mode), false)
+			tt.steps(i)
+			if got := stripTime(r.Events()); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("events = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_pipeline_remotePointer(t *testing.T) {
+	i, r := newTestPipeline(Config{"mac": {Hotkey: "F9"}}, false)
+	press(i, "F9")
+	r.SetPointerPos(Screen{100, 100})
+	i.Motion(10, 0)
+	i.Motion(10, 0)
+	r.SetPointerPos(Screen{50, 60})
+	i.handleClick(x11.Buttons["Button_Left"])
+	want := []RemoteEvent{
+		pointerEv("Motion", 1000, 500, false),
+		pointerEv("Motion", 110, 100, false),
+		pointerEv("Motion", 120, 100, false),
+		pointerEv("Button_Left", 50, 60, true),
+		pointerEv("Button_Left", 50, 60, false),
+	}
+	if got := stripTime(r.Events()); !reflect.DeepEqual(got, want) {
+		t.Errorf("events = %v, want %v", got, want)
+	}
+}
+
+func Test_pipeline_remoteResize(t *testing.T) {
+	i, r := newTestPipeline(Config{"mac": {Hotkey: "F9"}}, false)
+	press(i, "F9")
+	i.Motion(100, 0)
+	r.SetScreen(Screen{1000, 500})
+	i.Motion(0, 0)
+	i.Motion(1000, 1000)
+	want := []RemoteEvent{
+		pointerEv("Motion", 1000, 500, false),
+		pointerEv("Motion", 1100, 500, false),
+		pointerEv("Motion", 550, 250, false),
+		pointerEv("Motion", 1000, 500, false),
+	}
+	if got := stripTime(r.Events()); !reflect.DeepEqual(got, want) {
+		t.Errorf("events = %v, want %v", got, want)
+	}
+}
+
+func Test_pipeline_monitors(t *testing.T) {
+	tests := []struct {
+		name     string
+		monitors []Monitor
+		remote   []Monitor
+	}{
+		{"reported", nil, []Monitor{{0, 0, 1200, 1000}, {1200, 0, 800, 600}}},
+		{"configured", []Monitor{{0, 0, 1200, 1000}, {1200, 0, 800, 600}}, []Monitor{{0, 0, 2000, 1000}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			i, r := newTestPipeline(Config{"mac": {
+				Hotkey:   "F9",
+				Monitors: tt.monitors,
+				Pointer:  pointerConfig{MonitorHotkeys: []string{"F1", "F2"}},
+			}}, false)
+			r.SetMonitors(tt.remote)
+			press(i, "F9")
+			press(i, "F2")
+			release(i, "F2")
+			i.Motion(0, 400)
+			i.Motion(-500, 0)
+			press(i, "F1")
+			want := []RemoteEvent{
+				pointerEv("Motion", 1000, 500, false),
+				pointerEv("Motion", 1600, 300, false),
+				keyEv("F2", false),
+				pointerEv("Motion", 1600, 599, false),
+				pointerEv("Motion", 1100, 599, false),
+				pointerEv("Motion", 600, 500, false),
+			}
+			if got := stripTime(r.Events()); !reflect.DeepEqual(got, want) {
+				t.Errorf("events = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func Test_pipeline_scroll(t *testing.T) {
+	click := func(name string, n int) []RemoteEvent {
+		var events []RemoteEvent
+		for ; n > 0; n-- {
+			events = append(events, pointerEv(name, 1000, 500, true), pointerEv(name, 1000, 500, false))
+		}
+		return events
+	}
+	connected := pointerEv("Motion", 1000, 500, false)
+	tests := []struct {
+		name   string
+		scroll scrollConfig
+		steps  func(i *MockInput)
+		want   []RemoteEvent
+	}{
+		{
+			name:   "horizontal speed",
+			scroll: scrollConfig{Vertical: 3, Horizontal: 2},
+			steps: func(i *MockInput) {
+				i.ButtonEvent("Button_6", true)
+				i.ButtonEvent("Button_6", false)
+			},
+			want: []RemoteEvent{
+				connected,
+				pointerEv("Button_6", 1000, 500, true), pointerEv("Button_6", 1000, 500, true),
+				pointerEv("Button_6", 1000, 500, false), pointerEv("Button_6", 1000, 500, false),
+			},
+		},
+		{
+			name:   "natural",
+			scroll: scrollConfig{Natural: true},
+			steps: func(i *MockInput) {
+				i.ButtonEvent("Button_Up", true)
+				i.ButtonEvent("Button_7", true)
+			},
+			want: []RemoteEvent{
+				connected,
+				pointerEv("Button_Down", 1000, 500, true),
+				pointerEv("Button_6", 1000, 500, true),
+			},
+		},
+		{
+			name: "smooth accumulated into clicks",
+			steps: func(i *MockInput) {
+				i.Scroll(0, 0.4)
+				i.Scroll(0, 0.4)
+				i.Scroll(0, 0.4)
+				i.Scroll(-0.5, 0)
+				i.Scroll(-0.5, 0)
+			},
+			want: append(append([]RemoteEvent{connected}, click("Button_Down", 1)...), click("Button_6", 1)...),
+		},
+		{
+			name: "smooth rest dropped on direction change",
+			steps: func(i *MockInput) {
+				i.Scroll(0, 0.9)
+				i.Scroll(0, -0.5)
+			},
+			want: []RemoteEvent{connected},
+		},
+		{
+			name:   "smooth with speed and natural",
+			scroll: scrollConfig{Vertical: 2, Natural: true},
+			steps: func(i *MockInput) {
+				i.Scroll(0, 1)
+			},
+			want: []RemoteEvent{
+				connected,
+				pointerEv("Button_Up", 1000, 500, true), pointerEv("Button_Up", 1000, 500, true),
+				pointerEv("Button_Up", 1000, 500, false), pointerEv("Button_Up", 1000, 500, false),
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			i, r := newTestPipeline(Config{"mac": {Hotkey: "F9", Scroll: tt.scroll}}, false)
+			press(i, "F9")
+			tt.steps(i)
+			if got := stripTime(r.Events()); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("events = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_pipeline_hotkeys(t *testing.T) {
+	twoRemotes := func() Config {
+		return Config{
+			"mac":   {Hotkey: "F9"},
+			"linux": {Hotkey: "F10"},
+		}
+	}
+	tests := []struct {
+		name          string
+		forever       bool
+		connectErr    error
+		hotkeys       []string
+		wantConnects  []string
+		wantConnected bool
+		wantGrabbed   bool
+	}{
+		{"connect", false, nil, []string{"F9"}, []string{"mac"}, true, true},
+		{"switch", false, nil, []string{"F9", "F10"}, []string{"mac", "linux"}, true, true},
+		{"toggle disconnects and ungrabs", false, nil, []string{"F9", "F9"}, []string{"mac"}, false, false},
+		{"toggle forever reconnects", true, nil, []string{"F9", "F9"}, []string{"mac", "mac"}, true, true},
+		{"connect failure", false, errors.New("unreachable"), []string{"F9"}, []string{"mac"}, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			i, r := newTestPipeline(twoRemotes(), tt.forever)
+			r.SetConnectError(tt.connectErr)
+			for _, hotkey := range tt.hotkeys {
+				press(i, hotkey)
+				release(i, hotkey)
+			}
+			if got := r.Connects(); !reflect.DeepEqual(got, tt.wantConnects) {
+				t.Errorf("connects = %v, want %v", got, tt.wantConnects)
+			}
+			if got := r.IsConnected(); got != tt.wantConnected {
+				t.Errorf("connected = %v, want %v", got, tt.wantConnected)
+			}
+			if got := i.IsGrabbed(); got != tt.wantGrabbed {
+				t.Errorf("grabbed = %v, want %v", got, tt.wantGrabbed)
+			}
+		})
+	}
+}
+
+// statusRecorder is an Indicator recording every status shown.
+type statusRecorder []Status
+
+func (r *statusRecorder) Show(s Status) {
+	*r = append(*r, s)
+}
+
+func Test_pipeline_status(t *testing.T) {
+	i, r := newTestPipeline(Config{"mac": {Hotkey: "F9"}, "linux": {Hotkey: "F10"}}, false)
+	var got statusRecorder
+	i.AddIndicator(&got)
+	i.Grab()
+	press(i, "F9")
+	release(i, "F9")
+	errUnreachable := errors.New("unreachable")
+	r.SetConnectError(errUnreachable)
+	press(i, "F10")
+	release(i, "F10")
+	r.SetConnectError(nil)
+	press(i, "F9")
+	release(i, "F9")
+	press(i, "F9")
+	release(i, "F9")
+
+	want := statusRecorder{
+		{Grabbed: true},
+		{Grabbed: true, Remote: "mac", Connected: true, Switched: true},
+		{Grabbed: true, Remote: "linux", Err: errUnreachable},
+		{Grabbed: true, Remote: "mac", Connected: true, Switched: true},
+		{Remote: "mac"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("statuses = %+v, want %+v", got, want)
+	}
+}
+
+func Test_MockRemote_timing(t *testing.T) {
+	i, r := newTestPipeline(Config{"mac": {Hotkey: "F9"}}, false)
+	press(i, "F9", "a", "b")
+	events := r.Events()
+	if len(events) != 3 {
+		t.Fatalf("got %v events, want 3", len(events))
+	}
+	for n, re := range events {
+		if re.Time.IsZero() {
+			t.Errorf("event %v has no time", n)
+		}
+		if n > 0 && re.Time.Before(events[n-1].Time) {
+			t.Errorf("event %v recorded before event %v", n, n-1)
+		}
+	}
+}
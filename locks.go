@@ -0,0 +1,132 @@
+package i2vnc
+
+import (
+	"fmt"
+)
+
+// lockKeys are the keys toggling a lock state, in the order they're synced.
+var lockKeys = []string{"Caps_Lock", "Num_Lock", "Scroll_Lock"}
+
+// Locks are the states of the lock keys, the ones lit on the keyboard LEDs.
+type Locks struct {
+	CapsLock   bool `json:"capsLock,omitempty"`
+	NumLock    bool `json:"numLock,omitempty"`
+	ScrollLock bool `json:"scrollLock,omitempty"`
+}
+
+// lock returns the state of the lock key, nil if it isn't a lock key.
+func (l *Locks) lock(key string) *bool {
+	switch key {
+	case "Caps_Lock":
+		return &l.CapsLock
+	case "Num_Lock":
+		return &l.NumLock
+	case "Scroll_Lock":
+		return &l.ScrollLock
+	}
+	return nil
+}
+
+// lockConfig syncs the lock states of the remote with the local ones
+// when switching to it. Servers reporting their LED state are synced with
+// the reported state, the others with the state tracked from the lock keys
+// sent to them, assuming every lock is off at first.
+type lockConfig struct {
+	Sync bool `yaml:"sync"`
+	// Keys are the lock keys synced, Caps_Lock, Num_Lock and Scroll_Lock if empty.
+	Keys []string `yaml:"keys"`
+}
+
+func (c lockConfig) keys() []string {
+	if len(c.Keys) == 0 {
+		return lockKeys
+	}
+	return c.Keys
+}
+
+func (c lockConfig) validate() error {
+	for _, key := range c.Keys {
+		if !StringInSlice(key, lockKeys) {
+			return fmt.Errorf("unknown lock key %q, must be one of %v", key, lockKeys)
+		}
+	}
+	return nil
+}
+
+// lockStater is implemented by inputs that can query the local lock states.
+type lockStater interface {
+	lockState() (Locks, error)
+}
+
+// lockToggled tracks the lock states of the remote, after the key
+// was pressed on it.
+func (i *inputHandler) lockToggled(key string) {
+	locks := i.remoteLocks[i.ci.Name]
+	lock := locks.lock(key)
+	if lock == nil {
+		return
+	}
+	*lock = !*lock
+	if i.remoteLocks == nil {
+		i.remoteLocks = map[string]Locks{}
+	}
+	i.remoteLocks[i.ci.Name] = locks
+}
+
+// syncLocksPending syncs the lock states of the remote switched to, once
+// it sent its first update. The server reports its LED state with it,
+// if at all.
+func (i *inputHandler) syncLocksPending() {
+	if !i.locksPending || !i.r.Updated() {
+		return
+	}
+	i.locksPending = false
+	ls, ok := i.in.(lockStater)
+	if !ok {
+		i.l.Debug("the input can't query the lock states, not syncing them")
+		return
+	}
+	local, err := ls.lockState()
+	if err != nil {
+		i.l.WithError(err).Warn("failed querying the lock states")
+		return
+	}
+	var reported *Locks
+	if locks, ok := i.r.Locks(); ok {
+		reported = &locks
+	}
+	i.syncLocks(local, reported)
+}
+
+// syncLocks toggles the locks of the remote differing from the local ones.
+// The state reported by the remote takes precedence over the tracked one.
+func (i *inputHandler) syncLocks(local Locks, reported *Locks) {
+	i.t.input(TraceEvent{Type: traceTypeLocks, Locks: &local, RemoteLocks: reported})
+	i.locksPending = false
+	remote := i.remoteLocks[i.ci.Name]
+	if reported != nil {
+		remote = *reported
+	}
+	for _, key := range i.ci.Locks.keys() {
+		if *local.lock(key) == *remote.lock(key) {
+			continue
+		}
+		def, err := newEventDefByName(key, true)
+		if err != nil {
+			continue
+		}
+		i.l.Infof("toggling %v on the remote to match the local state", key)
+		if err := i.r.SendKeyEvent(def.Name, def.Key, true); err != nil {
+			i.l.Trace(err)
+			continue
+		}
+		if err := i.r.SendKeyEvent(def.Name, def.Key, false); err != nil {
+			i.l.Trace(err)
+		}
+		*remote.lock(key) = *local.lock(key)
+	}
+	if i.remoteLocks == nil {
+		i.remoteLocks = map[string]Locks{}
+	}
+	i.remoteLocks[i.ci.Name] = remote
+}
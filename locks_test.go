@@ -0,0 +1,130 @@
+package i2vnc
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func Test_lockConfig_validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		c       lockConfig
+		wantErr bool
+	}{
+		{"default", lockConfig{Sync: true}, false},
+		{"keys", lockConfig{Sync: true, Keys: []string{"Caps_Lock", "Num_Lock"}}, false},
+		{"unknown key", lockConfig{Sync: true, Keys: []string{"Shift_Lock"}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.c.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_pipeline_locks(t *testing.T) {
+	toggle := func(name string) []RemoteEvent {
+		return []RemoteEvent{keyEv(name, true), keyEv(name, false)}
+	}
+	tests := []struct {
+		name  string
+		c     lockConfig
+		local Locks
+		// reported are the locks reported by the remote, nil if they aren't
+		reported *Locks
+		steps    func(i *MockInput)
+		want     []RemoteEvent
+	}{
+		{"tracked", lockConfig{Sync: true}, Locks{CapsLock: true, NumLock: true}, nil, nil,
+			append(toggle("Caps_Lock"), toggle("Num_Lock")...)},
+		{"reported", lockConfig{Sync: true}, Locks{CapsLock: true, NumLock: true},
+			&Locks{CapsLock: true, ScrollLock: true}, nil,
+			append(toggle("Num_Lock"), toggle("Scroll_Lock")...)},
+		{"keys", lockConfig{Sync: true, Keys: []string{"Num_Lock"}}, Locks{CapsLock: true, NumLock: true}, nil, nil,
+			toggle("Num_Lock")},
+		{"disabled", lockConfig{}, Locks{CapsLock: true}, nil, nil, nil},
+		{"tracked keys sent", lockConfig{Sync: true}, Locks{CapsLock: true}, nil, func(i *MockInput) {
+			// caps lock is toggled on the remote, and back when returning to it
+			press(i, "Caps_Lock")
+			release(i, "Caps_Lock")
+			press(i, "F10")
+			release(i, "F10")
+			press(i, "F9")
+			release(i, "F9")
+		}, append(append(toggle("Caps_Lock"), toggle("Caps_Lock")...), toggle("Caps_Lock")...)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			i, r := newTestPipeline(Config{"mac": {Hotkey: "F9", Locks: tt.c}, "win": {Hotkey: "F10"}}, false)
+			i.SetLocks(tt.local)
+			if tt.reported != nil {
+				r.SetLocks(*tt.reported)
+			}
+			press(i, "F9")
+			release(i, "F9")
+			if tt.steps != nil {
+				tt.steps(i)
+			}
+			var got []RemoteEvent
+			for _, re := range keyEvents(r.Events()) {
+				if re.Name != "F9" && re.Name != "F10" {
+					got = append(got, re)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("events = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_pipeline_locksPending(t *testing.T) {
+	i, r := newTestPipeline(Config{"mac": {Hotkey: "F9", Locks: lockConfig{Sync: true}}}, false)
+	i.SetLocks(Locks{NumLock: true})
+	// the LED state arrives with the first update, after the switch
+	r.SetPending(true)
+	press(i, "F9")
+	release(i, "F9")
+	r.SetLocks(Locks{NumLock: true, ScrollLock: true})
+	r.SetPending(false)
+	press(i, "a")
+	want := []RemoteEvent{keyEv("F9", false), keyEv("Scroll_Lock", true), keyEv("Scroll_Lock", false), keyEv("a", true)}
+	if got := keyEvents(r.Events()); !reflect.DeepEqual(got, want) {
+		t.Errorf("events = %v, want %v", got, want)
+	}
+}
+
+func TestReplay_locks(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.PanicLevel)
+	config := Config{"mac": {Name: "mac", Hotkey: "F9", Locks: lockConfig{Sync: true}}}
+	var trace bytes.Buffer
+	tracer := NewTracer(logger, &trace)
+	mock := NewMockRemote(logrus.NewEntry(logger), testRemoteScreen)
+	mock.SetLocks(Locks{NumLock: true})
+	i := NewMockInput(logger, NewTraceRemote(mock, tracer), config, testLocalScreen, false)
+	i.SetLocks(Locks{CapsLock: true})
+	i.SetTracer(tracer)
+	i.Grab()
+
+	press(i, "F9")
+	release(i, "F9")
+	press(i, "a")
+
+	result, err := Replay(logger, bytes.NewReader(trace.Bytes()), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := result.Diff(); len(diff) != 0 {
+		t.Errorf("Replay() differs from the trace:\n%v", strings.Join(diff, "\n"))
+	}
+	if !strings.Contains(trace.String(), `"type":"locks"`) {
+		t.Error("the lock states aren't traced")
+	}
+}
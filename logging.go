@@ -0,0 +1,356 @@
+package i2vnc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Log fields, every field logged is one of these.
+const (
+	// LoggerFieldSubsystem is set on every entry, to one of the Subsystem* values.
+	LoggerFieldSubsystem = "subsystem"
+	// LoggerFieldSource is the component logging an event, like X11Input or MockRemote.
+	LoggerFieldSource = "source"
+	// LoggerFieldRemote is the config name of the remote.
+	LoggerFieldRemote = "remote"
+	// LoggerFieldPath is a file path, like the one of the config.
+	LoggerFieldPath = "path"
+	// LoggerFieldEvent is the event type, one of the LoggerEvent* values.
+	LoggerFieldEvent   = "event"
+	LoggerFieldName    = "name"
+	LoggerFieldIsPress = "isPress"
+	LoggerFieldCoords  = "coords"
+	LoggerFieldX11     = "x11"
+
+	LoggerEventKey    = "key"
+	LoggerEventButton = "button"
+	LoggerEventX11    = "x11"
+)
+
+// Subsystems, their log level can be set separately.
+const (
+	SubsystemInput  = "input"
+	SubsystemRemote = "remote"
+	SubsystemConfig = "config"
+)
+
+var subsystems = []string{SubsystemInput, SubsystemRemote, SubsystemConfig}
+
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+
+	LogOutputStderr   = "stderr"
+	LogOutputFile     = "file"
+	LogOutputJournald = "journald"
+
+	defaultLogMaxSizeMb  = 10
+	defaultLogMaxBackups = 3
+	journaldSocket       = "/run/systemd/journal/socket"
+	journaldIdentifier   = "i2vnc"
+)
+
+type loggingConfig struct {
+	// Format is text or json, text by default.
+	Format string `yaml:"format"`
+	// Level is the level of all subsystems, info by default.
+	Level string `yaml:"level"`
+	// Levels overrides Level by subsystem.
+	Levels map[string]string `yaml:"levels"`
+	// Output is stderr, file or journald. By default it's journald when
+	// running as a systemd service, file if File is set and stderr otherwise.
+	Output string `yaml:"output"`
+	// File is written to with the file output, it's rotated when it grows
+	// over MaxSizeMb, keeping MaxBackups of the rotated files.
+	File       string `yaml:"file"`
+	MaxSizeMb  int    `yaml:"maxSizeMb"`
+	MaxBackups int    `yaml:"maxBackups"`
+}
+
+// Loggers are the loggers of the subsystems, sharing the same output.
+type Loggers struct {
+	Input  *logrus.Logger
+	Remote *logrus.Logger
+	Config *logrus.Logger
+	closer io.Closer
+}
+
+// NewLoggers creates the subsystem loggers, they must be closed after use.
+func NewLoggers(c loggingConfig) (*Loggers, error) {
+	formatter, err := newLogFormatter(c.Format)
+	if err != nil {
+		return nil, err
+	}
+	levels := map[string]logrus.Level{}
+	for _, s := range subsystems {
+		levels[s] = logrus.InfoLevel
+	}
+	if c.Level != "" {
+		level, err := logrus.ParseLevel(c.Level)
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range subsystems {
+			levels[s] = level
+		}
+	}
+	for s, l := range c.Levels {
+		if _, ok := levels[s]; !ok {
+			return nil, fmt.Errorf("unknown log subsystem %q, must be one of %v", s, strings.Join(subsystems, ", "))
+		}
+		level, err := logrus.ParseLevel(l)
+		if err != nil {
+			return nil, err
+		}
+		levels[s] = level
+	}
+
+	ls := &Loggers{}
+	var out io.Writer = os.Stderr
+	var hook logrus.Hook
+	switch logOutput(c) {
+	case LogOutputStderr:
+	case LogOutputFile:
+		if c.File == "" {
+			return nil, fmt.Errorf("no log file set for the %v output", LogOutputFile)
+		}
+		f, err := newRotatingFile(c.File, c.MaxSizeMb, c.MaxBackups)
+		if err != nil {
+			return nil, err
+		}
+		out, ls.closer = f, f
+	case LogOutputJournald:
+		j, err := newJournaldHook(journaldSocket)
+		if err != nil {
+			return nil, err
+		}
+		out, hook, ls.closer = io.Discard, j, j
+	default:
+		return nil, fmt.Errorf("unknown log output %q", c.Output)
+	}
+	logger := func(subsystem string) *logrus.Logger {
+		l := logrus.New()
+		l.SetOutput(out)
+		l.SetFormatter(formatter)
+		l.SetLevel(levels[subsystem])
+		l.AddHook(subsystemHook(subsystem))
+		if hook != nil {
+			l.AddHook(hook)
+		}
+		return l
+	}
+	ls.Input = logger(SubsystemInput)
+	ls.Remote = logger(SubsystemRemote)
+	ls.Config = logger(SubsystemConfig)
+	return ls, nil
+}
+
+func (ls *Loggers) Close() error {
+	if ls.closer == nil {
+		return nil
+	}
+	return ls.closer.Close()
+}
+
+func logOutput(c loggingConfig) string {
+	switch {
+	case c.Output != "":
+		return c.Output
+	case os.Getenv("JOURNAL_STREAM") != "":
+		// stderr is connected to the journal
+		return LogOutputJournald
+	case c.File != "":
+		return LogOutputFile
+	}
+	return LogOutputStderr
+}
+
+func newLogFormatter(format string) (logrus.Formatter, error) {
+	switch format {
+	case "", LogFormatText:
+		return &logrus.TextFormatter{}, nil
+	case LogFormatJSON:
+		return &logrus.JSONFormatter{}, nil
+	}
+	return nil, fmt.Errorf("unknown log format %q, must be %v or %v", format, LogFormatText, LogFormatJSON)
+}
+
+// subsystemHook sets the subsystem field on every entry.
+type subsystemHook string
+
+func (h subsystemHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h subsystemHook) Fire(e *logrus.Entry) error {
+	e.Data[LoggerFieldSubsystem] = string(h)
+	return nil
+}
+
+// rotatingFile is a log file that's renamed to path.1 when it grows
+// over its max size, moving the older files up to path.maxBackups.
+type rotatingFile struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	f          *os.File
+	size       int64
+}
+
+func newRotatingFile(path string, maxSizeMb, maxBackups int) (*rotatingFile, error) {
+	if maxSizeMb <= 0 {
+		maxSizeMb = defaultLogMaxSizeMb
+	}
+	if maxBackups <= 0 {
+		maxBackups = defaultLogMaxBackups
+	}
+	r := &rotatingFile{path: path, maxSize: int64(maxSizeMb) << 20, maxBackups: maxBackups}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f, r.size = f, info.Size()
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *rotatingFile) rotate() error {
+	if err := r.f.Close(); err != nil {
+		return err
+	}
+	backup := func(n int) string {
+		return fmt.Sprintf("%v.%v", r.path, n)
+	}
+	os.Remove(backup(r.maxBackups))
+	for n := r.maxBackups - 1; n > 0; n-- {
+		os.Rename(backup(n), backup(n+1))
+	}
+	if err := os.Rename(r.path, backup(1)); err != nil {
+		return err
+	}
+	return r.open()
+}
+
+func (r *rotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.f.Close()
+}
+
+// journaldHook sends every entry to journald over its native protocol,
+// with the entry fields as journal fields.
+type journaldHook struct {
+	conn net.Conn
+}
+
+func newJournaldHook(socket string) (*journaldHook, error) {
+	conn, err := net.Dial("unixgram", socket)
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to journald: %s", err)
+	}
+	return &journaldHook{conn}, nil
+}
+
+func (h *journaldHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h *journaldHook) Fire(e *logrus.Entry) error {
+	_, err := h.conn.Write(journaldMessage(e))
+	return err
+}
+
+func (h *journaldHook) Close() error {
+	return h.conn.Close()
+}
+
+var journaldPriorities = map[logrus.Level]int{
+	logrus.PanicLevel: 2,
+	logrus.FatalLevel: 2,
+	logrus.ErrorLevel: 3,
+	logrus.WarnLevel:  4,
+	logrus.InfoLevel:  6,
+	logrus.DebugLevel: 7,
+	logrus.TraceLevel: 7,
+}
+
+func journaldMessage(e *logrus.Entry) []byte {
+	var b bytes.Buffer
+	writeJournaldField(&b, "MESSAGE", e.Message)
+	writeJournaldField(&b, "PRIORITY", fmt.Sprint(journaldPriorities[e.Level]))
+	writeJournaldField(&b, "SYSLOG_IDENTIFIER", journaldIdentifier)
+	var keys []string
+	for k := range e.Data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		v := e.Data[k]
+		if err, ok := v.(error); ok {
+			v = err.Error()
+		}
+		writeJournaldField(&b, journaldFieldName(k), fmt.Sprint(v))
+	}
+	return b.Bytes()
+}
+
+// journaldFieldName turns a log field into a journal field name,
+// which are upper case letters, digits and underscores.
+func journaldFieldName(field string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, field)
+	// prefixed, so they can't clash with the journal fields like MESSAGE
+	return "I2VNC_" + name
+}
+
+func writeJournaldField(b *bytes.Buffer, name, value string) {
+	if !strings.Contains(value, "\n") {
+		fmt.Fprintf(b, "%v=%v\n", name, value)
+		return
+	}
+	// multi line values are length prefixed
+	b.WriteString(name + "\n")
+	binary.Write(b, binary.LittleEndian, uint64(len(value)))
+	b.WriteString(value + "\n")
+}
@@ -0,0 +1,139 @@
+package i2vnc
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestNewLoggers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "i2vnc.log")
+	ls, err := NewLoggers(loggingConfig{
+		Format: LogFormatJSON,
+		Level:  "warn",
+		Levels: map[string]string{SubsystemInput: "debug"},
+		Output: LogOutputFile,
+		File:   path,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ls.Input.WithField(LoggerFieldName, "a").Debug("input debug")
+	ls.Remote.Info("remote info")
+	ls.Remote.WithField(LoggerFieldRemote, "mac").Warn("remote warn")
+	ls.Config.Info("config info")
+	if err := ls.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entries []map[string]string
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var e map[string]string
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("log line %q isn't json: %v", line, err)
+		}
+		delete(e, "time")
+		entries = append(entries, e)
+	}
+	want := []map[string]string{
+		{"level": "debug", "msg": "input debug", LoggerFieldSubsystem: SubsystemInput, LoggerFieldName: "a"},
+		{"level": "warning", "msg": "remote warn", LoggerFieldSubsystem: SubsystemRemote, LoggerFieldRemote: "mac"},
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("logged %v, want %v", entries, want)
+	}
+	for n := range want {
+		for k, v := range want[n] {
+			if entries[n][k] != v {
+				t.Errorf("entry %v %q = %q, want %q", n, k, entries[n][k], v)
+			}
+		}
+	}
+
+	for _, c := range []loggingConfig{
+		{Format: "xml"},
+		{Level: "loud"},
+		{Levels: map[string]string{"video": "debug"}},
+		{Output: "syslog"},
+		{Output: LogOutputFile},
+	} {
+		if _, err := NewLoggers(c); err == nil {
+			t.Errorf("NewLoggers(%+v) succeeded", c)
+		}
+	}
+}
+
+func Test_rotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "i2vnc.log")
+	r, err := newRotatingFile(path, 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.maxSize = 10
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		if _, err := r.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r.Close()
+	for file, want := range map[string]string{
+		path:        "fourth\n",
+		path + ".1": "third\n",
+		path + ".2": "second\n",
+	} {
+		got, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Errorf("%v = %q, want %q", filepath.Base(file), got, want)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("more than 2 backups kept")
+	}
+}
+
+func Test_journaldHook(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "journal.sock")
+	journal, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		t.Skipf("no unixgram sockets: %v", err)
+	}
+	defer journal.Close()
+	h, err := newJournaldHook(socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	logger := logrus.New()
+	logger.SetOutput(&bytes.Buffer{})
+	logger.AddHook(subsystemHook(SubsystemRemote))
+	logger.AddHook(h)
+	logger.WithField(LoggerFieldIsPress, true).Warn("two\nlines")
+
+	buf := make([]byte, 1024)
+	n, err := journal.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "MESSAGE\n\x09\x00\x00\x00\x00\x00\x00\x00two\nlines\n" +
+		"PRIORITY=4\n" +
+		"SYSLOG_IDENTIFIER=i2vnc\n" +
+		"I2VNC_ISPRESS=true\n" +
+		"I2VNC_SUBSYSTEM=remote\n"
+	if got := string(buf[:n]); got != want {
+		t.Errorf("journal message = %q, want %q", got, want)
+	}
+}
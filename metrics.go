@@ -0,0 +1,225 @@
+package i2vnc
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	metricsNamespace   = "i2vnc"
+	defaultMetricsPath = "/metrics"
+
+	metricsLabelRemote = "remote"
+	metricsLabelType   = "type"
+	metricsTypeKey     = "key"
+	metricsTypePointer = "pointer"
+)
+
+type metricsConfig struct {
+	// Listen is the address of the HTTP metrics listener, like :9100,
+	// metrics are off if it's empty.
+	Listen string `yaml:"listen"`
+	// Path defaults to /metrics.
+	Path string `yaml:"path"`
+}
+
+type metrics struct {
+	events          *prometheus.CounterVec
+	sendErrors      *prometheus.CounterVec
+	sendDuration    *prometheus.HistogramVec
+	connectAttempts *prometheus.CounterVec
+	reconnects      *prometheus.CounterVec
+	connects        *prometheus.CounterVec
+	disconnects     *prometheus.CounterVec
+	current         *prometheus.GaugeVec
+}
+
+func newMetrics(reg prometheus.Registerer) *metrics {
+	m := &metrics{
+		events: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "events_total",
+			Help:      "Key and pointer events forwarded to the remote.",
+		}, []string{metricsLabelRemote, metricsLabelType}),
+		sendErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "send_errors_total",
+			Help:      "Key and pointer events that failed sending to the remote.",
+		}, []string{metricsLabelRemote, metricsLabelType}),
+		sendDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "send_duration_seconds",
+			Help:      "Time taken sending a single event to the remote.",
+			Buckets:   prometheus.ExponentialBuckets(0.0001, 4, 8),
+		}, []string{metricsLabelRemote, metricsLabelType}),
+		connectAttempts: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "connect_attempts_total",
+			Help:      "Attempts to connect to the remote.",
+		}, []string{metricsLabelRemote}),
+		reconnects: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "reconnect_attempts_total",
+			Help:      "Attempts to connect to a remote that was connected before.",
+		}, []string{metricsLabelRemote}),
+		connects: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "connects_total",
+			Help:      "Successful connections to the remote.",
+		}, []string{metricsLabelRemote}),
+		disconnects: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "disconnects_total",
+			Help:      "Disconnects from the remote.",
+		}, []string{metricsLabelRemote}),
+		current: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "remote_connected",
+			Help:      "1 for the currently connected remote, 0 for the others.",
+		}, []string{metricsLabelRemote}),
+	}
+	reg.MustRegister(m.events, m.sendErrors, m.sendDuration, m.connectAttempts,
+		m.reconnects, m.connects, m.disconnects, m.current)
+	return m
+}
+
+// MetricsRemote is a Remote that records metrics of the Remote it wraps.
+type MetricsRemote struct {
+	Remote
+	m     *metrics
+	cname string
+	// connected is whether cname was connected when last checked
+	connected bool
+	// names of the remotes connected to before
+	seen map[string]bool
+}
+
+func NewMetricsRemote(r Remote, reg prometheus.Registerer) *MetricsRemote {
+	return &MetricsRemote{Remote: r, m: newMetrics(reg), seen: map[string]bool{}}
+}
+
+func (r *MetricsRemote) Connect(cname string, timeout time.Duration) error {
+	r.track()
+	r.m.connectAttempts.WithLabelValues(cname).Inc()
+	if r.seen[cname] {
+		r.m.reconnects.WithLabelValues(cname).Inc()
+	}
+	if err := r.Remote.Connect(cname, timeout); err != nil {
+		return err
+	}
+	r.m.connects.WithLabelValues(cname).Inc()
+	if r.cname != "" {
+		r.m.current.WithLabelValues(r.cname).Set(0)
+	}
+	r.m.current.WithLabelValues(cname).Set(1)
+	r.cname = cname
+	r.connected = true
+	r.seen[cname] = true
+	return nil
+}
+
+// SetConfig passes the config on to the wrapped remote.
+func (r *MetricsRemote) SetConfig(c Config) {
+	if cs, ok := r.Remote.(configSetter); ok {
+		cs.SetConfig(c)
+	}
+}
+
+func (r *MetricsRemote) Disconnect() error {
+	if err := r.Remote.Disconnect(); err != nil {
+		return err
+	}
+	r.track()
+	return nil
+}
+
+func (r *MetricsRemote) IsConnected() bool {
+	r.track()
+	return r.Remote.IsConnected()
+}
+
+// track records the disconnect of the remote, including the ones
+// the wrapped remote made by itself, like after a stalled send.
+func (r *MetricsRemote) track() {
+	if !r.connected || r.Remote.IsConnected() {
+		return
+	}
+	r.m.disconnects.WithLabelValues(r.cname).Inc()
+	r.m.current.WithLabelValues(r.cname).Set(0)
+	r.connected = false
+}
+
+func (r *MetricsRemote) SendKeyEvent(name string, key uint32, isPress bool) error {
+	connected := r.IsConnected()
+	start := time.Now()
+	err := r.Remote.SendKeyEvent(name, key, isPress)
+	r.observe(connected, metricsTypeKey, start, err)
+	return err
+}
+
+func (r *MetricsRemote) SendPointerEvent(name string, button uint8, x, y uint16, isPress bool) error {
+	connected := r.IsConnected()
+	start := time.Now()
+	err := r.Remote.SendPointerEvent(name, button, x, y, isPress)
+	r.observe(connected, metricsTypePointer, start, err)
+	return err
+}
+
+// observe records an event sent, the ones sent while no remote
+// is connected aren't sent anywhere.
+func (r *MetricsRemote) observe(connected bool, eventType string, start time.Time, err error) {
+	r.track()
+	if !connected {
+		return
+	}
+	if err != nil {
+		r.m.sendErrors.WithLabelValues(r.cname, eventType).Inc()
+		return
+	}
+	r.m.sendDuration.WithLabelValues(r.cname, eventType).Observe(time.Since(start).Seconds())
+	r.m.events.WithLabelValues(r.cname, eventType).Inc()
+}
+
+// WithMetrics wraps the remote with a MetricsRemote and serves the metrics
+// over HTTP, the remote is returned unchanged if metrics are off.
+func WithMetrics(logger *logrus.Logger, c metricsConfig, r Remote) (Remote, error) {
+	if c.Listen == "" {
+		return r, nil
+	}
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	mr := NewMetricsRemote(r, reg)
+	if _, err := serveMetrics(logrus.NewEntry(logger), c, reg); err != nil {
+		return nil, err
+	}
+	return mr, nil
+}
+
+// serveMetrics serves the metrics of g in the background
+// until the returned listener is closed.
+func serveMetrics(l *logrus.Entry, c metricsConfig, g prometheus.Gatherer) (net.Listener, error) {
+	path := c.Path
+	if path == "" {
+		path = defaultMetricsPath
+	}
+	ln, err := net.Listen("tcp", c.Listen)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle(path, promhttp.HandlerFor(g, promhttp.HandlerOpts{}))
+	l.Infof("serving metrics on %v%v", ln.Addr(), path)
+	go func() {
+		if err := http.Serve(ln, mux); err != nil && !errors.Is(err, net.ErrClosed) {
+			l.WithError(err).Error("metrics listener failed")
+		}
+	}()
+	return ln, nil
+}
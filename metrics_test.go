@@ -0,0 +1,71 @@
+package i2vnc
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+func TestMetricsRemote(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.PanicLevel)
+	reg := prometheus.NewRegistry()
+	mock := NewMockRemote(logrus.NewEntry(logger), testRemoteScreen)
+	r := NewMetricsRemote(mock, reg)
+
+	ln, err := serveMetrics(logrus.NewEntry(logger), metricsConfig{Listen: "127.0.0.1:0"}, reg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	// not connected, so it isn't sent anywhere
+	r.SendKeyEvent("a", 0x61, true)
+	r.Connect("mac", 0)
+	r.SendKeyEvent("a", 0x61, true)
+	r.SendKeyEvent("a", 0x61, false)
+	r.SendPointerEvent("Motion", 0, 10, 10, false)
+	// the remote drops the connection by itself
+	mock.Disconnect()
+	r.SendKeyEvent("a", 0x61, true)
+	r.Connect("linux", 0)
+	r.Disconnect()
+	mock.SetConnectError(errors.New("refused"))
+	r.Connect("mac", 0)
+
+	resp, err := http.Get(fmt.Sprintf("http://%v/metrics", ln.Addr()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`i2vnc_events_total{remote="mac",type="key"} 2`,
+		`i2vnc_events_total{remote="mac",type="pointer"} 1`,
+		`i2vnc_send_duration_seconds_count{remote="mac",type="key"} 2`,
+		`i2vnc_connect_attempts_total{remote="mac"} 2`,
+		`i2vnc_reconnect_attempts_total{remote="mac"} 1`,
+		`i2vnc_connects_total{remote="mac"} 1`,
+		`i2vnc_connects_total{remote="linux"} 1`,
+		`i2vnc_disconnects_total{remote="mac"} 1`,
+		`i2vnc_disconnects_total{remote="linux"} 1`,
+		`i2vnc_remote_connected{remote="mac"} 0`,
+		`i2vnc_remote_connected{remote="linux"} 0`,
+	} {
+		if !strings.Contains(string(body), want+"\n") {
+			t.Errorf("metrics are missing %q", want)
+		}
+	}
+	if strings.Contains(string(body), "i2vnc_send_errors_total{") {
+		t.Error("events sent without a connection are counted as send errors")
+	}
+}
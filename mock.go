@@ -1,31 +1,356 @@
 package i2vnc
 
 import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/runz0rd/i2vnc/x11"
 	"github.com/sirupsen/logrus"
 )
 
+// RemoteEvent is a single event received by a MockRemote.
+type RemoteEvent struct {
+	Name    string
+	Key     uint32
+	Button  uint8
+	X       uint16
+	Y       uint16
+	IsKey   bool
+	IsPress bool
+	Time    time.Time
+}
+
+func (e RemoteEvent) String() string {
+	if e.IsKey {
+		return fmt.Sprintf("key %v %#x isPress:%v", e.Name, e.Key, e.IsPress)
+	}
+	return fmt.Sprintf("pointer %v %v at %v %v isPress:%v", e.Name, e.Button, e.X, e.Y, e.IsPress)
+}
+
+// MockRemote is a Remote that records every event sent to it.
+// It is safe for concurrent use.
 type MockRemote struct {
-	l *logrus.Entry
+	l          *logrus.Entry
+	mu         sync.Mutex
+	screen     Screen
+	cname      string
+	connected  bool
+	connects   []string
+	events     []RemoteEvent
+	connectErr error
+	// pointerPos is set when the remote moved the pointer
+	pointerPos *Screen
+	monitors   []Monitor
+	// locks are the lock states reported, nil if they aren't
+	locks *Locks
+	// pending holds back the first update after connecting
+	pending bool
 }
 
-func NewMockRemote(l *logrus.Entry) *MockRemote {
-	return &MockRemote{l}
+func NewMockRemote(l *logrus.Entry, screen Screen) *MockRemote {
+	return &MockRemote{l: l, screen: screen}
 }
 
-func (r MockRemote) ScreenW() uint16 {
-	return 1
+func (r *MockRemote) IsConnected() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.connected
 }
 
-func (r MockRemote) ScreenH() uint16 {
-	return 1
+func (r *MockRemote) Connect(cname string, timeout time.Duration) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.connects = append(r.connects, cname)
+	if r.connectErr != nil {
+		return r.connectErr
+	}
+	r.cname = cname
+	r.connected = true
+	return nil
 }
 
-func (r MockRemote) SendKeyEvent(name string, key uint32, isPress bool) error {
-	DebugEvent(r.l, "MockRemote", true, name, 0, 0, isPress)
+func (r *MockRemote) Disconnect() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.connected = false
 	return nil
 }
 
-func (r MockRemote) SendPointerEvent(name string, button uint8, x, y uint16, isPress bool) error {
-	DebugEvent(r.l, "MockRemote", false, name, x, y, isPress)
+func (r *MockRemote) Screen() Screen {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.connected {
+		return Screen{}
+	}
+	return r.screen
+}
+
+func (r *MockRemote) SendKeyEvent(name string, key uint32, isPress bool) error {
+	return r.record(RemoteEvent{Name: name, Key: key, IsKey: true, IsPress: isPress})
+}
+
+func (r *MockRemote) SendPointerEvent(name string, button uint8, x, y uint16, isPress bool) error {
+	return r.record(RemoteEvent{Name: name, Button: button, X: x, Y: y, IsPress: isPress})
+}
+
+func (r *MockRemote) PointerPos() (Screen, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.pointerPos == nil {
+		return Screen{}, false
+	}
+	pos := *r.pointerPos
+	r.pointerPos = nil
+	return pos, true
+}
+
+func (r *MockRemote) Monitors() []Monitor {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.connected {
+		return nil
+	}
+	return r.monitors
+}
+
+func (r *MockRemote) Locks() (Locks, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.connected || r.locks == nil {
+		return Locks{}, false
+	}
+	return *r.locks, true
+}
+
+func (r *MockRemote) Updated() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.connected && !r.pending
+}
+
+// SetPending holds back the first update of the connection, as if it
+// didn't arrive yet, until it's unset.
+func (r *MockRemote) SetPending(pending bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.pending = pending
+}
+
+func (r *MockRemote) record(re RemoteEvent) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.connected {
+		return fmt.Errorf("remote not connected")
+	}
+	re.Time = time.Now()
+	r.events = append(r.events, re)
+	DebugEvent(r.l, "MockRemote", re.IsKey, re.Name, re.X, re.Y, re.IsPress)
 	return nil
 }
+
+// SetScreen sets the screen of the remotes connected to.
+func (r *MockRemote) SetScreen(screen Screen) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.screen = screen
+}
+
+// SetMonitors sets the monitor layout of the remotes connected to.
+func (r *MockRemote) SetMonitors(monitors []Monitor) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.monitors = monitors
+}
+
+// SetLocks sets the lock states reported by the remotes connected to.
+func (r *MockRemote) SetLocks(locks Locks) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.locks = &locks
+}
+
+// SetPointerPos moves the pointer, as if the remote moved it itself.
+func (r *MockRemote) SetPointerPos(pos Screen) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.pointerPos = &pos
+}
+
+// SetConnectError makes every following Connect fail with err.
+func (r *MockRemote) SetConnectError(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.connectErr = err
+}
+
+// Connected returns the name of the last remote connected to.
+func (r *MockRemote) Connected() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.cname
+}
+
+// Connects returns the names of all attempted connections, in order.
+func (r *MockRemote) Connects() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.connects...)
+}
+
+// Events returns a copy of all recorded events.
+func (r *MockRemote) Events() []RemoteEvent {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]RemoteEvent(nil), r.events...)
+}
+
+// Reset drops all recorded events.
+func (r *MockRemote) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = nil
+}
+
+// MockInput is an Input that is fed synthetic events instead of reading
+// them from a window system. In relative pointer mode the local pointer
+// is kept in the local screen center, as it is with the X11 pointer warping.
+type MockInput struct {
+	*inputHandler
+	screen  Screen
+	grabbed bool
+	// released is the release hotkey while the grab is released
+	released string
+	// locks are the local lock states, they can't be queried while nil
+	locks *Locks
+	// mu is held while feeding an event into the pipeline,
+	// as if it was the event loop
+	mu sync.Mutex
+}
+
+func NewMockInput(logger *logrus.Logger, r Remote, c Config, screen Screen, forever bool) *MockInput {
+	i := &MockInput{screen: screen}
+	i.inputHandler = newInputHandler(logrus.NewEntry(logger), i, r, c, forever)
+	return i
+}
+
+func (i *MockInput) Grab() error {
+	i.grabbed = true
+	// set the remote pointer to the middle of remote screen
+	i.r.SendPointerEvent("Motion", 0, i.e.remote.X, i.e.remote.Y, true)
+	i.notify(Status{Grabbed: true})
+	return nil
+}
+
+func (i *MockInput) Ungrab() error {
+	i.grabbed = false
+	return nil
+}
+
+func (i *MockInput) Screen() Screen {
+	return i.screen
+}
+
+// SetScreen changes the local screen, as if the local monitor changed.
+func (i *MockInput) SetScreen(screen Screen) {
+	i.screen = screen
+	i.localResized(screen)
+}
+
+// SetLocks sets the local lock states.
+func (i *MockInput) SetLocks(locks Locks) {
+	i.locks = &locks
+}
+
+func (i *MockInput) lockState() (Locks, error) {
+	if i.locks == nil {
+		return Locks{}, fmt.Errorf("no local lock states set")
+	}
+	return *i.locks, nil
+}
+
+// IsGrabbed reports whether the input is grabbed.
+func (i *MockInput) IsGrabbed() bool {
+	return i.grabbed
+}
+
+// release ungrabs the input until the last key of the keys is pressed.
+func (i *MockInput) release(keys string) error {
+	i.grabbed = false
+	i.released = keys
+	return nil
+}
+
+// KeyEvent feeds a key press or release, by keysym name, into the pipeline.
+// While the grab is released only the last key of the release hotkey
+// is seen, grabbing the input again.
+func (i *MockInput) KeyEvent(name string, isPress bool) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.released != "" {
+		keys := strings.Split(i.released, "+")
+		if isPress && name == keys[len(keys)-1] {
+			i.released = ""
+			i.grabbed = true
+			i.notify(i.grabbedStatus())
+		}
+		return nil
+	}
+	key, ok := x11.Keysyms[name]
+	if !ok {
+		return fmt.Errorf("no keysym definition found for %q", name)
+	}
+	i.handleKeysym(0, 0, key, isPress)
+	return nil
+}
+
+// ButtonEvent feeds a button press or release, by button name, into the pipeline.
+func (i *MockInput) ButtonEvent(name string, isPress bool) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	button, ok := x11.Buttons[name]
+	if !ok {
+		return fmt.Errorf("no button definition found for %q", name)
+	}
+	x, y := i.center()
+	if i.e.absolute {
+		x, y = int16(i.e.local.X), int16(i.e.local.Y)
+	}
+	i.handlePointerEvent(0, button, x, y, isPress)
+	return nil
+}
+
+// Motion feeds a pointer motion of dx, dy pixels into the pipeline.
+func (i *MockInput) Motion(dx, dy int16) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	x, y := i.center()
+	i.handlePointerEvent(0, i.e.getButtonForMotion(), x+dx, y+dy, i.e.getCurrentIsPress())
+}
+
+// Scroll feeds a high resolution scroll of dx, dy wheel clicks into the pipeline.
+func (i *MockInput) Scroll(dx, dy float64) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.handleScroll(dx, dy)
+}
+
+// MoveTo feeds a pointer motion to x, y on the local screen into the pipeline.
+func (i *MockInput) MoveTo(x, y int16) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.handlePointerEvent(0, i.e.getButtonForMotion(), x, y, i.e.getCurrentIsPress())
+}
+
+// post runs f in between the events fed into the pipeline.
+func (i *MockInput) post(f func()) bool {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	f()
+	return true
+}
+
+func (i *MockInput) center() (int16, int16) {
+	return int16(i.screen.X / 2), int16(i.screen.Y / 2)
+}
@@ -0,0 +1,102 @@
+package i2vnc
+
+import (
+	"fmt"
+	"image"
+)
+
+// Monitor is a monitor of the remote, a part of its framebuffer.
+type Monitor struct {
+	X      uint16 `yaml:"x"`
+	Y      uint16 `yaml:"y"`
+	Width  uint16 `yaml:"width"`
+	Height uint16 `yaml:"height"`
+}
+
+func (m Monitor) String() string {
+	return fmt.Sprintf("%vx%v+%v+%v", m.Width, m.Height, m.X, m.Y)
+}
+
+func (m Monitor) center() Screen {
+	return Screen{m.X + m.Width/2, m.Y + m.Height/2}
+}
+
+func (m Monitor) contains(x, y int) bool {
+	return x >= int(m.X) && x < int(m.X)+int(m.Width) &&
+		y >= int(m.Y) && y < int(m.Y)+int(m.Height)
+}
+
+// clamp returns the point of the monitor closest to x, y.
+func (m Monitor) clamp(x, y int) Screen {
+	return Screen{clampRange(x, int(m.X), int(m.X)+int(m.Width)-1),
+		clampRange(y, int(m.Y), int(m.Y)+int(m.Height)-1)}
+}
+
+// distance returns the squared distance of x, y to the monitor.
+func (m Monitor) distance(x, y int) int {
+	p := m.clamp(x, y)
+	dx, dy := int(p.X)-x, int(p.Y)-y
+	return dx*dx + dy*dy
+}
+
+func (m Monitor) validate() error {
+	if m.Width == 0 || m.Height == 0 {
+		return fmt.Errorf("monitor %v has no size", m)
+	}
+	return nil
+}
+
+func clampRange(v, min, max int) uint16 {
+	if v < min {
+		return uint16(min)
+	}
+	if v > max {
+		return uint16(max)
+	}
+	return uint16(v)
+}
+
+// monitorCoords moves the remote pointer from from to x, y, keeping it on the
+// monitors. A move ending in a gap between the monitors, or outside of them,
+// stops at the edge of the monitor it started on, or the one closest to it.
+func monitorCoords(from Screen, x, y int, monitors []Monitor) Screen {
+	if len(monitors) == 0 {
+		return Screen{uint16(x), uint16(y)}
+	}
+	for _, m := range monitors {
+		if m.contains(x, y) {
+			return Screen{uint16(x), uint16(y)}
+		}
+	}
+	nearest := monitors[0]
+	for _, m := range monitors[1:] {
+		if m.distance(int(from.X), int(from.Y)) < nearest.distance(int(from.X), int(from.Y)) {
+			nearest = m
+		}
+	}
+	return nearest.clamp(x, y)
+}
+
+// monitorsFromRects turns the screen layout reported by the server into monitors.
+func monitorsFromRects(rects []image.Rectangle) []Monitor {
+	var monitors []Monitor
+	for _, r := range rects {
+		if r.Empty() {
+			continue
+		}
+		monitors = append(monitors, Monitor{uint16(r.Min.X), uint16(r.Min.Y), uint16(r.Dx()), uint16(r.Dy())})
+	}
+	return monitors
+}
+
+func monitorsEqual(a, b []Monitor) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
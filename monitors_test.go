@@ -0,0 +1,42 @@
+package i2vnc
+
+import (
+	"image"
+	"reflect"
+	"testing"
+)
+
+func Test_monitorCoords(t *testing.T) {
+	// a smaller monitor right of a larger one, leaving a gap below it
+	monitors := []Monitor{{0, 0, 1200, 1000}, {1200, 0, 800, 600}}
+	tests := []struct {
+		name     string
+		from     Screen
+		x, y     int
+		monitors []Monitor
+		want     Screen
+	}{
+		{"no monitors", Screen{10, 10}, 20, 30, nil, Screen{20, 30}},
+		{"same monitor", Screen{100, 100}, 200, 300, monitors, Screen{200, 300}},
+		{"to other monitor", Screen{1100, 500}, 1300, 500, monitors, Screen{1300, 500}},
+		{"into gap", Screen{1100, 800}, 1300, 800, monitors, Screen{1199, 800}},
+		{"into gap from above", Screen{1500, 500}, 1500, 800, monitors, Screen{1500, 599}},
+		{"off screen", Screen{100, 100}, -50, 1200, monitors, Screen{0, 999}},
+		{"from gap", Screen{1500, 900}, 1500, 950, monitors, Screen{1199, 950}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := monitorCoords(tt.from, tt.x, tt.y, tt.monitors); got != tt.want {
+				t.Errorf("monitorCoords() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_monitorsFromRects(t *testing.T) {
+	rects := []image.Rectangle{image.Rect(0, 0, 1920, 1080), {}, image.Rect(1920, 0, 4480, 1440)}
+	want := []Monitor{{0, 0, 1920, 1080}, {1920, 0, 2560, 1440}}
+	if got := monitorsFromRects(rects); !reflect.DeepEqual(got, want) {
+		t.Errorf("monitorsFromRects() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,152 @@
+package i2vnc
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	notificationsName   = "org.freedesktop.Notifications"
+	notificationsPath   = "/org/freedesktop/Notifications"
+	notificationsNotify = notificationsName + ".Notify"
+	notificationsApp    = "i2vnc"
+	notificationsIcon   = "input-keyboard"
+	notificationsQueue  = 16
+	notifyTimeout       = time.Second
+
+	urgencyNormal   = byte(1)
+	urgencyCritical = byte(2)
+)
+
+type notificationsConfig struct {
+	// Enabled sends desktop notifications over the session bus.
+	Enabled bool `yaml:"enabled"`
+	// TimeoutMs is how long the notifications are shown,
+	// the notification server decides if it's 0.
+	TimeoutMs int32 `yaml:"timeoutMs"`
+}
+
+// notification is a freedesktop notification.
+type notification struct {
+	summary string
+	body    string
+	urgency byte
+}
+
+// DBusNotifier is an Indicator sending freedesktop notifications when connecting,
+// switching, disconnecting or failing to connect to a remote. The notifications
+// are sent in the background, so a slow notification server doesn't slow the input.
+type DBusNotifier struct {
+	l       *logrus.Entry
+	conn    *dbus.Conn
+	obj     dbus.BusObject
+	timeout int32
+	queue   chan notification
+	done    sync.WaitGroup
+	// mu guards closing the queue, nothing is queued once closed
+	mu     sync.Mutex
+	closed bool
+	// the remote connected to, to tell connecting and switching apart
+	connected string
+}
+
+// NewDBusNotifier connects to the session bus, it must be closed after use.
+func NewDBusNotifier(logger *logrus.Logger, c notificationsConfig) (*DBusNotifier, error) {
+	conn, err := dbus.ConnectSessionBus()
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to the session bus: %s", err)
+	}
+	return newDBusNotifier(logrus.NewEntry(logger), conn, c), nil
+}
+
+func newDBusNotifier(l *logrus.Entry, conn *dbus.Conn, c notificationsConfig) *DBusNotifier {
+	n := &DBusNotifier{
+		l:       l,
+		conn:    conn,
+		obj:     conn.Object(notificationsName, notificationsPath),
+		timeout: c.TimeoutMs,
+		queue:   make(chan notification, notificationsQueue),
+	}
+	if n.timeout == 0 {
+		n.timeout = -1
+	}
+	n.done.Add(1)
+	go n.send()
+	return n
+}
+
+func (n *DBusNotifier) Show(s Status) {
+	var nt notification
+	switch {
+	case s.Err != nil:
+		nt = notification{fmt.Sprintf("Unable to connect to %v", s.Remote), s.Err.Error(), urgencyCritical}
+		if !s.Connected {
+			n.connected = ""
+		}
+	case s.Connecting:
+		nt = notification{fmt.Sprintf("Waking %v", s.Remote), "connecting once it's awake", urgencyNormal}
+	case s.Switched && n.connected != "" && n.connected != s.Remote:
+		nt = notification{fmt.Sprintf("Switched to %v", s.Remote), fmt.Sprintf("from %v", n.connected), urgencyNormal}
+		n.connected = s.Remote
+	case s.Switched:
+		nt = notification{fmt.Sprintf("Connected to %v", s.Remote), "", urgencyNormal}
+		n.connected = s.Remote
+	case s.Released:
+		nt = notification{"Released the input", "press the release hotkey to grab it again", urgencyNormal}
+	case !s.Connected && s.Remote != "":
+		nt = notification{fmt.Sprintf("Disconnected from %v", s.Remote), "", urgencyNormal}
+		n.connected = ""
+	default:
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.closed {
+		return
+	}
+	select {
+	case n.queue <- nt:
+	default:
+		n.l.Warnf("dropped notification %q, too many queued", nt.summary)
+	}
+}
+
+func (n *DBusNotifier) send() {
+	defer n.done.Done()
+	// every notification replaces the previous one
+	var id uint32
+	for nt := range n.queue {
+		ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+		hints := map[string]dbus.Variant{"urgency": dbus.MakeVariant(nt.urgency)}
+		call := n.obj.CallWithContext(ctx, notificationsNotify, 0, notificationsApp, id,
+			notificationsIcon, nt.summary, nt.body, []string{}, hints, n.timeout)
+		cancel()
+		if call.Err != nil {
+			n.l.WithError(call.Err).Warnf("failed sending notification %q", nt.summary)
+			continue
+		}
+		if err := call.Store(&id); err != nil {
+			n.l.WithError(err).Warn("bad notification reply")
+		}
+	}
+}
+
+// Close sends the queued notifications and disconnects from the bus,
+// the statuses shown afterwards are ignored.
+func (n *DBusNotifier) Close() error {
+	n.mu.Lock()
+	if n.closed {
+		n.mu.Unlock()
+		return nil
+	}
+	n.closed = true
+	close(n.queue)
+	n.mu.Unlock()
+	n.done.Wait()
+	return n.conn.Close()
+}
@@ -0,0 +1,133 @@
+package i2vnc
+
+import (
+	"bufio"
+	"errors"
+	"os/exec"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/sirupsen/logrus"
+)
+
+// startDBus starts a private bus daemon and returns its address,
+// the test is skipped if dbus-daemon isn't installed.
+func startDBus(t *testing.T) string {
+	if testing.Short() {
+		t.Skip("skipping dbus-daemon test in short mode")
+	}
+	path, err := exec.LookPath("dbus-daemon")
+	if err != nil {
+		t.Skip("dbus-daemon not installed")
+	}
+	cmd := exec.Command(path, "--session", "--nofork", "--print-address")
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+	address, err := bufio.NewReader(out).ReadString('\n')
+	if err != nil {
+		t.Fatalf("failed starting dbus-daemon: %v", err)
+	}
+	return strings.TrimSpace(address)
+}
+
+type stubNotification struct {
+	replaces uint32
+	summary  string
+	body     string
+	urgency  byte
+	timeout  int32
+}
+
+// stubNotifications is a notification server recording the notifications.
+type stubNotifications struct {
+	mu    sync.Mutex
+	calls []stubNotification
+}
+
+func (s *stubNotifications) Notify(app string, replaces uint32, icon, summary, body string,
+	actions []string, hints map[string]dbus.Variant, timeout int32) (uint32, *dbus.Error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	urgency, _ := hints["urgency"].Value().(byte)
+	s.calls = append(s.calls, stubNotification{replaces, summary, body, urgency, timeout})
+	return uint32(len(s.calls)), nil
+}
+
+func (s *stubNotifications) Calls() []stubNotification {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]stubNotification(nil), s.calls...)
+}
+
+func TestDBusNotifier(t *testing.T) {
+	address := startDBus(t)
+	server, err := dbus.Connect(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	stub := &stubNotifications{}
+	if err := server.Export(stub, notificationsPath, notificationsName); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.RequestName(notificationsName, dbus.NameFlagDoNotQueue); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := dbus.Connect(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := logrus.New()
+	logger.SetLevel(logrus.PanicLevel)
+	i, r := newTestPipeline(Config{"mac": {Hotkey: "F9"}, "linux": {Hotkey: "F10"}}, false)
+	n := newDBusNotifier(logrus.NewEntry(logger), conn, notificationsConfig{TimeoutMs: 2000})
+	i.AddIndicator(n)
+
+	for _, hotkey := range []string{"F9", "F10"} {
+		press(i, hotkey)
+		release(i, hotkey)
+	}
+	r.SetConnectError(errors.New("unreachable"))
+	press(i, "F9")
+	release(i, "F9")
+	r.SetConnectError(nil)
+	for _, hotkey := range []string{"F9", "F9"} {
+		press(i, hotkey)
+		release(i, hotkey)
+	}
+	if err := n.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// the input outlives the notifier
+	press(i, "F10")
+	release(i, "F10")
+
+	want := []stubNotification{
+		{0, "Connected to mac", "", urgencyNormal, 2000},
+		{1, "Switched to linux", "from mac", urgencyNormal, 2000},
+		{2, "Unable to connect to mac", "unreachable", urgencyCritical, 2000},
+		{3, "Connected to mac", "", urgencyNormal, 2000},
+		{4, "Disconnected from mac", "", urgencyNormal, 2000},
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(stub.Calls()) < len(want) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := stub.Calls(); !reflect.DeepEqual(got, want) {
+		t.Errorf("notifications = %+v, want %+v", got, want)
+	}
+}
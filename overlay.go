@@ -0,0 +1,136 @@
+package i2vnc
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/xgbutil"
+	"github.com/BurntSushi/xgbutil/xevent"
+	"github.com/runz0rd/i2vnc/x11"
+)
+
+const (
+	OverlayPositionTop    = "top"
+	OverlayPositionBottom = "bottom"
+
+	defaultOverlayFlashMs = 500
+	defaultOverlayErrorMs = 3000
+
+	overlayColorText         = 0xffffff
+	overlayColorConnected    = 0x2e7d32
+	overlayColorDisconnected = 0x424242
+	overlayColorFlash        = 0xf9a825
+	overlayColorError        = 0xc62828
+)
+
+type overlayConfig struct {
+	// Enabled shows the overlay while the input is grabbed.
+	Enabled bool `yaml:"enabled"`
+	// Position is top or bottom, top by default.
+	Position string `yaml:"position"`
+	// FlashMs is how long the overlay flashes after switching remotes.
+	FlashMs int `yaml:"flashMs"`
+	// ErrorMs is how long errors are shown, before showing the status again.
+	ErrorMs int `yaml:"errorMs"`
+}
+
+// ShowOverlay shows the status of the pipeline in an always on top
+// overlay window, while the input is grabbed.
+func (i *X11Input) ShowOverlay(c overlayConfig) error {
+	bottom := false
+	switch c.Position {
+	case "", OverlayPositionTop:
+	case OverlayPositionBottom:
+		bottom = true
+	default:
+		return fmt.Errorf("unknown overlay position %q, must be %v or %v", c.Position, OverlayPositionTop, OverlayPositionBottom)
+	}
+	o, err := x11.NewOverlay(i.xu.Conn(), i.xu.Screen(), bottom)
+	if err != nil {
+		return fmt.Errorf("could not create overlay: %s", err)
+	}
+	o.SetMonitor(i.monitor)
+	i.overlay = o
+	xevent.ExposeFun(func(xu *xgbutil.XUtil, e xevent.ExposeEvent) {
+		if e.Count == 0 {
+			o.Redraw()
+		}
+	}).Connect(i.xu, o.Window())
+	i.AddIndicator(newOverlayIndicator(o, c))
+	return nil
+}
+
+// overlay is the window the overlayIndicator draws on.
+type overlay interface {
+	Show(text string, bg, fg uint32)
+	Hide()
+}
+
+// overlayIndicator shows the status on an overlay, flashing it after switching
+// remotes and showing errors for a while before showing the status again.
+type overlayIndicator struct {
+	o       overlay
+	flash   time.Duration
+	errTime time.Duration
+	mu      sync.Mutex
+	timer   *time.Timer
+}
+
+func newOverlayIndicator(o overlay, c overlayConfig) *overlayIndicator {
+	flash, errTime := c.FlashMs, c.ErrorMs
+	if flash <= 0 {
+		flash = defaultOverlayFlashMs
+	}
+	if errTime <= 0 {
+		errTime = defaultOverlayErrorMs
+	}
+	return &overlayIndicator{o: o, flash: time.Duration(flash) * time.Millisecond, errTime: time.Duration(errTime) * time.Millisecond}
+}
+
+func (ind *overlayIndicator) Show(s Status) {
+	ind.mu.Lock()
+	defer ind.mu.Unlock()
+	if ind.timer != nil {
+		ind.timer.Stop()
+		ind.timer = nil
+	}
+	if !s.Grabbed {
+		ind.o.Hide()
+		return
+	}
+	switch {
+	case s.Err != nil:
+		ind.o.Show(s.String(), overlayColorError, overlayColorText)
+		s.Err = nil
+		ind.later(ind.errTime, s)
+	case s.Switched:
+		ind.o.Show(s.String(), overlayColorFlash, overlayColorText)
+		s.Switched = false
+		ind.later(ind.flash, s)
+	default:
+		ind.o.Show(s.String(), statusColor(s), overlayColorText)
+	}
+}
+
+// later shows the status after d, unless another status is shown before.
+func (ind *overlayIndicator) later(d time.Duration, s Status) {
+	var timer *time.Timer
+	timer = time.AfterFunc(d, func() {
+		ind.mu.Lock()
+		defer ind.mu.Unlock()
+		if ind.timer != timer {
+			return
+		}
+		ind.timer = nil
+		ind.o.Show(s.String(), statusColor(s), overlayColorText)
+	})
+	ind.timer = timer
+}
+
+func statusColor(s Status) uint32 {
+	if s.Connected {
+		return overlayColorConnected
+	}
+	return overlayColorDisconnected
+}
@@ -0,0 +1,73 @@
+package i2vnc
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+type overlayCall struct {
+	text string
+	bg   uint32
+}
+
+// fakeOverlay records the texts shown, a hide is recorded as an empty text.
+type fakeOverlay struct {
+	mu    sync.Mutex
+	calls []overlayCall
+}
+
+func (o *fakeOverlay) Show(text string, bg, fg uint32) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.calls = append(o.calls, overlayCall{text, bg})
+}
+
+func (o *fakeOverlay) Hide() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.calls = append(o.calls, overlayCall{})
+}
+
+func (o *fakeOverlay) Calls() []overlayCall {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return append([]overlayCall(nil), o.calls...)
+}
+
+func Test_overlayIndicator(t *testing.T) {
+	o := &fakeOverlay{}
+	ind := newOverlayIndicator(o, overlayConfig{FlashMs: 10, ErrorMs: 10})
+	wait := func(n int) []overlayCall {
+		deadline := time.Now().Add(time.Second)
+		for len(o.Calls()) < n && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		return o.Calls()
+	}
+
+	ind.Show(Status{Grabbed: true})
+	ind.Show(Status{Grabbed: true, Remote: "mac", Connected: true, Switched: true})
+	wait(3)
+	ind.Show(Status{Grabbed: true, Remote: "linux", Err: errors.New("unreachable")})
+	wait(5)
+	// a status shown before the flash ends replaces it
+	ind.Show(Status{Grabbed: true, Remote: "mac", Connected: true, Switched: true})
+	ind.Show(Status{Remote: "mac"})
+	time.Sleep(30 * time.Millisecond)
+
+	want := []overlayCall{
+		{"i2vnc: not connected", overlayColorDisconnected},
+		{"i2vnc: mac", overlayColorFlash},
+		{"i2vnc: mac", overlayColorConnected},
+		{"linux: unreachable", overlayColorError},
+		{"i2vnc: not connected", overlayColorDisconnected},
+		{"i2vnc: mac", overlayColorFlash},
+		{},
+	}
+	if got := o.Calls(); !reflect.DeepEqual(got, want) {
+		t.Errorf("overlay calls = %v, want %v", got, want)
+	}
+}
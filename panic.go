@@ -0,0 +1,222 @@
+package i2vnc
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/runz0rd/i2vnc/x11"
+)
+
+const (
+	defaultPanicKeys     = "Control_L+Alt_L+Shift_L+Escape"
+	defaultPanicWithinMs = 1000
+)
+
+// panicConfig is the key sequence ungrabbing the input, however broken
+// the remote or the rest of the config is. The keys are matched by their
+// local keysyms, before the keymaps are applied.
+type panicConfig struct {
+	// Keys are held down together, Control_L+Alt_L+Shift_L+Escape if unset.
+	Keys string `yaml:"keys"`
+	// Presses is how many times the keys are pressed, once if unset.
+	Presses int `yaml:"presses"`
+	// WithinMs is the time all the presses happen in, 1000 if unset.
+	WithinMs int `yaml:"withinMs"`
+}
+
+func (c panicConfig) keys() string {
+	if c.Keys == "" {
+		return defaultPanicKeys
+	}
+	return c.Keys
+}
+
+func (c panicConfig) presses() int {
+	if c.Presses == 0 {
+		return 1
+	}
+	return c.Presses
+}
+
+func (c panicConfig) within() time.Duration {
+	if c.WithinMs == 0 {
+		return defaultPanicWithinMs * time.Millisecond
+	}
+	return time.Duration(c.WithinMs) * time.Millisecond
+}
+
+func (c panicConfig) validate() error {
+	if _, err := c.keysyms(); err != nil {
+		return err
+	}
+	if c.Presses < 0 {
+		return fmt.Errorf("panic presses can't be negative")
+	}
+	if c.WithinMs < 0 {
+		return fmt.Errorf("panic time can't be negative")
+	}
+	return nil
+}
+
+// collides reports whether pressing the panic keys presses the hotkey,
+// or a step of it, before the panic sequence is complete.
+func (c panicConfig) collides(hotkey string) bool {
+	panicKeys := strings.Split(c.keys(), "+")
+	for _, step := range sequenceSteps(hotkey) {
+		collides := true
+		for _, key := range strings.Split(step, "+") {
+			if !StringInSlice(strings.TrimSpace(key), panicKeys) {
+				collides = false
+			}
+		}
+		if collides {
+			return true
+		}
+	}
+	return false
+}
+
+// validateHotkeys checks that the panic keys don't press any of the hotkeys.
+func (c panicConfig) validateHotkeys(config Config, hotkeys []hotkeyConfig) error {
+	check := func(what, hotkey string) error {
+		if hotkey != "" && c.collides(hotkey) {
+			return fmt.Errorf("the panic keys %q press the %v hotkey %q", c.keys(), what, hotkey)
+		}
+		return nil
+	}
+	for _, h := range hotkeys {
+		if err := check(h.Action, h.Keys); err != nil {
+			return err
+		}
+	}
+	for _, name := range config.names() {
+		ci := config[name]
+		if err := check(name, ci.Hotkey); err != nil {
+			return err
+		}
+		if err := check(name+" pointer mode", ci.Pointer.ModeHotkey); err != nil {
+			return err
+		}
+		for _, hotkey := range ci.Pointer.MonitorHotkeys {
+			if err := check(name+" monitor", hotkey); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (c panicConfig) keysyms() ([]uint32, error) {
+	var keysyms []uint32
+	for _, name := range strings.Split(c.keys(), "+") {
+		keysym, ok := x11.Keysyms[name]
+		if !ok {
+			return nil, fmt.Errorf("no keysym definition found for panic key %q", name)
+		}
+		keysyms = append(keysyms, keysym)
+	}
+	return keysyms, nil
+}
+
+// panicDetector detects the panic sequence in the local key events.
+type panicDetector struct {
+	keysyms []uint32
+	presses int
+	within  time.Duration
+	// held are the local keysyms held down
+	held map[uint32]bool
+	// times are the times of the last presses of the keys
+	times []time.Time
+}
+
+func newPanicDetector(c panicConfig) (*panicDetector, error) {
+	keysyms, err := c.keysyms()
+	if err != nil {
+		return nil, err
+	}
+	return &panicDetector{keysyms: keysyms, presses: c.presses(), within: c.within(),
+		held: map[uint32]bool{}}, nil
+}
+
+// handle reports whether the key event at now completes the panic sequence.
+func (p *panicDetector) handle(keysym uint32, isPress bool, now time.Time) bool {
+	if !isPress {
+		delete(p.held, keysym)
+		return false
+	}
+	p.held[keysym] = true
+	pressed := false
+	for _, k := range p.keysyms {
+		if !p.held[k] {
+			return false
+		}
+		if k == keysym {
+			pressed = true
+		}
+	}
+	if !pressed {
+		return false
+	}
+	p.times = append(p.times, now)
+	for len(p.times) > 0 && now.Sub(p.times[0]) > p.within {
+		p.times = p.times[1:]
+	}
+	if len(p.times) < p.presses {
+		return false
+	}
+	p.times = nil
+	return true
+}
+
+// SetPanic detects the panic sequence from now on, instead of the default one.
+func (i *inputHandler) SetPanic(c panicConfig) error {
+	p, err := newPanicDetector(c)
+	if err != nil {
+		return err
+	}
+	i.panicSeq = p
+	i.panicConf = c
+	return nil
+}
+
+// panicUngrabber is implemented by inputs that can ungrab the keyboard
+// and pointer without stopping, leaving the process idle.
+type panicUngrabber interface {
+	panicUngrab() error
+}
+
+// panicked ungrabs the input first, as the remote might hang,
+// and releases the keys held on the remote. The events are ignored
+// from now on.
+func (i *inputHandler) panicked() {
+	i.l.Warn("caught the panic sequence, ungrabbing the input")
+	i.idle = true
+	var err error
+	if pu, ok := i.in.(panicUngrabber); ok {
+		err = pu.panicUngrab()
+	} else {
+		err = i.in.Ungrab()
+	}
+	if err != nil {
+		i.l.WithError(err).Error("failed ungrabbing the input")
+	}
+	var names []string
+	for name := range i.held {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		def, err := newEventDefByName(name, false)
+		if err != nil {
+			continue
+		}
+		if err := i.r.SendKeyEvent(def.Name, def.Key, false); err != nil {
+			i.l.Trace(err)
+		}
+	}
+	i.held = map[string]bool{}
+	i.notify(Status{})
+	i.l.Warn("the input is ungrabbed, i2vnc is idle until restarted")
+}
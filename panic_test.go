@@ -0,0 +1,148 @@
+package i2vnc
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/runz0rd/i2vnc/x11"
+	"github.com/sirupsen/logrus"
+)
+
+func Test_panicConfig_validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		c       panicConfig
+		wantErr bool
+	}{
+		{"default", panicConfig{}, false},
+		{"presses", panicConfig{Keys: "Scroll_Lock", Presses: 3, WithinMs: 500}, false},
+		{"unknown key", panicConfig{Keys: "Control_L+nope"}, true},
+		{"negative presses", panicConfig{Presses: -1}, true},
+		{"negative time", panicConfig{WithinMs: -1}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.c.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_panicDetector(t *testing.T) {
+	type key struct {
+		name    string
+		isPress bool
+		// at is the time of the event in ms
+		at int
+	}
+	tests := []struct {
+		name string
+		c    panicConfig
+		keys []key
+		want bool
+	}{
+		{"combo", panicConfig{}, []key{
+			{"Control_L", true, 0}, {"Alt_L", true, 0}, {"Shift_L", true, 0}, {"Escape", true, 0},
+		}, true},
+		{"combo in any order", panicConfig{}, []key{
+			{"Escape", true, 0}, {"Shift_L", true, 0}, {"Alt_L", true, 0}, {"Control_L", true, 0},
+		}, true},
+		{"combo without a key", panicConfig{}, []key{
+			{"Control_L", true, 0}, {"Shift_L", true, 0}, {"Escape", true, 0},
+		}, false},
+		{"combo after a release", panicConfig{}, []key{
+			{"Control_L", true, 0}, {"Alt_L", true, 0}, {"Alt_L", false, 0}, {"Shift_L", true, 0}, {"Escape", true, 0},
+		}, false},
+		{"presses", panicConfig{Keys: "Scroll_Lock", Presses: 3}, []key{
+			{"Scroll_Lock", true, 0}, {"Scroll_Lock", false, 100}, {"Scroll_Lock", true, 200},
+			{"Scroll_Lock", false, 300}, {"Scroll_Lock", true, 400},
+		}, true},
+		{"presses too slow", panicConfig{Keys: "Scroll_Lock", Presses: 3, WithinMs: 300}, []key{
+			{"Scroll_Lock", true, 0}, {"Scroll_Lock", false, 100}, {"Scroll_Lock", true, 200},
+			{"Scroll_Lock", false, 300}, {"Scroll_Lock", true, 400},
+		}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := newPanicDetector(tt.c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			start := time.Now()
+			got := false
+			for _, k := range tt.keys {
+				now := start.Add(time.Duration(k.at) * time.Millisecond)
+				if p.handle(x11.Keysyms[k.name], k.isPress, now) {
+					got = true
+				}
+			}
+			if got != tt.want {
+				t.Errorf("handle() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_pipeline_panic(t *testing.T) {
+	// the panic keys are matched before the keymap
+	i, r := newTestPipeline(Config{"mac": {Hotkey: "F9", Keymap: map[string]string{"Alt_L": "Meta_L"}}}, false)
+	press(i, "F9")
+	release(i, "F9")
+	r.Reset()
+	press(i, "Control_L", "Alt_L", "Shift_L", "Escape")
+	press(i, "a")
+	release(i, "a")
+
+	want := []RemoteEvent{
+		keyEv("Control_L", true), keyEv("Meta_L", true), keyEv("Shift_L", true),
+		// the held keys are released
+		keyEv("Control_L", false), keyEv("Meta_L", false), keyEv("Shift_L", false),
+	}
+	if got := stripTime(r.Events()); !reflect.DeepEqual(got, want) {
+		t.Errorf("events = %v, want %v", got, want)
+	}
+	if i.IsGrabbed() {
+		t.Error("still grabbed")
+	}
+}
+
+func TestReplay_panic(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.PanicLevel)
+	config := Config{"mac": {Name: "mac", Hotkey: "F9"}}
+	var trace bytes.Buffer
+	tracer := NewTracer(logger, &trace)
+	mock := NewMockRemote(logrus.NewEntry(logger), testRemoteScreen)
+	i := NewMockInput(logger, NewTraceRemote(mock, tracer), config, testLocalScreen, false)
+	if err := i.SetPanic(panicConfig{Keys: "Scroll_Lock", Presses: 2, WithinMs: 50}); err != nil {
+		t.Fatal(err)
+	}
+	i.SetTracer(tracer)
+	i.Grab()
+
+	press(i, "F9")
+	release(i, "F9")
+	// too slow, the replay is timed by the trace
+	press(i, "Scroll_Lock")
+	release(i, "Scroll_Lock")
+	time.Sleep(100 * time.Millisecond)
+	press(i, "Scroll_Lock")
+	release(i, "Scroll_Lock")
+	press(i, "Shift_L", "Scroll_Lock")
+	press(i, "a")
+
+	result, err := Replay(logger, bytes.NewReader(trace.Bytes()), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := result.Diff(); len(diff) != 0 {
+		t.Errorf("Replay() differs from the trace:\n%v", strings.Join(diff, "\n"))
+	}
+	if got := stripTime(mock.Events()); got[len(got)-1] != keyEv("Shift_L", false) {
+		t.Errorf("last event = %v, want the Shift_L release", got[len(got)-1])
+	}
+}
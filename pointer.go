@@ -0,0 +1,237 @@
+package i2vnc
+
+import (
+	"fmt"
+	"math"
+)
+
+const (
+	PointerModeRelative = "relative"
+	PointerModeAbsolute = "absolute"
+
+	LetterboxFit     = "fit"
+	LetterboxStretch = "stretch"
+
+	AccelProfileFlat     = "flat"
+	AccelProfileAdaptive = "adaptive"
+	AccelProfileCustom   = "custom"
+
+	defaultAccelThreshold = 4
+	defaultAccelFactor    = 2
+)
+
+type pointerConfig struct {
+	// Mode is relative (default), where local pointer deltas move the
+	// remote pointer, or absolute, where the local screen is mapped
+	// onto the remote screen.
+	Mode string `yaml:"mode"`
+	// Letterbox is how the absolute mode handles differing aspect ratios:
+	// fit (default) keeps the remote aspect ratio inside the local screen,
+	// stretch maps the whole local screen onto the remote.
+	Letterbox string `yaml:"letterbox"`
+	// ModeHotkey toggles between relative and absolute mode.
+	ModeHotkey string `yaml:"modeHotkey"`
+	// MonitorHotkeys move the pointer to the center of a remote monitor,
+	// the first hotkey to the first monitor and so on.
+	MonitorHotkeys []string `yaml:"monitorHotkeys"`
+	// Sensitivity multiplies every pointer delta, 1 if unset.
+	Sensitivity float64 `yaml:"sensitivity"`
+	// ScaleX and ScaleY additionally multiply the deltas per axis, 1 if unset.
+	ScaleX       float64     `yaml:"scaleX"`
+	ScaleY       float64     `yaml:"scaleY"`
+	Acceleration accelConfig `yaml:"acceleration"`
+}
+
+// accelConfig defines how the pointer speed, in pixels per motion event,
+// is mapped to a factor the pointer delta is multiplied with.
+//
+// flat: the factor is always 1.
+// adaptive: the factor is 1 up to threshold and rises linearly to factor
+// at four times the threshold.
+// custom: the factor is interpolated between points of speed and factor.
+type accelConfig struct {
+	Profile   string      `yaml:"profile"`
+	Threshold float64     `yaml:"threshold"`
+	Factor    float64     `yaml:"factor"`
+	Points    [][]float64 `yaml:"points"`
+}
+
+func (c pointerConfig) validate() error {
+	switch c.Mode {
+	case "", PointerModeRelative, PointerModeAbsolute:
+	default:
+		return fmt.Errorf("unknown pointer mode %q", c.Mode)
+	}
+	switch c.Letterbox {
+	case "", LetterboxFit, LetterboxStretch:
+	default:
+		return fmt.Errorf("unknown pointer letterbox %q", c.Letterbox)
+	}
+	if c.ModeHotkey != "" {
+		if _, err := getConfigDefs(c.ModeHotkey, false); err != nil {
+			return err
+		}
+	}
+	for _, hotkey := range c.MonitorHotkeys {
+		if _, err := getConfigDefs(hotkey, false); err != nil {
+			return err
+		}
+		if hotkey == c.ModeHotkey {
+			return fmt.Errorf("pointer monitor hotkeys can't be the same as the mode hotkey")
+		}
+	}
+	if c.Sensitivity < 0 || c.ScaleX < 0 || c.ScaleY < 0 {
+		return fmt.Errorf("pointer sensitivity and scale can't be negative")
+	}
+	a := c.Acceleration
+	switch a.Profile {
+	case "", AccelProfileFlat:
+	case AccelProfileAdaptive:
+		if a.Threshold < 0 || a.Factor < 0 {
+			return fmt.Errorf("adaptive acceleration threshold and factor can't be negative")
+		}
+	case AccelProfileCustom:
+		if len(a.Points) == 0 {
+			return fmt.Errorf("custom acceleration needs at least one point")
+		}
+		for i, p := range a.Points {
+			if len(p) != 2 {
+				return fmt.Errorf("custom acceleration point %v should be [speed, factor]", p)
+			}
+			if i > 0 && p[0] <= a.Points[i-1][0] {
+				return fmt.Errorf("custom acceleration points should be sorted by speed")
+			}
+		}
+	default:
+		return fmt.Errorf("unknown acceleration profile %q", a.Profile)
+	}
+	return nil
+}
+
+// pointerAccel turns local pointer deltas into remote pointer deltas.
+// Fractions of a pixel are accumulated, so slow movements aren't lost.
+type pointerAccel struct {
+	c     pointerConfig
+	restX float64
+	restY float64
+}
+
+func newPointerAccel(c pointerConfig) *pointerAccel {
+	return &pointerAccel{c: c}
+}
+
+func (p *pointerAccel) move(dx, dy int) (int, int) {
+	if dx == 0 && dy == 0 {
+		return 0, 0
+	}
+	f := orOne(p.c.Sensitivity) * p.factor(math.Hypot(float64(dx), float64(dy)))
+	var x, y int
+	x, p.restX = accumulate(float64(dx)*f*orOne(p.c.ScaleX), p.restX)
+	y, p.restY = accumulate(float64(dy)*f*orOne(p.c.ScaleY), p.restY)
+	return x, y
+}
+
+func (p *pointerAccel) factor(speed float64) float64 {
+	a := p.c.Acceleration
+	switch a.Profile {
+	case AccelProfileAdaptive:
+		threshold, factor := a.Threshold, a.Factor
+		if threshold == 0 {
+			threshold = defaultAccelThreshold
+		}
+		if factor == 0 {
+			factor = defaultAccelFactor
+		}
+		if speed <= threshold {
+			return 1
+		}
+		if speed >= 4*threshold {
+			return factor
+		}
+		return 1 + (factor-1)*(speed-threshold)/(3*threshold)
+	case AccelProfileCustom:
+		return interpolate(a.Points, speed)
+	}
+	return 1
+}
+
+// accumulate adds the rest of the previous move to the delta and returns
+// the whole pixels and the new rest. The rest is dropped when the
+// direction changes.
+func accumulate(delta, rest float64) (int, float64) {
+	if delta*rest < 0 {
+		rest = 0
+	}
+	delta += rest
+	whole := math.Trunc(delta)
+	return int(whole), delta - whole
+}
+
+// interpolate returns the linearly interpolated factor for speed,
+// clamped to the first and last point.
+func interpolate(points [][]float64, speed float64) float64 {
+	if len(points) == 0 {
+		return 1
+	}
+	if speed <= points[0][0] {
+		return points[0][1]
+	}
+	for i := 1; i < len(points); i++ {
+		if speed <= points[i][0] {
+			a, b := points[i-1], points[i]
+			return a[1] + (b[1]-a[1])*(speed-a[0])/(b[0]-a[0])
+		}
+	}
+	return points[len(points)-1][1]
+}
+
+func orOne(v float64) float64 {
+	if v == 0 {
+		return 1
+	}
+	return v
+}
+
+// absoluteCoords maps local screen coordinates onto the remote screen.
+func absoluteCoords(x, y uint16, local, remote Screen, letterbox string) Screen {
+	if local.X == 0 || local.Y == 0 || remote.X == 0 || remote.Y == 0 {
+		return Screen{}
+	}
+	// remote pixels per local pixel
+	scaleX := float64(remote.X) / float64(local.X)
+	scaleY := float64(remote.Y) / float64(local.Y)
+	var offsetX, offsetY float64
+	if letterbox != LetterboxStretch {
+		// use the same scale on both axes and center the mapped area,
+		// the bars outside of it are clamped to the remote edges
+		scale := math.Max(scaleX, scaleY)
+		scaleX, scaleY = scale, scale
+		offsetX = (float64(local.X) - float64(remote.X)/scale) / 2
+		offsetY = (float64(local.Y) - float64(remote.Y)/scale) / 2
+	}
+	return Screen{
+		clampCoord((float64(x)-offsetX)*scaleX, remote.X),
+		clampCoord((float64(y)-offsetY)*scaleY, remote.Y),
+	}
+}
+
+// rescaleCoords moves the remote coordinates to the same relative spot of the resized remote screen.
+func rescaleCoords(coords, from, to Screen) Screen {
+	if from.X == 0 || from.Y == 0 || to.X == 0 || to.Y == 0 {
+		return Screen{to.X / 2, to.Y / 2}
+	}
+	return Screen{
+		clampCoord(float64(coords.X)*float64(to.X)/float64(from.X), to.X),
+		clampCoord(float64(coords.Y)*float64(to.Y)/float64(from.Y), to.Y),
+	}
+}
+
+func clampCoord(v float64, max uint16) uint16 {
+	if v < 0 {
+		return 0
+	}
+	if v > float64(max-1) {
+		return max - 1
+	}
+	return uint16(v)
+}
@@ -0,0 +1,162 @@
+package i2vnc
+
+import (
+	"math"
+	"testing"
+)
+
+func Test_pointerAccel_move(t *testing.T) {
+	type delta struct{ x, y int }
+	tests := []struct {
+		name   string
+		c      pointerConfig
+		deltas []delta
+		want   delta
+	}{
+		{"default is 1:1", pointerConfig{}, []delta{{3, -4}, {10, 0}}, delta{13, -4}},
+		{"sensitivity", pointerConfig{Sensitivity: 2}, []delta{{3, -4}}, delta{6, -8}},
+		{"per axis scale", pointerConfig{ScaleX: 2, ScaleY: 0.5}, []delta{{4, 4}}, delta{8, 2}},
+		{
+			name:   "sub-pixel accumulation",
+			c:      pointerConfig{Sensitivity: 0.25},
+			deltas: []delta{{1, 1}, {1, 1}, {1, 1}, {1, 1}, {1, 1}, {1, 1}, {1, 1}, {1, 1}},
+			want:   delta{2, 2},
+		},
+		{
+			name:   "rest dropped on direction change",
+			c:      pointerConfig{Sensitivity: 0.5},
+			deltas: []delta{{1, 0}, {-1, 0}, {-1, 0}},
+			want:   delta{-1, 0},
+		},
+		{
+			name:   "flat profile",
+			c:      pointerConfig{Acceleration: accelConfig{Profile: AccelProfileFlat}},
+			deltas: []delta{{30, 40}},
+			want:   delta{30, 40},
+		},
+		{
+			name:   "adaptive below threshold",
+			c:      pointerConfig{Acceleration: accelConfig{Profile: AccelProfileAdaptive, Threshold: 10, Factor: 3}},
+			deltas: []delta{{6, 8}},
+			want:   delta{6, 8},
+		},
+		{
+			name:   "adaptive ramp",
+			c:      pointerConfig{Acceleration: accelConfig{Profile: AccelProfileAdaptive, Threshold: 10, Factor: 3}},
+			deltas: []delta{{15, 20}},
+			want:   delta{30, 40},
+		},
+		{
+			name:   "adaptive max",
+			c:      pointerConfig{Acceleration: accelConfig{Profile: AccelProfileAdaptive, Threshold: 10, Factor: 3}},
+			deltas: []delta{{60, 80}},
+			want:   delta{180, 240},
+		},
+		{
+			name:   "adaptive defaults",
+			c:      pointerConfig{Acceleration: accelConfig{Profile: AccelProfileAdaptive}},
+			deltas: []delta{{0, 16}},
+			want:   delta{0, 32},
+		},
+		{
+			name: "custom curve",
+			c: pointerConfig{Acceleration: accelConfig{
+				Profile: AccelProfileCustom,
+				Points:  [][]float64{{0, 1}, {10, 2}, {20, 4}},
+			}},
+			deltas: []delta{{5, 0}, {15, 0}, {40, 0}},
+			want:   delta{212, 0},
+		},
+		{
+			name: "custom curve with sensitivity",
+			c: pointerConfig{Sensitivity: 2, Acceleration: accelConfig{
+				Profile: AccelProfileCustom,
+				Points:  [][]float64{{0, 1}, {10, 2}},
+			}},
+			deltas: []delta{{0, 10}},
+			want:   delta{0, 40},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newPointerAccel(tt.c)
+			var got delta
+			for _, d := range tt.deltas {
+				x, y := p.move(d.x, d.y)
+				got.x += x
+				got.y += y
+			}
+			if got != tt.want {
+				t.Errorf("move() total = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_pointerAccel_slowMovementNotLost(t *testing.T) {
+	p := newPointerAccel(pointerConfig{Sensitivity: 0.3})
+	var total int
+	for i := 0; i < 1000; i++ {
+		x, _ := p.move(1, 0)
+		total += x
+	}
+	if math.Abs(float64(total)-300) > 1 {
+		t.Errorf("total = %v, want 300", total)
+	}
+}
+
+func Test_pointerConfig_validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		c       pointerConfig
+		wantErr bool
+	}{
+		{"empty", pointerConfig{}, false},
+		{"monitor hotkey is mode hotkey", pointerConfig{ModeHotkey: "F1", MonitorHotkeys: []string{"F1"}}, true},
+		{"unknown monitor hotkey", pointerConfig{MonitorHotkeys: []string{"Nope"}}, true},
+		{"negative sensitivity", pointerConfig{Sensitivity: -1}, true},
+		{"unknown profile", pointerConfig{Acceleration: accelConfig{Profile: "fast"}}, true},
+		{"custom without points", pointerConfig{Acceleration: accelConfig{Profile: AccelProfileCustom}}, true},
+		{"custom bad point", pointerConfig{Acceleration: accelConfig{Profile: AccelProfileCustom, Points: [][]float64{{1}}}}, true},
+		{"custom unsorted", pointerConfig{Acceleration: accelConfig{Profile: AccelProfileCustom, Points: [][]float64{{2, 1}, {1, 2}}}}, true},
+		{"custom", pointerConfig{Acceleration: accelConfig{Profile: AccelProfileCustom, Points: [][]float64{{1, 1}, {2, 2}}}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.c.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_absoluteCoords(t *testing.T) {
+	local := Screen{1000, 800}
+	remote := Screen{2000, 1000}
+	tests := []struct {
+		name      string
+		x, y      uint16
+		local     Screen
+		letterbox string
+		want      Screen
+	}{
+		{"stretch center", 500, 400, local, LetterboxStretch, Screen{1000, 500}},
+		{"stretch origin", 0, 0, local, LetterboxStretch, Screen{0, 0}},
+		{"stretch far edge", 999, 799, local, LetterboxStretch, Screen{1998, 998}},
+		{"stretch clamped", 1000, 800, local, LetterboxStretch, Screen{1999, 999}},
+		{"fit center", 500, 400, local, LetterboxFit, Screen{1000, 500}},
+		{"fit area origin", 0, 150, local, LetterboxFit, Screen{0, 0}},
+		{"fit top bar", 250, 100, local, LetterboxFit, Screen{500, 0}},
+		{"fit bottom bar", 500, 700, local, LetterboxFit, Screen{1000, 999}},
+		{"fit is default", 250, 100, local, "", Screen{500, 0}},
+		{"fit same aspect ratio", 250, 250, Screen{1000, 500}, LetterboxFit, Screen{500, 500}},
+		{"not connected", 250, 250, Screen{}, LetterboxFit, Screen{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := absoluteCoords(tt.x, tt.y, tt.local, remote, tt.letterbox); got != tt.want {
+				t.Errorf("absoluteCoords() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
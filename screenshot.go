@@ -0,0 +1,66 @@
+package i2vnc
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"net"
+	"time"
+
+	"github.com/kward/go-vnc"
+	"github.com/sirupsen/logrus"
+)
+
+// screenshotTimeout limits the whole screenshot, from connecting
+// to receiving the framebuffer.
+const screenshotTimeout = 30 * time.Second
+
+// Screenshot connects to the remote, requests the whole framebuffer
+// and returns it once received. It doesn't disturb a VncRemote
+// connected to the same remote, as it uses a connection of its own.
+func Screenshot(logger *logrus.Logger, c Config, cname string) (*image.RGBA, error) {
+	l := logrus.NewEntry(logger).WithField(LoggerFieldRemote, cname)
+	ci, err := c.getItem(cname)
+	if err != nil {
+		return nil, err
+	}
+	l.Infof("connecting to vnc remote %q for a screenshot", cname)
+	nc, err := net.DialTimeout("tcp", fmt.Sprintf("%v:%v", ci.Server, ci.Port), ci.timeout())
+	if err != nil {
+		return nil, err
+	}
+	defer nc.Close()
+	nc.SetDeadline(time.Now().Add(screenshotTimeout))
+	vc, err := vnc.Connect(context.Background(), nc, vnc.NewClientConfig(ci.Pw))
+	if err != nil {
+		return nil, err
+	}
+	if err := vc.SetPixelFormat(FramebufferPixelFormat); err != nil {
+		return nil, err
+	}
+	if err := setEncodings(nc, framebufferEncodings); err != nil {
+		return nil, err
+	}
+	fb := newFramebuffer(nc, vc.FramebufferWidth(), vc.FramebufferHeight())
+	// servers may send the framebuffer over several updates, the first
+	// ones possibly carrying only pseudo-rectangles
+	var received image.Rectangle
+	for !fb.img.Bounds().In(received) {
+		if err := requestUpdate(nc, false, fb.img.Bounds()); err != nil {
+			return nil, err
+		}
+		img := fb.img
+		damage, err := fb.readUpdate()
+		if err != nil {
+			return nil, fmt.Errorf("failed reading framebuffer: %s", err)
+		}
+		if fb.img != img {
+			// the resized framebuffer is empty, its contents are requested again
+			received = image.Rectangle{}
+			continue
+		}
+		received = received.Union(damage)
+	}
+	l.Infof("received %vx%v framebuffer of %q", fb.img.Bounds().Dx(), fb.img.Bounds().Dy(), cname)
+	return fb.img, nil
+}
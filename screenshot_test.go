@@ -0,0 +1,106 @@
+package i2vnc
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+
+	"github.com/runz0rd/i2vnc/vnctest"
+	"github.com/sirupsen/logrus"
+)
+
+// testFramebuffer has bands of 150x20 pixels, each suiting a different encoding.
+func testFramebuffer() *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, 150, 180))
+	gradient := func(band int) {
+		for y := band * 20; y < (band+1)*20; y++ {
+			for x := 0; x < 150; x++ {
+				img.SetRGBA(x, y, color.RGBA{uint8(x), uint8(y % 20 * 10), uint8(x + y%20), 0xff})
+			}
+		}
+	}
+	stripes := func(band int, colors ...color.RGBA) {
+		for y := band * 20; y < (band+1)*20; y++ {
+			for x := 0; x < 150; x++ {
+				img.SetRGBA(x, y, colors[(x/7+y)%len(colors)])
+			}
+		}
+	}
+	red := color.RGBA{0xff, 0, 0, 0xff}
+	green := color.RGBA{0, 0xff, 0, 0xff}
+	blue := color.RGBA{0, 0, 0xff, 0xff}
+	white := color.RGBA{0xff, 0xff, 0xff, 0xff}
+	gray := color.RGBA{0x80, 0x80, 0x80, 0xff}
+	gradient(0)
+	gradient(1)
+	gradient(2)
+	gradient(3)
+	stripes(4, red, blue)
+	stripes(5, red, green, blue)
+	stripes(6, red, green, blue, white, gray)
+	draw.Draw(img, image.Rect(0, 140, 150, 160), image.NewUniform(green), image.Point{}, draw.Src)
+	stripes(8, white, gray)
+	return img
+}
+
+func TestScreenshot(t *testing.T) {
+	all := []int32{
+		vnctest.EncodingRaw,      // gradient
+		vnctest.EncodingZRLE,     // raw tiles
+		vnctest.EncodingCopyRect, // copy of the first band
+		vnctest.EncodingTight,    // basic compression
+		vnctest.EncodingZRLE,     // 1 bit palette
+		vnctest.EncodingZRLE,     // 2 bit palette
+		vnctest.EncodingZRLE,     // 4 bit palette
+		vnctest.EncodingTight,    // fill
+		vnctest.EncodingCopyRect, // not found, raw
+	}
+	tests := []struct {
+		name      string
+		encodings []int32
+		pseudo    bool
+	}{
+		{"raw", nil, false},
+		{"all encodings", all, false},
+		{"tight", []int32{vnctest.EncodingTight, vnctest.EncodingTight, vnctest.EncodingTight}, false},
+		{"hextile", []int32{vnctest.EncodingHextile, vnctest.EncodingHextile, vnctest.EncodingHextile}, false},
+		{"pseudo-rectangles first", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logger := logrus.New()
+			logger.SetLevel(logrus.PanicLevel)
+			want := testFramebuffer()
+			s := vnctest.NewServer(logger, vnctest.Config{Width: 150, Height: 180, Framebuffer: want, Encodings: tt.encodings,
+				PseudoFirstUpdate: tt.pseudo})
+			if err := s.Listen(""); err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			config := Config{"mac": {Name: "mac", Server: "127.0.0.1", Port: s.Addr().Port}}
+			got, err := Screenshot(logger, config, "mac")
+			if err != nil {
+				t.Fatalf("Screenshot() error = %v", err)
+			}
+			if got.Bounds() != want.Bounds() {
+				t.Fatalf("Screenshot() bounds = %v, want %v", got.Bounds(), want.Bounds())
+			}
+			for y := 0; y < 180; y++ {
+				for x := 0; x < 150; x++ {
+					if got.RGBAAt(x, y) != want.RGBAAt(x, y) {
+						t.Fatalf("Screenshot() pixel %v,%v = %v, want %v", x, y, got.RGBAAt(x, y), want.RGBAAt(x, y))
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestScreenshot_unknownRemote(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.PanicLevel)
+	if _, err := Screenshot(logger, Config{}, "mac"); err == nil {
+		t.Error("Screenshot() expected an error for an unknown remote")
+	}
+}
@@ -0,0 +1,68 @@
+package i2vnc
+
+import (
+	"github.com/runz0rd/i2vnc/x11"
+)
+
+type scrollConfig struct {
+	// Vertical and Horizontal are the remote wheel clicks sent for every
+	// local wheel click, the vertical speed falls back to scrollSpeed.
+	Vertical   uint8 `yaml:"vertical"`
+	Horizontal uint8 `yaml:"horizontal"`
+	// Natural inverts the scroll direction on both axes.
+	Natural bool `yaml:"natural"`
+	// Smooth reads the high resolution scroll of XInput2 devices,
+	// like touchpads, and accumulates it into whole wheel clicks.
+	Smooth bool `yaml:"smooth"`
+}
+
+func isScrollButton(button uint8) bool {
+	switch button {
+	case x11.Buttons["Button_Up"], x11.Buttons["Button_Down"],
+		x11.Buttons["Button_6"], x11.Buttons["Button_7"]:
+		return true
+	}
+	return false
+}
+
+// resolve repeats the scroll button def by the speed of its axis
+// and inverts its direction for natural scrolling.
+func (c scrollConfig) resolve(def EventDef) []EventDef {
+	speed := c.Vertical
+	if def.Button == x11.Buttons["Button_6"] || def.Button == x11.Buttons["Button_7"] {
+		speed = c.Horizontal
+	}
+	if c.Natural {
+		def = invertScroll(def)
+	}
+	return resolveScrollButton(def, speed)
+}
+
+var scrollInversions = map[string]string{
+	"Button_Up":   "Button_Down",
+	"Button_Down": "Button_Up",
+	"Button_6":    "Button_7",
+	"Button_7":    "Button_6",
+}
+
+func invertScroll(def EventDef) EventDef {
+	inverted, err := newEventDefByName(scrollInversions[def.Name], def.IsPress)
+	if err != nil {
+		return def
+	}
+	return *inverted
+}
+
+// smoothScroll accumulates high resolution scroll deltas, in wheel clicks,
+// into whole wheel clicks.
+type smoothScroll struct {
+	restX float64
+	restY float64
+}
+
+func (s *smoothScroll) clicks(dx, dy float64) (int, int) {
+	var x, y int
+	x, s.restX = accumulate(dx, s.restX)
+	y, s.restY = accumulate(dy, s.restY)
+	return x, y
+}
@@ -0,0 +1,248 @@
+package i2vnc
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	SequenceAbortFlush = "flush"
+	SequenceAbortDrop  = "drop"
+
+	defaultSequenceTimeoutMs = 1000
+	// sequenceSep separates the steps of a sequence hotkey, like Super_R, m
+	sequenceSep = ","
+)
+
+// sequencesConfig configures the sequence hotkeys, the hotkeys typed
+// as a sequence of key combinations.
+type sequencesConfig struct {
+	// TimeoutMs aborts a sequence when its next step isn't pressed
+	// in time, 1000 if unset.
+	TimeoutMs int `yaml:"timeoutMs"`
+	// Abort is what happens to the keys of an aborted sequence, flush sends
+	// them to the remote and drop drops them, flush if unset.
+	Abort string `yaml:"abort"`
+}
+
+func (c sequencesConfig) validate() error {
+	switch c.Abort {
+	case "", SequenceAbortFlush, SequenceAbortDrop:
+	default:
+		return fmt.Errorf("unknown sequence abort %q, must be %v or %v", c.Abort, SequenceAbortFlush, SequenceAbortDrop)
+	}
+	if c.TimeoutMs < 0 {
+		return fmt.Errorf("sequence timeout can't be negative")
+	}
+	return nil
+}
+
+func (c sequencesConfig) timeout() time.Duration {
+	if c.TimeoutMs == 0 {
+		return defaultSequenceTimeoutMs * time.Millisecond
+	}
+	return time.Duration(c.TimeoutMs) * time.Millisecond
+}
+
+func isSequence(hotkey string) bool {
+	return strings.Contains(hotkey, sequenceSep)
+}
+
+// sequenceSteps returns the key combinations of the steps of the hotkey.
+func sequenceSteps(hotkey string) []string {
+	steps := strings.Split(hotkey, sequenceSep)
+	for n := range steps {
+		steps[n] = strings.TrimSpace(steps[n])
+	}
+	return steps
+}
+
+// validateHotkey validates a hotkey, a key combination or a sequence of them.
+func validateHotkey(hotkey string) error {
+	for _, step := range sequenceSteps(hotkey) {
+		if _, err := getConfigDefs(step, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sequence is a sequence hotkey and what it does.
+type sequence struct {
+	hotkey string
+	steps  []string
+	run    func()
+}
+
+// sequenceState is the sequence being typed.
+type sequenceState struct {
+	// candidates are the sequences the steps typed so far are the start of
+	candidates []sequence
+	// step is the step typed next
+	step int
+	last time.Time
+	// buffered are the events held back while the sequence is typed
+	buffered []EventDef
+	// timer aborts the sequence when the next step isn't typed in time
+	timer *time.Timer
+}
+
+func (s sequenceState) pending() bool {
+	return len(s.candidates) > 0
+}
+
+// SetSequences configures the sequence hotkeys from now on.
+func (i *inputHandler) SetSequences(c sequencesConfig) {
+	i.seqConf = c
+}
+
+// sequences returns the global sequence hotkeys, followed by the ones
+// of the remotes in the order of their names.
+func (i *inputHandler) sequences() []sequence {
+	var seqs []sequence
+	for _, h := range i.hotkeys {
+		if isSequence(h.Keys) {
+			h := h
+			seqs = append(seqs, sequence{h.Keys, sequenceSteps(h.Keys), func() {
+				if err := i.runAction(h); err != nil {
+					i.l.WithError(err).Warnf("%v action failed", h.Action)
+					i.notify(Status{Grabbed: true, Remote: i.ci.Name, Connected: i.r.IsConnected(), Err: err})
+				}
+			}})
+		}
+	}
+	var names []string
+	for name, ci := range i.c {
+		if isSequence(ci.Hotkey) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		name, ci := name, i.c[name]
+		seqs = append(seqs, sequence{ci.Hotkey, sequenceSteps(ci.Hotkey), func() { i.remoteHotkey(name, ci) }})
+	}
+	return seqs
+}
+
+// handleSequence handles the current key event when it's part of a sequence
+// hotkey, reporting whether it's held back from the remote. Inputs without
+// an event loop only notice the timeout on the next key event.
+func (i *inputHandler) handleSequence(now time.Time) bool {
+	if i.seq.pending() && now.Sub(i.seq.last) > i.seqConf.timeout() {
+		i.l.Debugf("sequence timed out after %v", i.seqConf.timeout())
+		i.abortSequence()
+	}
+	current := i.e.resolve()
+	if !i.e.current.IsPress {
+		if !i.seq.pending() {
+			return false
+		}
+		i.seq.buffered = append(i.seq.buffered, current...)
+		return true
+	}
+	candidates := i.seq.candidates
+	if !i.seq.pending() {
+		candidates = i.sequences()
+	}
+	var matched, partial []sequence
+	for _, s := range candidates {
+		step := s.steps[i.seq.step]
+		switch {
+		case i.hotkeyPressed(s.hotkey, step):
+			matched = append(matched, s)
+		// the modifiers of a step are pressed before its key
+		case i.seq.pending() && i.stepIncludes(step, current):
+			partial = append(partial, s)
+		}
+	}
+	if len(matched) == 0 && len(partial) == 0 {
+		if i.seq.pending() {
+			i.abortSequence()
+		}
+		return false
+	}
+	for _, s := range matched {
+		if i.seq.step == len(s.steps)-1 {
+			i.l.Infof("caught %q", s.hotkey)
+			i.resetSequence()
+			s.run()
+			return true
+		}
+	}
+	i.seq.buffered = append(i.seq.buffered, current...)
+	i.seq.last = now
+	i.armSequenceTimeout()
+	if len(matched) > 0 {
+		i.seq.candidates = matched
+		i.seq.step++
+	} else {
+		i.seq.candidates = partial
+	}
+	return true
+}
+
+// stepIncludes reports whether the events press a key of the step.
+func (i *inputHandler) stepIncludes(step string, events []EventDef) bool {
+	defs, err := getConfigDefs(step, true)
+	if err != nil {
+		return false
+	}
+	return len(edIntersection(defs, events)) > 0
+}
+
+// armSequenceTimeout aborts the sequence on the event loop of the input,
+// unless the next step is typed in time.
+func (i *inputHandler) armSequenceTimeout() {
+	p, ok := i.in.(eventPoster)
+	if !ok || i.afterFunc == nil {
+		return
+	}
+	if i.seq.timer != nil {
+		i.seq.timer.Stop()
+	}
+	var timer *time.Timer
+	timer = i.afterFunc(i.seqConf.timeout(), func() {
+		p.post(func() {
+			// the sequence went on meanwhile
+			if i.seq.timer != timer {
+				return
+			}
+			i.sequenceTimedOut()
+		})
+	})
+	i.seq.timer = timer
+}
+
+// sequenceTimedOut aborts the sequence, its next step wasn't typed in time.
+func (i *inputHandler) sequenceTimedOut() {
+	if i.idle || !i.seq.pending() {
+		return
+	}
+	i.t.input(TraceEvent{Time: i.now(), Type: traceTypeSequenceTimeout})
+	i.l.Debugf("sequence timed out after %v", i.seqConf.timeout())
+	i.abortSequence()
+	i.deactivateUnconnected()
+}
+
+// resetSequence forgets the sequence being typed.
+func (i *inputHandler) resetSequence() {
+	if i.seq.timer != nil {
+		i.seq.timer.Stop()
+	}
+	i.seq = sequenceState{}
+}
+
+// abortSequence flushes or drops the events held back by the sequence.
+func (i *inputHandler) abortSequence() {
+	buffered := i.seq.buffered
+	i.resetSequence()
+	if i.seqConf.Abort == SequenceAbortDrop {
+		i.l.Debugf("sequence aborted, dropping %v events", len(buffered))
+		return
+	}
+	i.l.Debugf("sequence aborted, flushing %v events", len(buffered))
+	i.sendDefs(buffered)
+}
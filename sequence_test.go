@@ -0,0 +1,203 @@
+package i2vnc
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func Test_sequencesConfig_validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		c       sequencesConfig
+		wantErr bool
+	}{
+		{"default", sequencesConfig{}, false},
+		{"drop", sequencesConfig{TimeoutMs: 500, Abort: SequenceAbortDrop}, false},
+		{"unknown abort", sequencesConfig{Abort: "keep"}, true},
+		{"negative timeout", sequencesConfig{TimeoutMs: -1}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.c.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_validateHotkey(t *testing.T) {
+	for hotkey, wantErr := range map[string]bool{
+		"F9":                  false,
+		"Scroll_Lock, 3":      false,
+		"Super_R,Control_L+m": false,
+		"Scroll_Lock, nope":   true,
+		"Scroll_Lock,":        true,
+	} {
+		if err := validateHotkey(hotkey); (err != nil) != wantErr {
+			t.Errorf("validateHotkey(%q) error = %v, wantErr %v", hotkey, err, wantErr)
+		}
+	}
+}
+
+func keyEvents(events []RemoteEvent) []RemoteEvent {
+	var keys []RemoteEvent
+	for _, re := range stripTime(events) {
+		if re.IsKey {
+			keys = append(keys, re)
+		}
+	}
+	return keys
+}
+
+func Test_pipeline_sequences(t *testing.T) {
+	tests := []struct {
+		name         string
+		c            sequencesConfig
+		steps        func(i *MockInput, clock *time.Time)
+		wantConnects []string
+		wantEvents   []RemoteEvent
+	}{
+		{
+			name: "switch",
+			steps: func(i *MockInput, clock *time.Time) {
+				press(i, "Scroll_Lock")
+				release(i, "Scroll_Lock")
+				press(i, "1")
+			},
+			wantConnects: []string{"win", "linux"},
+		},
+		{
+			name: "abort flushes",
+			steps: func(i *MockInput, clock *time.Time) {
+				press(i, "Scroll_Lock")
+				release(i, "Scroll_Lock")
+				press(i, "a")
+			},
+			wantConnects: []string{"win"},
+			wantEvents:   []RemoteEvent{keyEv("Scroll_Lock", true), keyEv("Scroll_Lock", false), keyEv("a", true)},
+		},
+		{
+			name: "abort drops",
+			c:    sequencesConfig{Abort: SequenceAbortDrop},
+			steps: func(i *MockInput, clock *time.Time) {
+				press(i, "Scroll_Lock")
+				release(i, "Scroll_Lock")
+				press(i, "a")
+			},
+			wantConnects: []string{"win"},
+			wantEvents:   []RemoteEvent{keyEv("a", true)},
+		},
+		{
+			name: "timeout",
+			c:    sequencesConfig{TimeoutMs: 500},
+			steps: func(i *MockInput, clock *time.Time) {
+				press(i, "Scroll_Lock")
+				release(i, "Scroll_Lock")
+				*clock = clock.Add(time.Second)
+				press(i, "2")
+			},
+			wantConnects: []string{"win"},
+			wantEvents:   []RemoteEvent{keyEv("Scroll_Lock", true), keyEv("Scroll_Lock", false), keyEv("2", true)},
+		},
+		{
+			name: "combination step",
+			steps: func(i *MockInput, clock *time.Time) {
+				press(i, "Super_R")
+				release(i, "Super_R")
+				press(i, "Control_L", "d")
+			},
+			wantConnects: []string{"win"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			i, r := newTestPipeline(Config{
+				"linux": {Hotkey: "Scroll_Lock, 1"},
+				"mac":   {Hotkey: "Scroll_Lock, 2"},
+				"win":   {Hotkey: "F10"},
+			}, false)
+			i.SetHotkeys([]hotkeyConfig{{Keys: "Super_R, Control_L+d", Action: ActionDisconnect}})
+			i.SetSequences(tt.c)
+			clock := time.Now()
+			i.now = func() time.Time { return clock }
+			press(i, "F10")
+			release(i, "F10")
+			r.Reset()
+			tt.steps(i, &clock)
+			if got := r.Connects(); !reflect.DeepEqual(got, tt.wantConnects) {
+				t.Errorf("connects = %v, want %v", got, tt.wantConnects)
+			}
+			if got := keyEvents(r.Events()); !reflect.DeepEqual(got, tt.wantEvents) {
+				t.Errorf("events = %v, want %v", got, tt.wantEvents)
+			}
+		})
+	}
+}
+
+func Test_pipeline_sequenceTimer(t *testing.T) {
+	tests := []struct {
+		name       string
+		c          sequencesConfig
+		wantEvents []RemoteEvent
+	}{
+		{"flush", sequencesConfig{TimeoutMs: 10}, []RemoteEvent{keyEv("Scroll_Lock", true), keyEv("Scroll_Lock", false)}},
+		{"drop", sequencesConfig{TimeoutMs: 10, Abort: SequenceAbortDrop}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			i, r := newTestPipeline(Config{"linux": {Hotkey: "Scroll_Lock, 1"}, "win": {Hotkey: "F10"}}, false)
+			i.SetSequences(tt.c)
+			press(i, "F10")
+			release(i, "F10")
+			r.Reset()
+			// the sequence times out without another key event
+			press(i, "Scroll_Lock")
+			release(i, "Scroll_Lock")
+			time.Sleep(100 * time.Millisecond)
+			if got := keyEvents(r.Events()); !reflect.DeepEqual(got, tt.wantEvents) {
+				t.Errorf("events = %v, want %v", got, tt.wantEvents)
+			}
+			press(i, "1")
+			if got := r.Connects(); !reflect.DeepEqual(got, []string{"win"}) {
+				t.Errorf("connects = %v, want [win]", got)
+			}
+		})
+	}
+}
+
+func TestReplay_sequenceTimeout(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.PanicLevel)
+	config := Config{"linux": {Name: "linux", Hotkey: "Scroll_Lock, 1"}, "win": {Name: "win", Hotkey: "F10"}}
+	var trace bytes.Buffer
+	tracer := NewTracer(logger, &trace)
+	mock := NewMockRemote(logrus.NewEntry(logger), testRemoteScreen)
+	i := NewMockInput(logger, NewTraceRemote(mock, tracer), config, testLocalScreen, false)
+	i.SetSequences(sequencesConfig{TimeoutMs: 10})
+	i.SetTracer(tracer)
+	i.Grab()
+
+	press(i, "F10")
+	release(i, "F10")
+	press(i, "Scroll_Lock")
+	release(i, "Scroll_Lock")
+	time.Sleep(100 * time.Millisecond)
+	// the keys are flushed before the motion, without a key event
+	i.Motion(5, 5)
+
+	result, err := Replay(logger, bytes.NewReader(trace.Bytes()), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := result.Diff(); len(diff) != 0 {
+		t.Errorf("Replay() differs from the trace:\n%v", strings.Join(diff, "\n"))
+	}
+	if !strings.Contains(trace.String(), `"type":"sequenceTimeout"`) {
+		t.Error("the sequence timeout isn't traced")
+	}
+}
@@ -0,0 +1,38 @@
+package i2vnc
+
+import "fmt"
+
+// Status is the state of the input pipeline shown by the indicators.
+type Status struct {
+	Grabbed   bool
+	Remote    string
+	Connected bool
+	// Connecting is set while waking the remote up to connect to it.
+	Connecting bool
+	// Switched is set right after switching to the remote.
+	Switched bool
+	// Err is set when switching to the remote failed.
+	Err error
+	// Released is set while the grab is released until the release
+	// hotkey is pressed again, the remote stays connected.
+	Released bool
+}
+
+func (s Status) String() string {
+	switch {
+	case s.Err != nil:
+		return fmt.Sprintf("%v: %v", s.Remote, s.Err)
+	case s.Connecting:
+		return fmt.Sprintf("i2vnc: waking %v", s.Remote)
+	case s.Released:
+		return fmt.Sprintf("i2vnc: %v (released)", s.Remote)
+	case s.Connected:
+		return fmt.Sprintf("i2vnc: %v", s.Remote)
+	}
+	return "i2vnc: not connected"
+}
+
+// Indicator shows the pipeline status to the user.
+type Indicator interface {
+	Show(s Status)
+}
@@ -0,0 +1,358 @@
+package i2vnc
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	traceSourceInput  = "input"
+	traceSourceRemote = "remote"
+	traceSourceHook   = "hook"
+	traceSourceConfig = "config"
+
+	traceTypeStart       = "start"
+	traceTypeKey         = "key"
+	traceTypePointer     = "pointer"
+	traceTypeScroll      = "scroll"
+	traceTypeClick       = "click"
+	traceTypePointerPos  = "pointerPos"
+	traceTypeResize      = "resize"
+	traceTypeLocalResize = "localResize"
+	traceTypeConnect     = "connect"
+	traceTypeDisconnect  = "disconnect"
+	traceTypeReload      = "reload"
+	traceTypeLocks       = "locks"
+	// traceTypeSequenceTimeout is a sequence timing out before its next step
+	traceTypeSequenceTimeout = "sequenceTimeout"
+)
+
+// TraceEvent is a single line of a trace. Input events are the events fed
+// into the input pipeline, remote events the resolved events sent to the remote,
+// hook events whether the hooks of a connection lifecycle event aborted the switch,
+// config events the config loaded by the reload action.
+// The trace starts with an input event of type start, holding what the
+// pipeline needs to replay the trace.
+type TraceEvent struct {
+	Time   time.Time `json:"time"`
+	Source string    `json:"source"`
+	Type   string    `json:"type"`
+	// start and localResize
+	Local *Screen `json:"local,omitempty"`
+	// start and reload
+	Config    Config           `json:"config,omitempty"`
+	Hotkeys   []hotkeyConfig   `json:"hotkeys,omitempty"`
+	Panic     *panicConfig     `json:"panic,omitempty"`
+	Sequences *sequencesConfig `json:"sequences,omitempty"`
+	// start
+	Forever bool `json:"forever,omitempty"`
+	// key and pointer events
+	Name    string `json:"name,omitempty"`
+	State   uint16 `json:"state,omitempty"`
+	Keycode uint8  `json:"keycode,omitempty"`
+	Key     uint32 `json:"key,omitempty"`
+	Button  uint8  `json:"button,omitempty"`
+	X       int32  `json:"x,omitempty"`
+	Y       int32  `json:"y,omitempty"`
+	IsPress bool   `json:"isPress,omitempty"`
+	// scroll
+	DX float64 `json:"dx,omitempty"`
+	DY float64 `json:"dy,omitempty"`
+	// connect and resize
+	Screen   *Screen   `json:"screen,omitempty"`
+	Monitors []Monitor `json:"monitors,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	// locks, the local lock states and the ones reported by the remote
+	Locks       *Locks `json:"locks,omitempty"`
+	RemoteLocks *Locks `json:"remoteLocks,omitempty"`
+}
+
+// Tracer writes trace events as JSON lines. A nil Tracer writes nothing.
+type Tracer struct {
+	l   *logrus.Entry
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func NewTracer(logger *logrus.Logger, w io.Writer) *Tracer {
+	return &Tracer{l: logrus.NewEntry(logger), enc: json.NewEncoder(w)}
+}
+
+func (t *Tracer) write(e TraceEvent) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	if err := t.enc.Encode(e); err != nil {
+		t.l.WithError(err).Warn("failed writing trace event")
+	}
+}
+
+// start writes the trace header, passwords are left out of the config.
+func (t *Tracer) start(e TraceEvent) {
+	e.Source, e.Type = traceSourceInput, traceTypeStart
+	e.Config = stripPasswords(e.Config)
+	t.write(e)
+}
+
+// stripPasswords returns a copy of the config without the passwords.
+func stripPasswords(c Config) Config {
+	config := Config{}
+	for name, ci := range c {
+		ci.Pw = ""
+		config[name] = ci
+	}
+	return config
+}
+
+func (t *Tracer) input(e TraceEvent) {
+	e.Source = traceSourceInput
+	t.write(e)
+}
+
+// TraceRemote is a Remote that traces the events sent to the Remote it wraps.
+type TraceRemote struct {
+	Remote
+	t *Tracer
+}
+
+func NewTraceRemote(r Remote, t *Tracer) *TraceRemote {
+	return &TraceRemote{r, t}
+}
+
+func (r *TraceRemote) Connect(cname string, timeout time.Duration) error {
+	err := r.Remote.Connect(cname, timeout)
+	e := TraceEvent{Source: traceSourceRemote, Type: traceTypeConnect, Name: cname}
+	if err != nil {
+		e.Error = err.Error()
+	} else {
+		screen := r.Remote.Screen()
+		e.Screen = &screen
+		e.Monitors = r.Remote.Monitors()
+	}
+	r.t.write(e)
+	return err
+}
+
+// SetConfig passes the config on to the wrapped remote.
+func (r *TraceRemote) SetConfig(c Config) {
+	if cs, ok := r.Remote.(configSetter); ok {
+		cs.SetConfig(c)
+	}
+}
+
+func (r *TraceRemote) Disconnect() error {
+	connected := r.Remote.IsConnected()
+	err := r.Remote.Disconnect()
+	if connected && err == nil {
+		r.t.write(TraceEvent{Source: traceSourceRemote, Type: traceTypeDisconnect})
+	}
+	return err
+}
+
+func (r *TraceRemote) SendKeyEvent(name string, key uint32, isPress bool) error {
+	err := r.Remote.SendKeyEvent(name, key, isPress)
+	if err == nil {
+		r.t.write(TraceEvent{Source: traceSourceRemote, Type: traceTypeKey, Name: name, Key: key, IsPress: isPress})
+	}
+	return err
+}
+
+func (r *TraceRemote) SendPointerEvent(name string, button uint8, x, y uint16, isPress bool) error {
+	err := r.Remote.SendPointerEvent(name, button, x, y, isPress)
+	if err == nil {
+		r.t.write(TraceEvent{Source: traceSourceRemote, Type: traceTypePointer, Name: name, Button: button,
+			X: int32(x), Y: int32(y), IsPress: isPress})
+	}
+	return err
+}
+
+// ReplayResult holds the remote events of a trace and the ones of its replay.
+type ReplayResult struct {
+	Want []RemoteEvent
+	Got  []RemoteEvent
+}
+
+// Diff returns a line for every remote event that differs between
+// the trace and the replay, it is empty if the replay matches the trace.
+func (r ReplayResult) Diff() []string {
+	var diff []string
+	for n := 0; n < len(r.Want) || n < len(r.Got); n++ {
+		switch {
+		case n >= len(r.Got):
+			diff = append(diff, fmt.Sprintf("%v: - %v", n, r.Want[n]))
+		case n >= len(r.Want):
+			diff = append(diff, fmt.Sprintf("%v: + %v", n, r.Got[n]))
+		case r.Want[n] != r.Got[n]:
+			diff = append(diff, fmt.Sprintf("%v: - %v", n, r.Want[n]), fmt.Sprintf("%v: + %v", n, r.Got[n]))
+		}
+	}
+	return diff
+}
+
+// Replay feeds the input events of the trace through the input pipeline
+// into a MockRemote. Connects to remotes succeed or fail as they did in the trace.
+// The config of the trace is used if c is nil.
+func Replay(logger *logrus.Logger, r io.Reader, c Config) (ReplayResult, error) {
+	var result ReplayResult
+	var start TraceEvent
+	dec := json.NewDecoder(r)
+	if err := dec.Decode(&start); err != nil {
+		return result, fmt.Errorf("unable to decode trace: %s", err)
+	}
+	if start.Type != traceTypeStart || start.Local == nil {
+		return result, fmt.Errorf("trace doesn't start with a %v event", traceTypeStart)
+	}
+	if c == nil {
+		c = start.Config
+	}
+	var inputs, connects, hooks, reloads []TraceEvent
+	for {
+		var e TraceEvent
+		err := dec.Decode(&e)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return result, fmt.Errorf("unable to decode trace: %s", err)
+		}
+		switch {
+		case e.Source == traceSourceInput:
+			inputs = append(inputs, e)
+		case e.Source == traceSourceHook:
+			hooks = append(hooks, e)
+		case e.Source == traceSourceConfig:
+			reloads = append(reloads, e)
+		case e.Type == traceTypeConnect:
+			connects = append(connects, e)
+		case e.Type == traceTypeKey:
+			result.Want = append(result.Want, RemoteEvent{Name: e.Name, Key: e.Key, IsKey: true, IsPress: e.IsPress})
+		case e.Type == traceTypePointer:
+			result.Want = append(result.Want, RemoteEvent{Name: e.Name, Button: e.Button,
+				X: uint16(e.X), Y: uint16(e.Y), IsPress: e.IsPress})
+		}
+	}
+
+	mock := NewMockRemote(logrus.NewEntry(logger), Screen{})
+	in := NewMockInput(logger, &replayRemote{mock, connects}, c, *start.Local, start.Forever)
+	// the hooks abort the switches they aborted, without running,
+	// also after the reloads
+	in.hooks = func(event string, ci configItem, err error) error {
+		if len(hooks) == 0 {
+			return nil
+		}
+		e := hooks[0]
+		hooks = hooks[1:]
+		if e.Error != "" {
+			return errors.New(e.Error)
+		}
+		return nil
+	}
+	in.SetHotkeys(start.Hotkeys)
+	if start.Panic != nil {
+		if err := in.SetPanic(*start.Panic); err != nil {
+			return result, fmt.Errorf("invalid panic sequence in trace: %s", err)
+		}
+	}
+	if start.Sequences != nil {
+		in.SetSequences(*start.Sequences)
+	}
+	// the key sequences are timed by the times of the trace,
+	// and time out when they did
+	var now time.Time
+	in.now = func() time.Time { return now }
+	in.afterFunc = nil
+	// the reloads load the config they loaded, and no commands run
+	in.SetConfigLoader(func() (Config, Settings, error) {
+		if len(reloads) == 0 {
+			return nil, Settings{}, fmt.Errorf("no %v event in trace", traceTypeReload)
+		}
+		e := reloads[0]
+		reloads = reloads[1:]
+		if e.Error != "" {
+			return nil, Settings{}, errors.New(e.Error)
+		}
+		s := Settings{Hotkeys: e.Hotkeys}
+		if e.Panic != nil {
+			s.Panic = *e.Panic
+		}
+		if e.Sequences != nil {
+			s.Sequences = *e.Sequences
+		}
+		return e.Config, s, nil
+	})
+	in.startCommand = func(command string, env []string) error { return nil }
+	in.Grab()
+	for _, e := range inputs {
+		now = e.Time
+		switch e.Type {
+		case traceTypeKey:
+			in.handleKeysym(e.State, e.Keycode, e.Key, e.IsPress)
+		case traceTypePointer:
+			in.handlePointerEvent(e.State, e.Button, int16(e.X), int16(e.Y), e.IsPress)
+		case traceTypeScroll:
+			in.handleScroll(e.DX, e.DY)
+		case traceTypeClick:
+			in.handleClick(e.Button)
+		case traceTypePointerPos:
+			in.remotePointerMoved(Screen{uint16(e.X), uint16(e.Y)})
+		case traceTypeResize:
+			if e.Screen == nil {
+				return result, fmt.Errorf("%v event without a screen in trace", traceTypeResize)
+			}
+			mock.SetScreen(*e.Screen)
+			mock.SetMonitors(e.Monitors)
+			in.remoteResized(*e.Screen, e.Monitors)
+		case traceTypeLocalResize:
+			if e.Local == nil {
+				return result, fmt.Errorf("%v event without a screen in trace", traceTypeLocalResize)
+			}
+			in.SetScreen(*e.Local)
+		case traceTypeLocks:
+			if e.Locks == nil {
+				return result, fmt.Errorf("%v event without the local locks in trace", traceTypeLocks)
+			}
+			in.syncLocks(*e.Locks, e.RemoteLocks)
+		case traceTypeSequenceTimeout:
+			in.sequenceTimedOut()
+		default:
+			return result, fmt.Errorf("unknown input event type %q in trace", e.Type)
+		}
+	}
+	for _, re := range mock.Events() {
+		re.Time = time.Time{}
+		result.Got = append(result.Got, re)
+	}
+	return result, nil
+}
+
+// replayRemote is a MockRemote that connects as the traced remote did.
+type replayRemote struct {
+	*MockRemote
+	connects []TraceEvent
+}
+
+func (r *replayRemote) Connect(cname string, timeout time.Duration) error {
+	if len(r.connects) > 0 {
+		e := r.connects[0]
+		r.connects = r.connects[1:]
+		r.SetConnectError(nil)
+		if e.Error != "" {
+			r.SetConnectError(errors.New(e.Error))
+		} else if e.Screen != nil {
+			r.SetScreen(*e.Screen)
+			r.SetMonitors(e.Monitors)
+		}
+	}
+	return r.MockRemote.Connect(cname, timeout)
+}
@@ -0,0 +1,131 @@
+package i2vnc
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestReplay(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.PanicLevel)
+	config := func() Config {
+		return Config{
+			"mac": {Name: "mac", Hotkey: "F9", Pw: "secret", ScrollSpeed: 3,
+				Keymap:  map[string]string{"Alt_L": "Meta_L"},
+				Pointer: pointerConfig{MonitorHotkeys: []string{"F2"}}},
+			"linux": {Name: "linux", Hotkey: "F10"},
+		}
+	}
+	var trace bytes.Buffer
+	tracer := NewTracer(logger, &trace)
+	mock := NewMockRemote(logrus.NewEntry(logger), testRemoteScreen)
+	i := NewMockInput(logger, NewTraceRemote(mock, tracer), config(), testLocalScreen, false)
+	i.SetTracer(tracer)
+	i.Grab()
+
+	mock.SetConnectError(errors.New("refused"))
+	press(i, "F10")
+	release(i, "F10")
+	mock.SetConnectError(nil)
+	press(i, "F9")
+	release(i, "F9")
+	press(i, "Alt_L", "a")
+	release(i, "a", "Alt_L")
+	i.Motion(10, -5)
+	mock.SetPointerPos(Screen{300, 400})
+	i.Motion(5, 5)
+	mock.SetScreen(Screen{1000, 500})
+	i.Motion(5, 5)
+	mock.SetMonitors([]Monitor{{0, 0, 600, 500}, {600, 0, 400, 300}})
+	press(i, "F2")
+	release(i, "F2")
+	i.Motion(0, 400)
+	i.ButtonEvent("Button_Left", true)
+	i.ButtonEvent("Button_Left", false)
+	i.Scroll(0, 1.5)
+	i.handleClick(6)
+	i.SetScreen(Screen{500, 400})
+	i.Motion(30, 30)
+	mock.SetScreen(Screen{800, 600})
+	press(i, "F10")
+	release(i, "F10")
+	i.Motion(-20, 0)
+
+	if strings.Contains(trace.String(), "secret") {
+		t.Error("trace contains the password")
+	}
+	want := stripTime(mock.Events())
+	result, err := Replay(logger, bytes.NewReader(trace.Bytes()), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(result.Want, want) {
+		t.Errorf("Replay() traced events = %v, want %v", result.Want, want)
+	}
+	if diff := result.Diff(); len(diff) != 0 {
+		t.Errorf("Replay() differs from the trace:\n%v", strings.Join(diff, "\n"))
+	}
+
+	// replaying with another keymap changes the resolved events
+	c := config()
+	mac := c["mac"]
+	mac.Keymap = nil
+	c["mac"] = mac
+	result, err = Replay(logger, bytes.NewReader(trace.Bytes()), c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantDiff := []string{
+		"2: - key Meta_L 0xffe7 isPress:true",
+		"2: + key Alt_L 0xffe9 isPress:true",
+		"5: - key Meta_L 0xffe7 isPress:false",
+		"5: + key Alt_L 0xffe9 isPress:false",
+	}
+	if diff := result.Diff(); !reflect.DeepEqual(diff, wantDiff) {
+		t.Errorf("Replay() diff = %q, want %q", diff, wantDiff)
+	}
+
+	if _, err := Replay(logger, strings.NewReader(`{"source":"input","type":"key"}`), nil); err == nil {
+		t.Error("Replay() of a trace without a start event succeeded")
+	}
+}
+
+func TestReplay_hooks(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.PanicLevel)
+	config := Config{
+		"mac":   {Name: "mac", Hotkey: "F9"},
+		"linux": {Name: "linux", Hotkey: "F10", Hooks: hooksConfig{PreConnect: []hookConfig{{Command: "exit 1", Abort: true}}}},
+	}
+	var trace bytes.Buffer
+	tracer := NewTracer(logger, &trace)
+	mock := NewMockRemote(logrus.NewEntry(logger), testRemoteScreen)
+	i := NewMockInput(logger, NewTraceRemote(mock, tracer), config, testLocalScreen, false)
+	i.SetTracer(tracer)
+	i.SetHooks(hooksConfig{})
+	i.Grab()
+
+	press(i, "F9")
+	release(i, "F9")
+	// aborted, the keys keep going to mac
+	press(i, "F10")
+	release(i, "F10")
+	press(i, "a")
+	release(i, "a")
+
+	result, err := Replay(logger, bytes.NewReader(trace.Bytes()), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := result.Diff(); len(diff) != 0 {
+		t.Errorf("Replay() differs from the trace:\n%v", strings.Join(diff, "\n"))
+	}
+	if len(result.Got) != len(stripTime(mock.Events())) {
+		t.Errorf("Replay() got %v events, want %v", len(result.Got), len(mock.Events()))
+	}
+}
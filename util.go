@@ -1,10 +1,12 @@
 package i2vnc
 
 import (
+	"bytes"
 	"fmt"
 	"os"
 	"os/user"
 	"path/filepath"
+	"reflect"
 	"sort"
 	"strings"
 	"time"
@@ -18,17 +20,7 @@ import (
 type WindowSystem uint8
 
 const (
-	X11WindowSystem         = iota
-	LoggerFieldRemote       = "remote"
-	LoggerFieldInput        = "input"
-	LoggerFieldSource       = "source"
-	LoggerFieldEvent        = "event"
-	LoggerFieldEventKey     = "key"
-	LoggerFieldEventButton  = "button"
-	LoggerFieldName         = "name"
-	LoggerFieldEventIsPress = "isPress"
-	LoggerFieldEventCoords  = "coords"
-	LoggerFieldEventX11     = "x11"
+	X11WindowSystem = iota
 )
 
 type Input interface {
@@ -44,6 +36,18 @@ type Remote interface {
 	Screen() Screen
 	SendKeyEvent(name string, key uint32, isPress bool) error
 	SendPointerEvent(name string, button uint8, x, y uint16, isPress bool) error
+	// PointerPos returns the remote pointer position,
+	// if the remote moved it since the last call.
+	PointerPos() (Screen, bool)
+	// Monitors returns the monitor layout of the remote screen,
+	// nil if the remote doesn't report it.
+	Monitors() []Monitor
+	// Locks returns the lock states of the remote,
+	// false if the remote doesn't report them.
+	Locks() (Locks, bool)
+	// Updated reports whether the remote sent its first update since
+	// connecting, what it reports isn't known before.
+	Updated() bool
 }
 
 type Config map[string]configItem
@@ -56,6 +60,16 @@ func (c Config) getItem(name string) (configItem, error) {
 	return item, nil
 }
 
+// names returns the names of the remotes, sorted.
+func (c Config) names() []string {
+	var names []string
+	for name := range c {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
 type configMap struct {
 	from []string
 	to   []string
@@ -69,8 +83,17 @@ type configItem struct {
 	Hotkey      string
 	Keymap      map[string]string
 	ScrollSpeed uint8         `yaml:"scrollSpeed"`
-	settle      time.Duration `yaml:"settleMs"`
-	timeout     time.Duration `yaml:"timeoutSec"`
+	Scroll      scrollConfig  `yaml:"scroll"`
+	Pointer     pointerConfig `yaml:"pointer"`
+	// Monitors is the monitor layout of the remote screen,
+	// overriding the one reported by the remote.
+	Monitors []Monitor   `yaml:"monitors"`
+	Wol      wolConfig   `yaml:"wol"`
+	Hooks    hooksConfig `yaml:"hooks"`
+	Locks    lockConfig  `yaml:"locks"`
+	SettleMs int         `yaml:"settleMs"`
+	// TimeoutSec bounds connecting to the remote, the system default if unset.
+	TimeoutSec int `yaml:"timeoutSec"`
 }
 
 func (c *configItem) SetPw(value string) {
@@ -79,12 +102,12 @@ func (c *configItem) SetPw(value string) {
 	}
 }
 
-func (c configItem) SettleMs() time.Duration {
-	return c.settle * time.Millisecond
+func (c configItem) settle() time.Duration {
+	return time.Duration(c.SettleMs) * time.Millisecond
 }
 
-func (c configItem) TimeoutSec() time.Duration {
-	return c.timeout * time.Second
+func (c configItem) timeout() time.Duration {
+	return time.Duration(c.TimeoutSec) * time.Second
 }
 
 func (c configItem) getConfigMaps() []configMap {
@@ -95,11 +118,49 @@ func (c configItem) getConfigMaps() []configMap {
 	return cms
 }
 
+func (c configItem) newEvent() *event {
+	e := newEvent(c.getConfigMaps(), c.ScrollSpeed)
+	e.scroll = c.Scroll
+	if e.scroll.Vertical == 0 {
+		e.scroll.Vertical = c.ScrollSpeed
+	}
+	e.pointer = newPointerAccel(c.Pointer)
+	e.absolute = c.Pointer.Mode == PointerModeAbsolute
+	e.letterbox = c.Pointer.Letterbox
+	return e
+}
+
 func (c configItem) validate() error {
-	_, err := getConfigDefs(c.Hotkey, false)
-	if err != nil {
+	var err error
+	// a remote without a hotkey is switched to with the next and previous actions
+	if c.Hotkey != "" {
+		if err := validateHotkey(c.Hotkey); err != nil {
+			return err
+		}
+	}
+	if err := c.Pointer.validate(); err != nil {
+		return err
+	}
+	if c.Pointer.ModeHotkey != "" && c.Pointer.ModeHotkey == c.Hotkey {
+		return fmt.Errorf("pointer mode hotkey can't be the same as the hotkey")
+	}
+	if c.Hotkey != "" && StringInSlice(c.Hotkey, c.Pointer.MonitorHotkeys) {
+		return fmt.Errorf("pointer monitor hotkeys can't be the same as the hotkey")
+	}
+	if err := c.Hooks.validate(); err != nil {
+		return err
+	}
+	if err := c.Wol.validate(); err != nil {
+		return err
+	}
+	if err := c.Locks.validate(); err != nil {
 		return err
 	}
+	for _, m := range c.Monitors {
+		if err := m.validate(); err != nil {
+			return err
+		}
+	}
 	for from, to := range c.Keymap {
 		_, err = getConfigDefs(from, false)
 		if err != nil {
@@ -132,34 +193,113 @@ func getConfigDefs(value string, isPress bool) ([]EventDef, error) {
 	return defs, nil
 }
 
-func LoadConfig(path string) (Config, error) {
+// Settings are the reserved top-level config sections,
+// every other top-level key is a remote.
+type Settings struct {
+	Metrics       metricsConfig       `yaml:"metrics"`
+	Logging       loggingConfig       `yaml:"logging"`
+	Overlay       overlayConfig       `yaml:"overlay"`
+	Notifications notificationsConfig `yaml:"notifications"`
+	Hooks         hooksConfig         `yaml:"hooks"`
+	Hotkeys       []hotkeyConfig      `yaml:"hotkeys"`
+	Panic         panicConfig         `yaml:"panic"`
+	Sequences     sequencesConfig     `yaml:"sequences"`
+	Grab          grabConfig          `yaml:"grab"`
+}
+
+// settingsKeys are the top-level keys of the settings, the yaml tags of Settings.
+var settingsKeys = func() []string {
+	var keys []string
+	t := reflect.TypeOf(Settings{})
+	for n := 0; n < t.NumField(); n++ {
+		keys = append(keys, strings.Split(t.Field(n).Tag.Get("yaml"), ",")[0])
+	}
+	return keys
+}()
+
+// decodeSettings decodes the settings from the top-level config keys. They're
+// decoded strictly, so a remote named like a setting fails instead of being dropped.
+func decodeSettings(items map[string]yaml.Node) (Settings, error) {
+	var settings Settings
+	v := reflect.ValueOf(&settings).Elem()
+	for n, key := range settingsKeys {
+		node, ok := items[key]
+		if !ok {
+			continue
+		}
+		data, err := yaml.Marshal(&node)
+		if err != nil {
+			return settings, err
+		}
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		if err := dec.Decode(v.Field(n).Addr().Interface()); err != nil {
+			return settings, fmt.Errorf("invalid %v settings, remotes can't be named %q: %s", key, key, err)
+		}
+	}
+	return settings, nil
+}
+
+func LoadConfig(path string) (Config, Settings, error) {
+	var settings Settings
 	if strings.HasPrefix(path, "~") {
 		usr, err := user.Current()
 		if err != nil {
-			return nil, err
+			return nil, settings, err
 		}
 		dir := usr.HomeDir
 		path = filepath.Join(dir, path[1:])
 	}
 	path, err := filepath.Abs(path)
 	if err != nil {
-		return nil, err
+		return nil, settings, err
 	}
 	file, err := os.Open(path)
 	if err != nil {
-		return nil, err
+		return nil, settings, err
 	}
 	defer file.Close()
 
-	var config Config
-	if err := yaml.NewDecoder(file).Decode(&config); err != nil {
-		return nil, fmt.Errorf("unable to decode config: %s", err)
+	var items map[string]yaml.Node
+	if err := yaml.NewDecoder(file).Decode(&items); err != nil {
+		return nil, settings, fmt.Errorf("unable to decode config: %s", err)
+	}
+	if settings, err = decodeSettings(items); err != nil {
+		return nil, settings, err
+	}
+	if err := settings.Hooks.validate(); err != nil {
+		return nil, settings, fmt.Errorf("invalid hooks: %s", err)
+	}
+	if err := settings.Panic.validate(); err != nil {
+		return nil, settings, fmt.Errorf("invalid panic sequence: %s", err)
+	}
+	if err := settings.Sequences.validate(); err != nil {
+		return nil, settings, fmt.Errorf("invalid sequences: %s", err)
 	}
-	for name, c := range config {
+	for _, h := range settings.Hotkeys {
+		if err := h.validate(); err != nil {
+			return nil, settings, fmt.Errorf("invalid hotkey %q: %s", h.Keys, err)
+		}
+	}
+	config := Config{}
+	for name, node := range items {
+		if StringInSlice(name, settingsKeys) {
+			continue
+		}
+		var c configItem
+		if err := node.Decode(&c); err != nil {
+			return nil, settings, fmt.Errorf("unable to decode config %q: %s", name, err)
+		}
 		c.Name = name
+		if err := c.validate(); err != nil {
+			return nil, settings, fmt.Errorf("invalid config %q: %s", name, err)
+		}
 		config[name] = c
 	}
-	return config, nil
+	if err := settings.Panic.validateHotkeys(config, settings.Hotkeys); err != nil {
+		return nil, settings, fmt.Errorf("invalid panic sequence: %s", err)
+	}
+	return config, settings, nil
 }
 
 var modNames = []string{
@@ -189,19 +329,26 @@ type EventDef struct {
 }
 
 type event struct {
-	current     EventDef
-	remote      Screen
-	local       Screen
-	scrollSpeed uint8
-	configMaps  []configMap
+	current    EventDef
+	remote     Screen
+	local      Screen
+	scroll     scrollConfig
+	smooth     smoothScroll
+	configMaps []configMap
+	pointer    *pointerAccel
+	absolute   bool
+	letterbox  string
+	// monitors keep the remote pointer off the gaps between them
+	monitors []Monitor
 }
 
 func newEvent(cms []configMap, scrollSpeed uint8) *event {
 	return &event{
-		remote:      Screen{},
-		local:       Screen{},
-		scrollSpeed: scrollSpeed,
-		configMaps:  cms,
+		remote:     Screen{},
+		local:      Screen{},
+		scroll:     scrollConfig{Vertical: scrollSpeed},
+		configMaps: cms,
+		pointer:    newPointerAccel(pointerConfig{}),
 	}
 }
 
@@ -210,8 +357,8 @@ func (e *event) handle(def EventDef) {
 }
 
 func (e *event) resolve() []EventDef {
-	if e.current.Button == x11.Buttons["Button_Up"] || e.current.Button == x11.Buttons["Button_Down"] {
-		return resolveScrollButton(e.current, e.scrollSpeed)
+	if !e.current.IsKey && isScrollButton(e.current.Button) {
+		return e.scroll.resolve(e.current)
 	}
 	resolved := resolveDef(e.current, e.configMaps)
 	return edSliceSortByPress(resolved, e.current.IsPress)
@@ -236,25 +383,39 @@ func (e event) getButtonForMotion() uint8 {
 	return e.current.Button
 }
 
+func (e *event) toggleAbsolute() bool {
+	e.absolute = !e.absolute
+	return e.absolute
+}
+
 func (e *event) setCoords(x, y uint16, local, remote Screen) {
 	e.local.X = x
 	e.local.Y = y
-	e.remote.X = screenOffset(e.remote.X, x, local.X, remote.X)
-	e.remote.Y = screenOffset(e.remote.Y, y, local.Y, remote.Y)
+	if e.absolute {
+		e.remote = absoluteCoords(x, y, local, remote, e.letterbox)
+		e.remote = monitorCoords(e.remote, int(e.remote.X), int(e.remote.Y), e.monitors)
+		return
+	}
+	// in relative mode the local pointer is kept in the local screen center,
+	// so the offset from it is the pointer delta
+	dx, dy := e.pointer.move(int(x)-int(local.X/2), int(y)-int(local.Y/2))
+	if len(e.monitors) > 0 {
+		e.remote = monitorCoords(e.remote, int(e.remote.X)+dx, int(e.remote.Y)+dy, e.monitors)
+		return
+	}
+	e.remote.X = screenOffset(e.remote.X, dx, remote.X)
+	e.remote.Y = screenOffset(e.remote.Y, dy, remote.Y)
 }
 
-func screenOffset(value, offset, localMax, remoteMax uint16) uint16 {
-	value += offset - localMax/2
-	if value < 1 || value > 65535/2 {
-		// when going under 0, the value starts going down from max uint16
-		// if it is in the upper half of max uint16, reset to 0
-		value = 0
+func screenOffset(value uint16, delta int, remoteMax uint16) uint16 {
+	moved := int(value) + delta
+	if moved < 0 {
+		return 0
 	}
-	if value >= remoteMax && value <= 65535/2 {
-		// if it is in the lower half of max uint16, reset to max
-		value = remoteMax
+	if moved > int(remoteMax) {
+		return remoteMax
 	}
-	return value
+	return uint16(moved)
 }
 
 func edSliceSortByPress(s []EventDef, isPress bool) []EventDef {
@@ -319,26 +480,29 @@ func newEventDefByName(name string, isPress bool) (*EventDef, error) {
 }
 
 func DebugEvent(l *logrus.Entry, source string, isKey bool, name string, x, y uint16, isPress bool) {
-	event := LoggerFieldEventButton
+	event := LoggerEventButton
 	if isKey {
-		event = LoggerFieldEventKey
+		event = LoggerEventKey
 	}
 	l = l.WithFields(logrus.Fields{
-		LoggerFieldEventCoords:  fmt.Sprintf("%v %v", x, y),
-		LoggerFieldEventIsPress: isPress,
-		LoggerFieldName:         name,
-		LoggerFieldEvent:        event,
+		LoggerFieldSource:  source,
+		LoggerFieldEvent:   event,
+		LoggerFieldName:    name,
+		LoggerFieldIsPress: isPress,
+		LoggerFieldCoords:  fmt.Sprintf("%v %v", x, y),
 	})
-	l.Debug(source)
+	l.Debug("event")
 }
 
 func DebugX11Event(l *logrus.Entry, source string, state uint16, keycode xproto.Keycode, button uint8, x, y int16, isPress bool) {
 	l = l.WithFields(logrus.Fields{
-		LoggerFieldEventCoords:  fmt.Sprintf("%v %v", x, y),
-		LoggerFieldEventIsPress: isPress,
-		LoggerFieldEventX11:     fmt.Sprintf("state:%v keycode:%v button:%v", state, keycode, button),
+		LoggerFieldSource:  source,
+		LoggerFieldEvent:   LoggerEventX11,
+		LoggerFieldIsPress: isPress,
+		LoggerFieldCoords:  fmt.Sprintf("%v %v", x, y),
+		LoggerFieldX11:     fmt.Sprintf("state:%v keycode:%v button:%v", state, keycode, button),
 	})
-	l.Debug(source)
+	l.Debug("event")
 }
 
 func StringInSlice(s string, slice []string) bool {
@@ -2,8 +2,12 @@ package i2vnc
 
 import (
 	"fmt"
+	"os"
+	"path/filepath"
 	"reflect"
+	"sort"
 	"testing"
+	"time"
 )
 
 func makeEd(name string, isPress bool) EventDef {
@@ -312,3 +316,117 @@ func Test_event_resolve(t *testing.T) {
 		})
 	}
 }
+
+func TestLoadConfig(t *testing.T) {
+	tests := []struct {
+		name         string
+		yaml         string
+		wantRemotes  []string
+		wantSettings Settings
+		wantErr      bool
+	}{
+		{
+			name:        "remotes only",
+			yaml:        "mac:\n  hotkey: F9\nlinux:\n  hotkey: F10\n",
+			wantRemotes: []string{"linux", "mac"},
+		},
+		{
+			name:         "settings aren't remotes",
+			yaml:         "metrics:\n  listen: :9100\nmac:\n  hotkey: F9\n",
+			wantRemotes:  []string{"mac"},
+			wantSettings: Settings{Metrics: metricsConfig{Listen: ":9100"}},
+		},
+		{
+			name:        "logging settings",
+			yaml:        "logging:\n  format: json\n  levels:\n    input: debug\nmac:\n  hotkey: F9\n",
+			wantRemotes: []string{"mac"},
+			wantSettings: Settings{Logging: loggingConfig{
+				Format: LogFormatJSON,
+				Levels: map[string]string{SubsystemInput: "debug"},
+			}},
+		},
+		{
+			name:    "invalid remote",
+			yaml:    "mac:\n  hotkey: NoSuchKey\n",
+			wantErr: true,
+		},
+		{
+			name:    "remote named like a setting",
+			yaml:    "metrics:\n  hotkey: F9\n  server: 10.0.0.2\nmac:\n  hotkey: F10\n",
+			wantErr: true,
+		},
+		{
+			name:    "panic keys pressing a remote hotkey",
+			yaml:    "panic:\n  keys: Scroll_Lock\n  presses: 3\nmac:\n  hotkey: Scroll_Lock\n",
+			wantErr: true,
+		},
+		{
+			name:    "panic keys pressing a pointer mode hotkey",
+			yaml:    "mac:\n  hotkey: F9\n  pointer:\n    modeHotkey: Escape\n",
+			wantErr: true,
+		},
+		{
+			name:    "panic keys pressing a sequence step",
+			yaml:    "hotkeys:\n  - keys: Control_L+Alt_L, q\n    action: quit\nmac:\n  hotkey: F9\n",
+			wantErr: true,
+		},
+		{
+			name:        "remote without a hotkey",
+			yaml:        "mac:\n  hotkey: F9\nlinux:\n  server: 10.0.0.2\n",
+			wantRemotes: []string{"linux", "mac"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.yaml")
+			if err := os.WriteFile(path, []byte(tt.yaml), 0600); err != nil {
+				t.Fatal(err)
+			}
+			config, settings, err := LoadConfig(path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("LoadConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			var remotes []string
+			for name, ci := range config {
+				if ci.Name != name {
+					t.Errorf("config %q has name %q", name, ci.Name)
+				}
+				remotes = append(remotes, name)
+			}
+			sort.Strings(remotes)
+			if !reflect.DeepEqual(remotes, tt.wantRemotes) {
+				t.Errorf("LoadConfig() remotes = %v, want %v", remotes, tt.wantRemotes)
+			}
+			if !reflect.DeepEqual(settings, tt.wantSettings) {
+				t.Errorf("LoadConfig() settings = %+v, want %+v", settings, tt.wantSettings)
+			}
+		})
+	}
+}
+
+func TestLoadConfig_timeouts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	yaml := "mac:\n  hotkey: F9\n  settleMs: 50\n  timeoutSec: 2\n"
+	if err := os.WriteFile(path, []byte(yaml), 0600); err != nil {
+		t.Fatal(err)
+	}
+	config, _, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := config["mac"].settle(); got != 50*time.Millisecond {
+		t.Errorf("settle() = %v, want 50ms", got)
+	}
+	if got := config["mac"].timeout(); got != 2*time.Second {
+		t.Errorf("timeout() = %v, want 2s", got)
+	}
+}
+
+func TestLoadConfig_example(t *testing.T) {
+	if _, _, err := LoadConfig("example.yaml"); err != nil {
+		t.Fatal(err)
+	}
+}
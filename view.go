@@ -0,0 +1,89 @@
+package i2vnc
+
+import (
+	"image"
+
+	"github.com/BurntSushi/xgbutil"
+	"github.com/BurntSushi/xgbutil/keybind"
+	"github.com/BurntSushi/xgbutil/mousebind"
+	"github.com/BurntSushi/xgbutil/xevent"
+	"github.com/runz0rd/i2vnc/x11"
+)
+
+const (
+	defaultViewWidth  = 1024
+	defaultViewHeight = 768
+)
+
+// Viewer shows the framebuffer of the connected remote.
+type Viewer interface {
+	// ShowFramebuffer is called after every framebuffer update with the
+	// rectangle it changed, the image must not be used after returning.
+	ShowFramebuffer(img *image.RGBA, r image.Rectangle)
+}
+
+// absoluteInput is implemented by inputs whose pointer is always absolute.
+type absoluteInput interface {
+	absolutePointer() bool
+}
+
+// View switches to view mode, in which a window shows the remote framebuffer
+// and the input is read from the window, instead of being grabbed. The window
+// shows the remote screen unscaled, so the pointer is always absolute.
+// It must be called before Grab, the returned Viewer shows the framebuffer.
+func (i *X11Input) View() (Viewer, error) {
+	v, err := x11.NewViewer(i.xu.Conn(), i.xu.Screen(), defaultViewWidth, defaultViewHeight)
+	if err != nil {
+		return nil, err
+	}
+	xevent.ExposeFun(func(xu *xgbutil.XUtil, e xevent.ExposeEvent) {
+		v.Redraw(image.Rect(int(e.X), int(e.Y), int(e.X)+int(e.Width), int(e.Y)+int(e.Height)))
+	}).Connect(i.xu, v.Window())
+	i.view = v
+	// the raw XInput2 events are for the grabbed pointer
+	if i.xi2 != nil {
+		i.xi2.Close()
+		i.xi2 = nil
+	}
+	i.e.absolute = true
+	vw := x11Viewer{v}
+	vw.Show(Status{})
+	i.AddIndicator(vw)
+	return vw, nil
+}
+
+func (i *X11Input) absolutePointer() bool {
+	return i.view != nil
+}
+
+// grabView reads the input from the view window.
+func (i *X11Input) grabView() error {
+	i.l.Infof("viewing remotes")
+	w := i.view.Window()
+	keybind.Initialize(i.xu)
+	mousebind.Initialize(i.xu)
+	xevent.KeyPressFun(i.handleKeyPress).Connect(i.xu, w)
+	xevent.KeyReleaseFun(i.handleKeyRelease).Connect(i.xu, w)
+	xevent.ButtonPressFun(i.handleButtonPress).Connect(i.xu, w)
+	xevent.ButtonReleaseFun(i.handleButtonRelease).Connect(i.xu, w)
+	xevent.MotionNotifyFun(i.handleMotionNotify).Connect(i.xu, w)
+
+	i.notify(Status{Grabbed: true})
+	i.l.Infof("viewing! press a hotkey in the window to connect")
+	i.eventLoop()
+	return nil
+}
+
+// x11Viewer shows the framebuffer in the view window,
+// with the status as its title.
+type x11Viewer struct {
+	*x11.Viewer
+}
+
+func (v x11Viewer) ShowFramebuffer(img *image.RGBA, r image.Rectangle) {
+	v.Draw(img, r)
+}
+
+func (v x11Viewer) Show(s Status) {
+	v.SetTitle(s.String())
+}
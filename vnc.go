@@ -2,8 +2,11 @@ package i2vnc
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"image"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/kward/go-vnc"
@@ -12,45 +15,381 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+const (
+	// updateInterval is the shortest time between framebuffer update requests.
+	updateInterval = 16 * time.Millisecond
+	// pointerEchoWindow is how long a pointer position sent is recognized,
+	// when the server reports it back.
+	pointerEchoWindow = time.Second
+	// pointerInFlight is how long a pointer report might predate
+	// the motion sent before it.
+	pointerInFlight = 100 * time.Millisecond
+	// sendTimeout bounds sending an event to the server,
+	// a stalled connection is dropped after it.
+	sendTimeout = 2 * time.Second
+	// defaultHandshakeTimeout bounds the handshake with the server,
+	// unless the remote has a timeout.
+	defaultHandshakeTimeout = 10 * time.Second
+)
+
 type VncRemote struct {
 	l  *logrus.Entry
 	c  Config
 	vc *vnc.ClientConn
 	nc net.Conn
+	// w writes to nc, the events and the update requests
+	w  *connWriter
 	ci configItem
+	// v shows the framebuffer, nil unless viewing
+	v Viewer
+	// state is reported by the server of the current connection
+	state *remoteState
 }
 
 func NewVncRemote(logger *logrus.Logger, config Config) *VncRemote {
 	return &VncRemote{l: logrus.NewEntry(logger), c: config}
 }
 
+// SetConfig connects with the config from now on, like after reloading it.
+func (r *VncRemote) SetConfig(config Config) {
+	r.c = config
+}
+
 func (r *VncRemote) Connect(cname string, timeout time.Duration) error {
 	ci, err := r.c.getItem(cname)
 	if err != nil {
 		return err
 	}
-	r.l.Infof("connecting to vnc remote %q", cname)
-	r.nc, err = net.DialTimeout("tcp", fmt.Sprintf("%v:%v", ci.Server, ci.Port), timeout*time.Second)
-	if err != nil {
-		return err
+	l := r.l.WithField(LoggerFieldRemote, cname)
+	l.Infof("connecting to vnc remote %q", cname)
+	if ci.Wol.enabled() && ci.Wol.Always {
+		if err := sendMagicPacket(ci.Wol); err != nil {
+			l.WithError(err).Warn("failed sending wol magic packet")
+		}
 	}
+	if err := r.dial(ci, timeout); err != nil {
+		// only remotes that can't be reached are woken up,
+		// the ones failing the negotiation are awake
+		if !ci.Wol.enabled() {
+			return err
+		}
+		l.WithError(err).Infof("failed connecting to vnc remote %q, waking it", cname)
+		if err := r.wake(l, cname, ci, timeout); err != nil {
+			return err
+		}
+	}
+	return r.negotiate(l, cname, ci, timeout)
+}
+
+// wake sends the Wake-on-LAN magic packet and dials
+// the remote again until it wakes up.
+func (r *VncRemote) wake(l *logrus.Entry, cname string, ci configItem, timeout time.Duration) error {
+	if err := sendMagicPacket(ci.Wol); err != nil {
+		return fmt.Errorf("failed sending wol magic packet: %s", err)
+	}
+	window := ci.Wol.wakeWindow()
+	l.Infof("sent wol magic packet to %v, waiting up to %v for %q to wake up", ci.Wol.broadcast(), window, cname)
+	deadline := time.Now().Add(window)
+	for attempt := 1; ; attempt++ {
+		// the last attempt doesn't outlast the wake window
+		d := time.Until(deadline)
+		if timeout > 0 && timeout < d {
+			d = timeout
+		}
+		err := r.dial(ci, d)
+		if err == nil {
+			l.Infof("vnc remote %q woke up after %v attempts", cname, attempt)
+			return nil
+		}
+		if time.Until(deadline) < wolRetryInterval {
+			return fmt.Errorf("remote didn't wake up in %v: %s", window, err)
+		}
+		l.WithError(err).Infof("waiting for %q to wake up, attempt %v failed", cname, attempt)
+		time.Sleep(wolRetryInterval)
+	}
+}
 
+func (r *VncRemote) dial(ci configItem, timeout time.Duration) error {
+	var err error
+	r.nc, err = net.DialTimeout("tcp", fmt.Sprintf("%v:%v", ci.Server, ci.Port), timeout)
+	return err
+}
+
+func (r *VncRemote) negotiate(l *logrus.Entry, cname string, ci configItem, timeout time.Duration) error {
+	var err error
 	cc := vnc.NewClientConfig(ci.Pw)
 	// cc.ServerMessageCh = make(chan vnc.ServerMessage)
 
+	// a server stalling the handshake would block the input
+	if timeout == 0 {
+		timeout = defaultHandshakeTimeout
+	}
+	if err := r.nc.SetDeadline(time.Now().Add(timeout)); err != nil {
+		r.nc.Close()
+		return err
+	}
+	defer r.nc.SetDeadline(time.Time{})
+	r.w = &connWriter{nc: r.nc}
+
 	// Negotiate connection with the server.
-	r.l.Infof("negotiating with vnc remote %q", cname)
+	l.Infof("negotiating with vnc remote %q", cname)
 	r.vc, err = vnc.Connect(context.Background(), r.nc, cc)
 	if err != nil {
+		r.nc.Close()
 		return err
 	}
-	r.l.Infof("connected to vnc remote %q", cname)
+	l.Infof("connected to vnc remote %q", cname)
 	// configure settle (UI) time to reduce lag
-	vnc.SetSettle(ci.SettleMs())
+	vnc.SetSettle(ci.settle())
 	r.ci = ci
+	if err := r.startUpdates(l); err != nil {
+		return fmt.Errorf("failed requesting framebuffer updates: %s", err)
+	}
+	return nil
+}
+
+// SetViewer shows the framebuffer of the remotes connected to from now on.
+func (r *VncRemote) SetViewer(v Viewer) {
+	r.v = v
+}
+
+// startUpdates reads the framebuffer updates in the background. Without a viewer
+// only the pseudo-encodings tracking the remote pointer are of interest.
+func (r *VncRemote) startUpdates(l *logrus.Entry) error {
+	if err := r.vc.SetPixelFormat(FramebufferPixelFormat); err != nil {
+		return err
+	}
+	encodings := append(append([]int32(nil), framebufferEncodings...), cursorEncodings...)
+	if r.v != nil {
+		// the server draws the cursor into the viewed framebuffer
+		encodings = append(append([]int32(nil), framebufferEncodings...), encodingPointerPos)
+	}
+	encodings = append(encodings, encodingLEDState)
+	if err := setEncodings(r.nc, encodings); err != nil {
+		return err
+	}
+	r.state = &remoteState{screen: Screen{r.vc.FramebufferWidth(), r.vc.FramebufferHeight()}}
+	fb := newFramebuffer(r.nc, r.vc.FramebufferWidth(), r.vc.FramebufferHeight())
+	go r.readUpdates(l, r.w, fb, r.state)
 	return nil
 }
 
+// readUpdates requests framebuffer updates and handles them,
+// until the connection is closed.
+func (r *VncRemote) readUpdates(l *logrus.Entry, w *connWriter, fb *framebuffer, state *remoteState) {
+	incremental := false
+	for {
+		requested := time.Now()
+		region := image.Rect(0, 0, 1, 1)
+		if r.v != nil {
+			region = fb.img.Bounds()
+		}
+		err := w.write(func() error { return requestUpdate(w.nc, incremental, region) })
+		if err != nil {
+			l.WithError(err).Debug("stopped reading framebuffer updates")
+			return
+		}
+		damage, err := fb.readUpdate()
+		if err != nil {
+			l.WithError(err).Debug("stopped reading framebuffer updates")
+			return
+		}
+		if fb.cursorChanged {
+			fb.cursorChanged = false
+			l.Debugf("remote cursor changed to %vx%v, hotspot at %v",
+				fb.cursor.Bounds().Dx(), fb.cursor.Bounds().Dy(), fb.cursorHotspot)
+		}
+		if fb.pointerMoved {
+			fb.pointerMoved = false
+			pos := Screen{uint16(fb.pointer.X), uint16(fb.pointer.Y)}
+			if !state.setPointer(pos, time.Now()) {
+				l.Tracef("ignored the remote pointer at %v, echoing the pointer sent", pos)
+			}
+		}
+		size := fb.img.Bounds().Size()
+		screen := Screen{uint16(size.X), uint16(size.Y)}
+		// the contents of a resized framebuffer are requested again
+		resized := state.setScreen(screen)
+		if resized {
+			l.Infof("remote screen resized to %vx%v", screen.X, screen.Y)
+		}
+		if monitors := monitorsFromRects(fb.screens); state.setMonitors(monitors) {
+			l.Infof("remote monitors changed to %v", monitors)
+		}
+		if fb.locks != nil {
+			l.Debugf("remote lock states changed to %+v", *fb.locks)
+			state.setLocks(*fb.locks)
+			fb.locks = nil
+		}
+		state.setUpdated()
+		if r.v != nil && !damage.Empty() {
+			r.v.ShowFramebuffer(fb.img, damage)
+		}
+		incremental = !resized
+		// servers usually hold incremental updates until something changes,
+		// this limits the rate for the ones that don't
+		time.Sleep(updateInterval - time.Since(requested))
+	}
+}
+
+// PointerPos returns the remote pointer position reported by the server,
+// if it moved since the last call. Some servers report the pointer events
+// sent to them back, those reports are left out, so only the pointer
+// moved by the remote itself is reported.
+func (r *VncRemote) PointerPos() (Screen, bool) {
+	if !r.IsConnected() || r.state == nil {
+		return Screen{}, false
+	}
+	return r.state.pointer()
+}
+
+// Monitors returns the monitor layout reported by the server,
+// with the ExtendedDesktopSize pseudo-encoding.
+func (r *VncRemote) Monitors() []Monitor {
+	if !r.IsConnected() || r.state == nil {
+		return nil
+	}
+	return r.state.getMonitors()
+}
+
+// Locks returns the lock states reported by the server,
+// with the LED state pseudo-encoding.
+func (r *VncRemote) Locks() (Locks, bool) {
+	if !r.IsConnected() || r.state == nil {
+		return Locks{}, false
+	}
+	return r.state.getLocks()
+}
+
+// Updated reports whether the server sent its first framebuffer update,
+// along with the state of the remote it reports.
+func (r *VncRemote) Updated() bool {
+	if !r.IsConnected() || r.state == nil {
+		return false
+	}
+	return r.state.isUpdated()
+}
+
+// remoteState is what the server reports about the remote, it's set
+// while reading the updates and read by the input.
+type remoteState struct {
+	mu       sync.Mutex
+	pos      Screen
+	moved    bool
+	screen   Screen
+	monitors []Monitor
+	// locks are nil until the server reports them
+	locks *Locks
+	// updated is set once the first update is read
+	updated bool
+	// sent are the pointer positions sent within the pointerEchoWindow
+	sent []sentPointer
+}
+
+type sentPointer struct {
+	pos Screen
+	at  time.Time
+}
+
+// pointerSent remembers the pointer position sent at now.
+func (s *remoteState) pointerSent(pos Screen, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pruneSent(now)
+	s.sent = append(s.sent, sentPointer{pos, now})
+}
+
+func (s *remoteState) pruneSent(now time.Time) {
+	for len(s.sent) > 0 && now.Sub(s.sent[0].at) > pointerEchoWindow {
+		s.sent = s.sent[1:]
+	}
+}
+
+// setPointer sets the pointer position reported at now, reporting whether
+// it's set. The positions sent recently are echoes of the pointer sent,
+// as are the reports while the motion sent is in flight.
+func (s *remoteState) setPointer(pos Screen, now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pruneSent(now)
+	if len(s.sent) > 0 && now.Sub(s.sent[len(s.sent)-1].at) < pointerInFlight {
+		return false
+	}
+	for _, sent := range s.sent {
+		if sent.pos == pos {
+			return false
+		}
+	}
+	s.pos, s.moved = pos, true
+	return true
+}
+
+// pointer returns the pointer position, if it moved since the last call.
+func (s *remoteState) pointer() (Screen, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	moved := s.moved
+	s.moved = false
+	return s.pos, moved
+}
+
+// setScreen sets the screen size, reporting whether it changed.
+func (s *remoteState) setScreen(screen Screen) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	changed := s.screen != screen
+	s.screen = screen
+	return changed
+}
+
+func (s *remoteState) getScreen() Screen {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.screen
+}
+
+// setMonitors sets the monitor layout, reporting whether it changed.
+func (s *remoteState) setMonitors(monitors []Monitor) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	changed := !monitorsEqual(s.monitors, monitors)
+	s.monitors = monitors
+	return changed
+}
+
+func (s *remoteState) getMonitors() []Monitor {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.monitors
+}
+
+func (s *remoteState) setLocks(locks Locks) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.locks = &locks
+}
+
+func (s *remoteState) setUpdated() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.updated = true
+}
+
+func (s *remoteState) isUpdated() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.updated
+}
+
+func (s *remoteState) getLocks() (Locks, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.locks == nil {
+		return Locks{}, false
+	}
+	return *s.locks, true
+}
+
 func (r *VncRemote) IsConnected() bool {
 	if r.nc == nil || r.vc == nil {
 		return false
@@ -69,7 +408,8 @@ func (r *VncRemote) Disconnect() error {
 	if err != nil {
 		return err
 	}
-	r.l.Infof("disconnected from %q", r.ci.Name)
+	r.nc, r.w, r.vc, r.state = nil, nil, nil, nil
+	r.l.WithField(LoggerFieldRemote, r.ci.Name).Infof("disconnected from %q", r.ci.Name)
 	return nil
 }
 
@@ -77,6 +417,10 @@ func (r *VncRemote) Screen() Screen {
 	if !r.IsConnected() {
 		return Screen{}
 	}
+	if r.state != nil {
+		// the screen is resized when the remote changes its resolution
+		return r.state.getScreen()
+	}
 	return Screen{r.vc.FramebufferWidth(), r.vc.FramebufferHeight()}
 }
 
@@ -84,8 +428,8 @@ func (r *VncRemote) SendKeyEvent(name string, key uint32, isPress bool) error {
 	if !r.IsConnected() {
 		return fmt.Errorf("remote not connected")
 	}
-	if err := r.vc.KeyEvent(keys.Key(key), isPress); err != nil {
-		r.l.WithError(err).Error("failed to send key event")
+	if err := r.send(func() error { return r.vc.KeyEvent(keys.Key(key), isPress) }); err != nil {
+		r.l.WithField(LoggerFieldRemote, r.ci.Name).WithError(err).Error("failed to send key event")
 		return err
 	}
 	DebugEvent(r.l, "VncRemote", true, name, 0, 0, isPress)
@@ -101,23 +445,50 @@ func (r *VncRemote) SendPointerEvent(name string, button uint8, x, y uint16, isP
 		// is set, it is pressed, when it is unset, it is released.
 		button = 0
 	}
-	if err := r.vc.PointerEvent(buttonAdapter(button), x, y); err != nil {
-		r.l.WithError(err).Error("failed to send pointer event")
+	if err := r.send(func() error { return r.vc.PointerEvent(buttonAdapter(button), x, y) }); err != nil {
+		r.l.WithField(LoggerFieldRemote, r.ci.Name).WithError(err).Error("failed to send pointer event")
 		return err
 	}
+	if r.state != nil {
+		r.state.pointerSent(Screen{x, y}, time.Now())
+	}
 	DebugEvent(r.l, "VncRemote", false, name, x, y, isPress)
 	return nil
 }
 
-func buttonAdapter(button uint8) buttons.Button {
-	if button == 3 {
-		return buttons.Right
+// send writes an event to the server within the send timeout,
+// a server that stopped reading is disconnected.
+func (r *VncRemote) send(write func() error) error {
+	err := r.w.write(write)
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		r.l.WithField(LoggerFieldRemote, r.ci.Name).Warnf("the remote stopped reading the events for %v, disconnecting", sendTimeout)
+		r.Disconnect()
 	}
-	if button == 4 {
-		return buttons.Four
+	return err
+}
+
+// connWriter writes to the server one message at a time,
+// each within the send timeout.
+type connWriter struct {
+	mu sync.Mutex
+	nc net.Conn
+}
+
+func (w *connWriter) write(write func() error) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.nc.SetWriteDeadline(time.Now().Add(sendTimeout)); err != nil {
+		return err
 	}
-	if button == 5 {
-		return buttons.Five
+	defer w.nc.SetWriteDeadline(time.Time{})
+	return write()
+}
+
+func buttonAdapter(button uint8) buttons.Button {
+	// X11 buttons are numbered from 1, rfb buttons are bits of a mask
+	if button == 0 || button > 8 {
+		return buttons.None
 	}
-	return buttons.Button(button)
+	return buttons.Button(1 << (button - 1))
 }
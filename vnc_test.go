@@ -0,0 +1,442 @@
+package i2vnc
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/kward/go-vnc"
+	"github.com/kward/go-vnc/messages"
+	"github.com/runz0rd/i2vnc/vnctest"
+	"github.com/sirupsen/logrus"
+)
+
+func newTestVncRemote(t *testing.T, c vnctest.Config, pw string) (*VncRemote, *vnctest.Server) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.PanicLevel)
+	s := vnctest.NewServer(logger, c)
+	if err := s.Listen(""); err != nil {
+		t.Fatal(err)
+	}
+	config := Config{"mac": {Name: "mac", Server: "127.0.0.1", Port: s.Addr().Port, Pw: pw}}
+	return NewVncRemote(logger, config), s
+}
+
+func TestVncRemote_Connect(t *testing.T) {
+	tests := []struct {
+		name    string
+		c       vnctest.Config
+		pw      string
+		wantErr bool
+	}{
+		{"no auth", vnctest.Config{}, "", false},
+		{"vnc auth", vnctest.Config{Password: "test123"}, "test123", false},
+		{"wrong password", vnctest.Config{Password: "test123"}, "wrong", true},
+		{"protocol 3.3", vnctest.Config{ProtocolVersion: vnctest.ProtocolVersion33}, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.c.Width, tt.c.Height = 1440, 900
+			r, s := newTestVncRemote(t, tt.c, tt.pw)
+			defer s.Close()
+			err := r.Connect("mac", time.Second)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Connect() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			defer r.Disconnect()
+			if got := r.Screen(); got != (Screen{1440, 900}) {
+				t.Errorf("Screen() = %v, want 1440x900", got)
+			}
+		})
+	}
+}
+
+func TestVncRemote_events(t *testing.T) {
+	r, s := newTestVncRemote(t, vnctest.Config{Width: 1440, Height: 900}, "")
+	defer s.Close()
+	if err := r.Connect("mac", time.Second); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Disconnect()
+	a := makeEd("a", true)
+	r.SendKeyEvent(a.Name, a.Key, true)
+	r.SendKeyEvent(a.Name, a.Key, false)
+	r.SendPointerEvent("Button_Right", 3, 100, 200, true)
+	r.SendPointerEvent("Button_Right", 3, 100, 200, false)
+	r.SendPointerEvent("Button_7", 7, 100, 200, true)
+
+	got, err := s.WaitEvents(5, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []vnctest.Event{
+		{Type: messages.KeyEvent, Key: a.Key, Down: true},
+		{Type: messages.KeyEvent, Key: a.Key, Down: false},
+		{Type: messages.PointerEvent, Mask: 4, X: 100, Y: 200},
+		{Type: messages.PointerEvent, Mask: 0, X: 100, Y: 200},
+		{Type: messages.PointerEvent, Mask: 64, X: 100, Y: 200},
+	}
+	for i := range want {
+		got[i].Time = time.Time{}
+		if got[i] != want[i] {
+			t.Errorf("event %v = %v, want %v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestVncRemote_pointerPos(t *testing.T) {
+	r, s := newTestVncRemote(t, vnctest.Config{Width: 1440, Height: 900}, "")
+	defer s.Close()
+	if err := r.Connect("mac", time.Second); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Disconnect()
+	if pos, ok := r.PointerPos(); ok {
+		t.Errorf("PointerPos() = %v before the pointer moved", pos)
+	}
+	s.MovePointer(100, 200)
+	deadline := time.Now().Add(time.Second)
+	for {
+		pos, ok := r.PointerPos()
+		if ok {
+			if pos != (Screen{100, 200}) {
+				t.Errorf("PointerPos() = %v, want 100 200", pos)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the pointer position")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if pos, ok := r.PointerPos(); ok {
+		t.Errorf("PointerPos() = %v again", pos)
+	}
+	if encs := s.Encodings(); !containsEncoding(encs, encodingCursor) || !containsEncoding(encs, encodingPointerPos) {
+		t.Errorf("encodings %v miss the cursor pseudo-encodings", encs)
+	}
+}
+
+func TestVncRemote_send(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.PanicLevel)
+	// the server end of the pipe never reads
+	client, server := net.Pipe()
+	defer server.Close()
+	r := NewVncRemote(logger, Config{})
+	r.nc, r.w, r.vc = client, &connWriter{nc: client}, &vnc.ClientConn{}
+	err := r.send(func() error {
+		_, err := client.Write([]byte{0})
+		return err
+	})
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatalf("send() error = %v, want a timeout", err)
+	}
+	if r.IsConnected() {
+		t.Error("still connected to the stalled remote")
+	}
+}
+
+func Test_remoteState_setPointer(t *testing.T) {
+	start := time.Now()
+	at := func(ms int) time.Time { return start.Add(time.Duration(ms) * time.Millisecond) }
+	tests := []struct {
+		name string
+		sent []sentPointer
+		pos  Screen
+		at   time.Time
+		want bool
+	}{
+		{"nothing sent", nil, Screen{10, 10}, at(0), true},
+		{"echo", []sentPointer{{Screen{10, 10}, at(0)}, {Screen{20, 20}, at(100)}}, Screen{10, 10}, at(500), false},
+		{"in flight", []sentPointer{{Screen{20, 20}, at(0)}}, Screen{10, 10}, at(50), false},
+		{"moved by the remote", []sentPointer{{Screen{20, 20}, at(0)}}, Screen{10, 10}, at(500), true},
+		{"old echo", []sentPointer{{Screen{10, 10}, at(0)}}, Screen{10, 10}, at(2000), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &remoteState{}
+			for _, sent := range tt.sent {
+				s.pointerSent(sent.pos, sent.at)
+			}
+			if got := s.setPointer(tt.pos, tt.at); got != tt.want {
+				t.Errorf("setPointer() = %v, want %v", got, tt.want)
+			}
+			if _, moved := s.pointer(); moved != tt.want {
+				t.Errorf("pointer() moved = %v, want %v", moved, tt.want)
+			}
+		})
+	}
+}
+
+func TestVncRemote_resize(t *testing.T) {
+	r, s := newTestVncRemote(t, vnctest.Config{Width: 1440, Height: 900}, "")
+	defer s.Close()
+	if err := r.Connect("mac", time.Second); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Disconnect()
+	s.SetFramebuffer(image.NewRGBA(image.Rect(0, 0, 1920, 1080)))
+	deadline := time.Now().Add(time.Second)
+	for r.Screen() != (Screen{1920, 1080}) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Screen() = %v, want 1920x1080", r.Screen())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestVncRemote_resizeAfterIdle(t *testing.T) {
+	r, s := newTestVncRemote(t, vnctest.Config{Width: 1440, Height: 900}, "")
+	defer s.Close()
+	if err := r.Connect("mac", time.Second); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Disconnect()
+	// the deadline of the key sent doesn't outlive it
+	if err := r.SendKeyEvent("a", 0x61, true); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(sendTimeout + 500*time.Millisecond)
+	for _, size := range []Screen{{1920, 1080}, {2560, 1440}} {
+		s.SetFramebuffer(image.NewRGBA(image.Rect(0, 0, int(size.X), int(size.Y))))
+		deadline := time.Now().Add(time.Second)
+		for r.Screen() != size {
+			if time.Now().After(deadline) {
+				t.Fatalf("Screen() = %v, want %v", r.Screen(), size)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
+
+func TestVncRemote_handshakeTimeout(t *testing.T) {
+	// the server accepts the connection, but never starts the handshake
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			nc, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer nc.Close()
+		}
+	}()
+	logger := logrus.New()
+	logger.SetLevel(logrus.PanicLevel)
+	r := NewVncRemote(logger, Config{"mac": {Name: "mac", Server: "127.0.0.1", Port: ln.Addr().(*net.TCPAddr).Port}})
+	done := make(chan error, 1)
+	go func() { done <- r.Connect("mac", 100*time.Millisecond) }()
+	select {
+	case err := <-done:
+		if err == nil {
+			r.Disconnect()
+			t.Fatal("Connect() succeeded, want error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Connect() blocked on the stalled handshake")
+	}
+}
+
+func TestVncRemote_updated(t *testing.T) {
+	r, s := newTestVncRemote(t, vnctest.Config{Width: 1024, Height: 768}, "")
+	defer s.Close()
+	if r.Updated() {
+		t.Fatal("Updated() before connecting")
+	}
+	if err := r.Connect("mac", time.Second); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Disconnect()
+	deadline := time.Now().Add(time.Second)
+	for !r.Updated() {
+		if time.Now().After(deadline) {
+			t.Fatal("no update read after connecting")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestVncRemote_monitors(t *testing.T) {
+	r, s := newTestVncRemote(t, vnctest.Config{Width: 3840, Height: 1440, Screens: []image.Rectangle{
+		image.Rect(0, 0, 1920, 1080), image.Rect(1920, 0, 3840, 1440),
+	}}, "")
+	defer s.Close()
+	if err := r.Connect("mac", time.Second); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Disconnect()
+	want := []Monitor{{0, 0, 1920, 1080}, {1920, 0, 1920, 1440}}
+	deadline := time.Now().Add(time.Second)
+	for !reflect.DeepEqual(r.Monitors(), want) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Monitors() = %v, want %v", r.Monitors(), want)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestVncRemote_wol(t *testing.T) {
+	const mac = "01:02:03:04:05:06"
+	hw, _ := net.ParseMAC(mac)
+	logger := logrus.New()
+	logger.SetLevel(logrus.PanicLevel)
+	// listen returns the address of a local UDP listener,
+	// which calls received with every magic packet
+	listen := func(t *testing.T, received func([]byte)) string {
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { pc.Close() })
+		go func() {
+			buf := make([]byte, 1024)
+			for {
+				n, _, err := pc.ReadFrom(buf)
+				if err != nil {
+					return
+				}
+				received(append([]byte(nil), buf[:n]...))
+			}
+		}()
+		return pc.LocalAddr().String()
+	}
+
+	t.Run("always", func(t *testing.T) {
+		packets := make(chan []byte, 1)
+		broadcast := listen(t, func(p []byte) { packets <- p })
+		s := vnctest.NewServer(logger, vnctest.Config{})
+		if err := s.Listen(""); err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		r := NewVncRemote(logger, Config{"mac": {Name: "mac", Server: "127.0.0.1", Port: s.Addr().Port,
+			Wol: wolConfig{Mac: mac, Broadcast: broadcast, Always: true}}})
+		if err := r.Connect("mac", time.Second); err != nil {
+			t.Fatal(err)
+		}
+		defer r.Disconnect()
+		select {
+		case p := <-packets:
+			if !reflect.DeepEqual(p, magicPacket(hw)) {
+				t.Errorf("packet = %x, want %x", p, magicPacket(hw))
+			}
+		case <-time.After(time.Second):
+			t.Fatal("no magic packet received")
+		}
+	})
+
+	t.Run("sleeping", func(t *testing.T) {
+		// reserve a port for the server, which starts listening
+		// on it when it receives the magic packet
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr := ln.Addr().(*net.TCPAddr)
+		ln.Close()
+		s := vnctest.NewServer(logger, vnctest.Config{})
+		defer s.Close()
+		woken := make(chan error, 1)
+		broadcast := listen(t, func(p []byte) {
+			if reflect.DeepEqual(p, magicPacket(hw)) {
+				woken <- s.Listen(addr.String())
+			}
+		})
+		r := NewVncRemote(logger, Config{"mac": {Name: "mac", Server: "127.0.0.1", Port: addr.Port,
+			Wol: wolConfig{Mac: mac, Broadcast: broadcast, WakeSec: 5}}})
+		if err := r.Connect("mac", time.Second); err != nil {
+			t.Fatal(err)
+		}
+		defer r.Disconnect()
+		if err := <-woken; err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("not waking", func(t *testing.T) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		port := ln.Addr().(*net.TCPAddr).Port
+		ln.Close()
+		broadcast := listen(t, func([]byte) {})
+		r := NewVncRemote(logger, Config{"mac": {Name: "mac", Server: "127.0.0.1", Port: port,
+			Wol: wolConfig{Mac: mac, Broadcast: broadcast, WakeSec: 1}}})
+		if err := r.Connect("mac", time.Second); err == nil {
+			r.Disconnect()
+			t.Fatal("Connect() succeeded, want error")
+		}
+	})
+}
+
+func containsEncoding(encs []int32, enc int32) bool {
+	for _, e := range encs {
+		if e == enc {
+			return true
+		}
+	}
+	return false
+}
+
+// recordingViewer sends a copy of every framebuffer shown.
+type recordingViewer chan *image.RGBA
+
+func (v recordingViewer) ShowFramebuffer(img *image.RGBA, r image.Rectangle) {
+	c := image.NewRGBA(img.Bounds())
+	draw.Draw(c, c.Bounds(), img, image.Point{}, draw.Src)
+	v <- c
+}
+
+func (v recordingViewer) wait(t *testing.T) *image.RGBA {
+	select {
+	case img := <-v:
+		return img
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for a framebuffer update")
+	}
+	return nil
+}
+
+func TestVncRemote_view(t *testing.T) {
+	first := testFramebuffer()
+	r, s := newTestVncRemote(t, vnctest.Config{Width: 150, Height: 180, Framebuffer: first,
+		Encodings: []int32{vnctest.EncodingHextile, vnctest.EncodingZRLE, vnctest.EncodingRaw}}, "")
+	defer s.Close()
+	v := make(recordingViewer, 4)
+	r.SetViewer(v)
+	if err := r.Connect("mac", time.Second); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Disconnect()
+	if got := v.wait(t); !reflect.DeepEqual(got.Pix, first.Pix) {
+		t.Error("first framebuffer update differs from the framebuffer")
+	}
+	second := image.NewRGBA(first.Bounds())
+	draw.Draw(second, second.Bounds(), image.NewUniform(color.RGBA{0x12, 0x34, 0x56, 0xff}), image.Point{}, draw.Src)
+	s.SetFramebuffer(second)
+	if got := v.wait(t); !reflect.DeepEqual(got.Pix, second.Pix) {
+		t.Error("incremental framebuffer update differs from the changed framebuffer")
+	}
+	select {
+	case <-v:
+		t.Error("got a framebuffer update without a change")
+	case <-time.After(50 * time.Millisecond):
+	}
+	// the server draws the cursor into the viewed framebuffer
+	if encs := s.Encodings(); containsEncoding(encs, encodingCursor) {
+		t.Errorf("encodings %v request the cursor shape while viewing", encs)
+	}
+}
@@ -0,0 +1,488 @@
+package vnctest
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"net"
+	"sync"
+)
+
+// Encodings the Server can send framebuffer updates with.
+const (
+	EncodingRaw      = int32(0)
+	EncodingCopyRect = int32(1)
+	EncodingHextile  = int32(5)
+	EncodingTight    = int32(7)
+	EncodingZRLE     = int32(16)
+
+	// Pseudo-encodings reporting the framebuffer size and the pointer position.
+	EncodingDesktopSize         = int32(-223)
+	EncodingPointerPos          = int32(-232)
+	EncodingExtendedDesktopSize = int32(-308)
+
+	zrleTileSize       = 64
+	hextileSize        = 16
+	tightMinToCompress = 12
+)
+
+// client is the state of a connected client.
+type client struct {
+	conn      net.Conn
+	encodings map[int32]bool
+	// the zlib streams live as long as the connection
+	zrle  *zlibStream
+	tight *zlibStream
+
+	// mu guards sending framebuffer updates, which SetFramebuffer
+	// and MovePointer do too
+	mu sync.Mutex
+	// pending is set while an incremental update request waits for a change
+	pending bool
+	// region is the last requested part of the framebuffer
+	region image.Rectangle
+	// sent and sentPointer are the framebuffer and pointer versions last sent
+	sent        int
+	sentPointer int
+	// size is the framebuffer size last sent
+	size image.Point
+	// screensSent is set once the screen layout was sent
+	screensSent bool
+	// updates counts the framebuffer updates sent
+	updates int
+}
+
+func newClient(conn net.Conn) *client {
+	return &client{conn: conn, encodings: map[int32]bool{}}
+}
+
+// requestUpdate sends the requested region of the framebuffer, unless the request
+// is incremental and neither the framebuffer nor the pointer changed since.
+func (s *Server) requestUpdate(c *client, incremental bool, region image.Rectangle) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.region = region
+	if incremental && !s.changed(c) {
+		c.pending = true
+		return nil
+	}
+	return s.writeUpdate(c, !incremental)
+}
+
+// changed reports whether the client has any changes to be sent.
+func (s *Server) changed(c *client) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return c.sent != s.version || (c.encodings[EncodingPointerPos] && c.sentPointer != s.pointerVersion)
+}
+
+// sendPending sends the changes to the clients waiting for them.
+func (s *Server) sendPending() {
+	s.mu.Lock()
+	var clients []*client
+	for _, c := range s.conns {
+		clients = append(clients, c)
+	}
+	s.mu.Unlock()
+	for _, c := range clients {
+		c.mu.Lock()
+		if c.pending && s.changed(c) {
+			c.pending = false
+			if err := s.writeUpdate(c, false); err != nil {
+				s.l.WithError(err).Warn("failed sending framebuffer update")
+			}
+		}
+		c.mu.Unlock()
+	}
+}
+
+// writeUpdate sends the framebuffer if it's a full update or it changed,
+// followed by the pointer position if it moved.
+func (s *Server) writeUpdate(c *client, full bool) error {
+	s.mu.Lock()
+	img, version := s.framebuffer, s.version
+	pointer, pointerVersion := s.pointer, s.pointerVersion
+	s.mu.Unlock()
+	var rects bytes.Buffer
+	n := 0
+	size := s.size(img)
+	if size != c.size || (c.encodings[EncodingExtendedDesktopSize] && !c.screensSent) {
+		switch {
+		case c.encodings[EncodingExtendedDesktopSize]:
+			s.writeScreens(&rects, size)
+			c.screensSent = true
+			n++
+		case c.encodings[EncodingDesktopSize]:
+			binary.Write(&rects, binary.BigEndian, []uint16{0, 0, uint16(size.X), uint16(size.Y)})
+			binary.Write(&rects, binary.BigEndian, EncodingDesktopSize)
+			n++
+		}
+		// the resized framebuffer is sent again, clipped to its new size
+		c.size, full = size, true
+		c.region = c.region.Intersect(image.Rectangle{Max: size})
+	}
+	if (full || c.sent != version) && !(s.c.PseudoFirstUpdate && c.updates == 0) {
+		n += s.encodeFramebuffer(&rects, c, img)
+		c.sent = version
+	}
+	c.updates++
+	if c.encodings[EncodingPointerPos] && c.sentPointer != pointerVersion {
+		binary.Write(&rects, binary.BigEndian, []uint16{uint16(pointer.X), uint16(pointer.Y), 0, 0})
+		binary.Write(&rects, binary.BigEndian, EncodingPointerPos)
+		c.sentPointer = pointerVersion
+		n++
+	}
+	var msg bytes.Buffer
+	binary.Write(&msg, binary.BigEndian, struct {
+		Type  uint8
+		_     uint8
+		Rects uint16
+	}{0, 0, uint16(n)})
+	msg.Write(rects.Bytes())
+	return s.write(c.conn, msg.Bytes())
+}
+
+// writeScreens writes an ExtendedDesktopSize rectangle with the screen layout.
+func (s *Server) writeScreens(rects *bytes.Buffer, size image.Point) {
+	screens := s.c.Screens
+	if len(screens) == 0 {
+		screens = []image.Rectangle{{Max: size}}
+	}
+	binary.Write(rects, binary.BigEndian, []uint16{0, 0, uint16(size.X), uint16(size.Y)})
+	binary.Write(rects, binary.BigEndian, EncodingExtendedDesktopSize)
+	binary.Write(rects, binary.BigEndian, []uint8{uint8(len(screens)), 0, 0, 0})
+	for id, r := range screens {
+		binary.Write(rects, binary.BigEndian, struct {
+			ID                  uint32
+			X, Y, Width, Height uint16
+			Flags               uint32
+		}{uint32(id), uint16(r.Min.X), uint16(r.Min.Y), uint16(r.Dx()), uint16(r.Dy()), 0})
+	}
+}
+
+// encodeFramebuffer encodes the requested region of the framebuffer in horizontal
+// bands, one for each of the configured encodings the client supports.
+func (s *Server) encodeFramebuffer(rects *bytes.Buffer, c *client, img image.Image) int {
+	if img == nil {
+		img = image.NewRGBA(image.Rectangle{Max: s.size(nil)})
+	}
+	encs := s.c.Encodings
+	if len(encs) == 0 {
+		encs = []int32{EncodingRaw}
+	}
+	b := img.Bounds()
+	area := c.region.Add(b.Min).Intersect(b)
+	bandHeight := (area.Dy() + len(encs) - 1) / len(encs)
+	var sent []image.Rectangle
+	n := 0
+	for i, enc := range encs {
+		band := image.Rect(area.Min.X, area.Min.Y+i*bandHeight, area.Max.X, area.Min.Y+(i+1)*bandHeight).Intersect(area)
+		if band.Empty() {
+			continue
+		}
+		if !c.encodings[enc] {
+			enc = EncodingRaw
+		}
+		header := func(enc int32) {
+			binary.Write(rects, binary.BigEndian, []uint16{
+				uint16(band.Min.X - b.Min.X), uint16(band.Min.Y - b.Min.Y), uint16(band.Dx()), uint16(band.Dy())})
+			binary.Write(rects, binary.BigEndian, enc)
+		}
+		switch enc {
+		case EncodingCopyRect:
+			src, ok := findCopy(img, sent, band)
+			if !ok {
+				header(EncodingRaw)
+				rects.Write(encodeRaw(img, band))
+				break
+			}
+			header(enc)
+			binary.Write(rects, binary.BigEndian, []uint16{uint16(src.X - b.Min.X), uint16(src.Y - b.Min.Y)})
+		case EncodingHextile:
+			header(enc)
+			rects.Write(encodeHextile(img, band))
+		case EncodingZRLE:
+			if c.zrle == nil {
+				c.zrle = newZlibStream()
+			}
+			header(enc)
+			data := c.zrle.compress(encodeZRLE(img, band))
+			binary.Write(rects, binary.BigEndian, uint32(len(data)))
+			rects.Write(data)
+		case EncodingTight:
+			if c.tight == nil {
+				c.tight = newZlibStream()
+			}
+			header(enc)
+			rects.Write(encodeTight(c.tight, img, band))
+		default:
+			header(EncodingRaw)
+			rects.Write(encodeRaw(img, band))
+		}
+		sent = append(sent, band)
+		n++
+	}
+	return n
+}
+
+// size is the size of the framebuffer img, the configured size if it's nil.
+func (s *Server) size(img image.Image) image.Point {
+	if img == nil {
+		return image.Pt(int(s.c.Width), int(s.c.Height))
+	}
+	return img.Bounds().Size()
+}
+
+// findCopy finds an already sent rectangle with the same pixels as r.
+func findCopy(img image.Image, sent []image.Rectangle, r image.Rectangle) (image.Point, bool) {
+	for _, s := range sent {
+		if s.Dx() < r.Dx() || s.Dy() < r.Dy() {
+			continue
+		}
+		if samePixels(img, s.Min, r) {
+			return s.Min, true
+		}
+	}
+	return image.Point{}, false
+}
+
+func samePixels(img image.Image, src image.Point, r image.Rectangle) bool {
+	for y := 0; y < r.Dy(); y++ {
+		for x := 0; x < r.Dx(); x++ {
+			if rgb(img.At(src.X+x, src.Y+y)) != rgb(img.At(r.Min.X+x, r.Min.Y+y)) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func rgb(c color.Color) [3]byte {
+	r, g, b, _ := c.RGBA()
+	return [3]byte{byte(r >> 8), byte(g >> 8), byte(b >> 8)}
+}
+
+// encodeRaw encodes the pixels in PixelFormat.
+func encodeRaw(img image.Image, r image.Rectangle) []byte {
+	var buf bytes.Buffer
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			buf.Write(pixel(rgb(img.At(x, y))))
+		}
+	}
+	return buf.Bytes()
+}
+
+// pixel encodes the color in PixelFormat.
+func pixel(c [3]byte) []byte {
+	return []byte{c[2], c[1], c[0], 0}
+}
+
+// encodeHextile encodes the tiles of the rectangle as background only, background
+// and foreground subrectangles, or raw tiles. The background is only sent when
+// it differs from the previous tile.
+func encodeHextile(img image.Image, r image.Rectangle) []byte {
+	const (
+		raw        = 0x01
+		background = 0x02
+		foreground = 0x04
+		subrects   = 0x08
+	)
+	var buf bytes.Buffer
+	var bg [3]byte
+	first := true
+	for y := r.Min.Y; y < r.Max.Y; y += hextileSize {
+		for x := r.Min.X; x < r.Max.X; x += hextileSize {
+			tile := image.Rect(x, y, x+hextileSize, y+hextileSize).Intersect(r)
+			palette, _ := tilePalette(img, tile, 2)
+			if palette == nil {
+				buf.WriteByte(raw)
+				buf.Write(encodeRaw(img, tile))
+				// the background is undefined after a raw tile
+				first = true
+				continue
+			}
+			var sub byte
+			if first || palette[0] != bg {
+				sub |= background
+			}
+			if len(palette) == 2 {
+				sub |= foreground | subrects
+			}
+			buf.WriteByte(sub)
+			if sub&background != 0 {
+				bg, first = palette[0], false
+				buf.Write(pixel(bg))
+			}
+			if len(palette) == 1 {
+				continue
+			}
+			buf.Write(pixel(palette[1]))
+			// a subrectangle for every run of foreground pixels in a row
+			var runs [][2]byte
+			for ty := 0; ty < tile.Dy(); ty++ {
+				for tx := 0; tx < tile.Dx(); {
+					if rgb(img.At(tile.Min.X+tx, tile.Min.Y+ty)) != palette[1] {
+						tx++
+						continue
+					}
+					start := tx
+					for tx < tile.Dx() && rgb(img.At(tile.Min.X+tx, tile.Min.Y+ty)) == palette[1] {
+						tx++
+					}
+					// the width and height are sent minus one, the height is one
+					runs = append(runs, [2]byte{byte(start<<4 | ty), byte((tx - start - 1) << 4)})
+				}
+			}
+			buf.WriteByte(byte(len(runs)))
+			for _, run := range runs {
+				buf.Write(run[:])
+			}
+		}
+	}
+	return buf.Bytes()
+}
+
+// encodeZRLE encodes the tiles of the rectangle as solid, packed palette
+// or raw tiles, before compression.
+func encodeZRLE(img image.Image, r image.Rectangle) []byte {
+	var buf bytes.Buffer
+	for y := r.Min.Y; y < r.Max.Y; y += zrleTileSize {
+		for x := r.Min.X; x < r.Max.X; x += zrleTileSize {
+			tile := image.Rect(x, y, x+zrleTileSize, y+zrleTileSize).Intersect(r)
+			palette, index := tilePalette(img, tile, 16)
+			switch {
+			case len(palette) == 1:
+				buf.WriteByte(1)
+				writeCPixel(&buf, palette[0])
+			case palette != nil:
+				buf.WriteByte(byte(len(palette)))
+				for _, c := range palette {
+					writeCPixel(&buf, c)
+				}
+				bits := 4
+				if len(palette) == 2 {
+					bits = 1
+				} else if len(palette) <= 4 {
+					bits = 2
+				}
+				buf.Write(packIndexes(img, tile, index, bits))
+			default:
+				buf.WriteByte(0)
+				for ty := tile.Min.Y; ty < tile.Max.Y; ty++ {
+					for tx := tile.Min.X; tx < tile.Max.X; tx++ {
+						writeCPixel(&buf, rgb(img.At(tx, ty)))
+					}
+				}
+			}
+		}
+	}
+	return buf.Bytes()
+}
+
+func writeCPixel(buf *bytes.Buffer, c [3]byte) {
+	buf.Write([]byte{c[2], c[1], c[0]})
+}
+
+// tilePalette returns the colors of the rectangle and their indexes,
+// the palette is nil if there are more than max colors.
+func tilePalette(img image.Image, r image.Rectangle, max int) ([][3]byte, map[[3]byte]int) {
+	var palette [][3]byte
+	index := map[[3]byte]int{}
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			c := rgb(img.At(x, y))
+			if _, ok := index[c]; ok {
+				continue
+			}
+			if len(palette) == max {
+				return nil, nil
+			}
+			index[c] = len(palette)
+			palette = append(palette, c)
+		}
+	}
+	return palette, index
+}
+
+// packIndexes packs the palette indexes of the pixels, every row starts at a new byte.
+func packIndexes(img image.Image, r image.Rectangle, index map[[3]byte]int, bits int) []byte {
+	var buf bytes.Buffer
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		var b byte
+		used := 0
+		for x := r.Min.X; x < r.Max.X; x++ {
+			b |= byte(index[rgb(img.At(x, y))]) << uint(8-bits-used)
+			used += bits
+			if used == 8 {
+				buf.WriteByte(b)
+				b, used = 0, 0
+			}
+		}
+		if used > 0 {
+			buf.WriteByte(b)
+		}
+	}
+	return buf.Bytes()
+}
+
+// encodeTight encodes the rectangle with Tight fill compression if it has a single
+// color and basic compression with the copy filter on stream 0 otherwise.
+func encodeTight(z *zlibStream, img image.Image, r image.Rectangle) []byte {
+	var buf bytes.Buffer
+	if palette, _ := tilePalette(img, r, 1); palette != nil {
+		buf.WriteByte(0x80)
+		buf.Write(palette[0][:])
+		return buf.Bytes()
+	}
+	var data bytes.Buffer
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			c := rgb(img.At(x, y))
+			data.Write(c[:])
+		}
+	}
+	buf.WriteByte(0x00)
+	if data.Len() < tightMinToCompress {
+		buf.Write(data.Bytes())
+		return buf.Bytes()
+	}
+	compressed := z.compress(data.Bytes())
+	writeCompactLength(&buf, len(compressed))
+	buf.Write(compressed)
+	return buf.Bytes()
+}
+
+func writeCompactLength(buf *bytes.Buffer, n int) {
+	switch {
+	case n < 1<<7:
+		buf.WriteByte(byte(n))
+	case n < 1<<14:
+		buf.Write([]byte{byte(n) | 0x80, byte(n >> 7)})
+	default:
+		buf.Write([]byte{byte(n) | 0x80, byte(n>>7) | 0x80, byte(n >> 14)})
+	}
+}
+
+// zlibStream compresses data in a single zlib stream,
+// flushing after every call, like VNC servers do.
+type zlibStream struct {
+	buf bytes.Buffer
+	w   *zlib.Writer
+}
+
+func newZlibStream() *zlibStream {
+	z := &zlibStream{}
+	z.w = zlib.NewWriter(&z.buf)
+	return z
+}
+
+func (z *zlibStream) compress(data []byte) []byte {
+	z.w.Write(data)
+	z.w.Flush()
+	compressed := append([]byte(nil), z.buf.Bytes()...)
+	z.buf.Reset()
+	return compressed
+}
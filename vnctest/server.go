@@ -0,0 +1,520 @@
+// Package vnctest provides a fake RFB (VNC) server for testing clients
+// such as i2vnc without a real remote desktop.
+package vnctest
+
+import (
+	"crypto/des"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/kward/go-vnc"
+	"github.com/kward/go-vnc/messages"
+	"github.com/kward/go-vnc/rfbflags"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	ProtocolVersion33 = "RFB 003.003\n"
+	ProtocolVersion38 = "RFB 003.008\n"
+
+	secTypeInvalid = uint8(0)
+	secTypeNone    = uint8(1)
+	secTypeVNCAuth = uint8(2)
+)
+
+// Config configures the behaviour of a Server.
+type Config struct {
+	// Framebuffer size and desktop name reported in ServerInit.
+	Width  uint16
+	Height uint16
+	Name   string
+	// ProtocolVersion offered to clients, ProtocolVersion38 if empty.
+	ProtocolVersion string
+	// Password enables VNC authentication, no authentication is used if empty.
+	Password string
+	// RejectReason, if set, makes the server refuse every connection
+	// during the security handshake with this reason.
+	RejectReason string
+	// SecurityResultForNone sends a SecurityResult after the None security
+	// type with protocol 3.8, as RFC 6143 requires. Older clients,
+	// including the one i2vnc uses, do not expect it.
+	SecurityResultForNone bool
+	// WriteDelay is waited before every write to a client.
+	WriteDelay time.Duration
+	// ReadDelay is waited before reading every client message.
+	ReadDelay time.Duration
+	// DisconnectAfter closes a client connection after receiving
+	// this many input events, never if 0.
+	DisconnectAfter int
+	// Framebuffer is sent on FramebufferUpdateRequests until changed
+	// with SetFramebuffer, a black Width x Height framebuffer if nil.
+	Framebuffer image.Image
+	// Encodings are used in turn for horizontal bands of the framebuffer,
+	// Raw is used for the ones the client doesn't support and if empty.
+	Encodings []int32
+	// Screens is the screen layout sent to the clients supporting the
+	// ExtendedDesktopSize pseudo-encoding, with their first framebuffer update
+	// and every resize. A single screen covering the framebuffer if empty.
+	Screens []image.Rectangle
+	// PseudoFirstUpdate sends the first framebuffer update to every client
+	// with only the pseudo-rectangles, the framebuffer follows with the next.
+	PseudoFirstUpdate bool
+}
+
+// Event is a KeyEvent, PointerEvent or ClientCutText message received by the Server.
+type Event struct {
+	Type messages.ClientMessage
+	// KeyEvent keysym and down-flag
+	Key  uint32
+	Down bool
+	// PointerEvent button-mask and position
+	Mask uint8
+	X    uint16
+	Y    uint16
+	// ClientCutText text
+	Text string
+	Time time.Time
+}
+
+func (e Event) String() string {
+	switch e.Type {
+	case messages.KeyEvent:
+		return fmt.Sprintf("%v key:%#x down:%v", e.Type, e.Key, e.Down)
+	case messages.PointerEvent:
+		return fmt.Sprintf("%v mask:%08b coords:%v %v", e.Type, e.Mask, e.X, e.Y)
+	}
+	return fmt.Sprintf("%v text:%q", e.Type, e.Text)
+}
+
+// Server is a fake RFB server that records the input events it receives.
+type Server struct {
+	l  *logrus.Entry
+	c  Config
+	ln net.Listener
+
+	mu        sync.Mutex
+	conns     map[net.Conn]*client
+	events    []Event
+	encodings []int32
+	notify    chan struct{}
+	// framebuffer is sent on update requests, version counts its changes
+	framebuffer image.Image
+	version     int
+	// pointer is the pointer position moved on the server,
+	// pointerVersion counts its moves
+	pointer        image.Point
+	pointerVersion int
+}
+
+func NewServer(logger *logrus.Logger, c Config) *Server {
+	if c.ProtocolVersion == "" {
+		c.ProtocolVersion = ProtocolVersion38
+	}
+	return &Server{
+		l:           logrus.NewEntry(logger).WithField("source", "vnctest"),
+		c:           c,
+		conns:       make(map[net.Conn]*client),
+		notify:      make(chan struct{}),
+		framebuffer: c.Framebuffer,
+	}
+}
+
+// Listen starts listening on addr and serving clients in the background.
+// An empty addr listens on a random local port.
+func (s *Server) Listen(addr string) error {
+	if addr == "" {
+		addr = "127.0.0.1:0"
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	s.ln = ln
+	s.l.Infof("listening on %v", ln.Addr())
+	go s.serve()
+	return nil
+}
+
+// Addr returns the address the server is listening on.
+func (s *Server) Addr() *net.TCPAddr {
+	return s.ln.Addr().(*net.TCPAddr)
+}
+
+// Close stops listening and drops all clients.
+func (s *Server) Close() error {
+	s.Disconnect()
+	return s.ln.Close()
+}
+
+// Disconnect drops all connected clients, the server keeps listening.
+func (s *Server) Disconnect() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn := range s.conns {
+		conn.Close()
+		delete(s.conns, conn)
+	}
+}
+
+// Clients returns the number of connected clients.
+func (s *Server) Clients() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.conns)
+}
+
+// Events returns a copy of all recorded events.
+func (s *Server) Events() []Event {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Event(nil), s.events...)
+}
+
+// Encodings returns the encodings last set by a client.
+func (s *Server) Encodings() []int32 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]int32(nil), s.encodings...)
+}
+
+// SetFramebuffer changes the framebuffer, it's sent to the clients
+// waiting for an incremental update right away.
+func (s *Server) SetFramebuffer(img image.Image) {
+	s.mu.Lock()
+	s.framebuffer = img
+	s.version++
+	s.mu.Unlock()
+	s.sendPending()
+}
+
+// MovePointer moves the pointer, as if it was moved on the server. The position
+// is sent to the clients supporting the PointerPos pseudo-encoding with their
+// next framebuffer update, right away if they are waiting for one.
+func (s *Server) MovePointer(x, y uint16) {
+	s.mu.Lock()
+	s.pointer = image.Pt(int(x), int(y))
+	s.pointerVersion++
+	s.mu.Unlock()
+	s.sendPending()
+}
+
+// Reset drops all recorded events.
+func (s *Server) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = nil
+}
+
+// WaitEvents waits until at least n events are recorded and returns them.
+func (s *Server) WaitEvents(n int, timeout time.Duration) ([]Event, error) {
+	deadline := time.After(timeout)
+	for {
+		s.mu.Lock()
+		events := append([]Event(nil), s.events...)
+		notify := s.notify
+		s.mu.Unlock()
+		if len(events) >= n {
+			return events, nil
+		}
+		select {
+		case <-notify:
+		case <-deadline:
+			return events, fmt.Errorf("timed out waiting for %v events, got %v", n, len(events))
+		}
+	}
+}
+
+func (s *Server) serve() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		c := newClient(conn)
+		s.mu.Lock()
+		s.conns[conn] = c
+		s.mu.Unlock()
+		go s.handle(c)
+	}
+}
+
+func (s *Server) handle(c *client) {
+	conn := c.conn
+	l := s.l.WithField("client", conn.RemoteAddr().String())
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+	if err := s.handshake(c); err != nil {
+		l.WithError(err).Warn("handshake failed")
+		return
+	}
+	l.Info("client connected")
+	for received := 0; s.c.DisconnectAfter == 0 || received < s.c.DisconnectAfter; {
+		e, err := s.readMessage(c)
+		if err != nil {
+			if err != io.EOF {
+				l.WithError(err).Warn("failed reading client message")
+			}
+			break
+		}
+		if e == nil {
+			continue
+		}
+		l.Info(e)
+		s.record(*e)
+		received++
+	}
+	l.Info("client disconnected")
+}
+
+func (s *Server) record(e Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, e)
+	close(s.notify)
+	s.notify = make(chan struct{})
+}
+
+func (s *Server) handshake(c *client) error {
+	conn := c.conn
+	// ProtocolVersion
+	if err := s.write(conn, []byte(s.c.ProtocolVersion)); err != nil {
+		return err
+	}
+	var version [12]byte
+	if err := s.read(conn, &version); err != nil {
+		return err
+	}
+	is33 := string(version[:]) == ProtocolVersion33
+
+	// Security
+	secType := secTypeNone
+	if s.c.Password != "" {
+		secType = secTypeVNCAuth
+	}
+	if s.c.RejectReason != "" {
+		if is33 {
+			s.write(conn, uint32(secTypeInvalid))
+		} else {
+			s.write(conn, []uint8{0})
+		}
+		s.writeReason(conn, s.c.RejectReason)
+		return fmt.Errorf("rejected: %v", s.c.RejectReason)
+	}
+	if is33 {
+		if err := s.write(conn, uint32(secType)); err != nil {
+			return err
+		}
+	} else {
+		if err := s.write(conn, []uint8{1, secType}); err != nil {
+			return err
+		}
+		var chosen uint8
+		if err := s.read(conn, &chosen); err != nil {
+			return err
+		}
+		if chosen != secType {
+			return fmt.Errorf("client chose unsupported security type %v", chosen)
+		}
+	}
+
+	// SecurityResult
+	if secType == secTypeVNCAuth {
+		if err := s.authenticate(conn, is33); err != nil {
+			return err
+		}
+	} else if !is33 && s.c.SecurityResultForNone {
+		if err := s.write(conn, uint32(0)); err != nil {
+			return err
+		}
+	}
+
+	// ClientInit, ServerInit
+	var shared uint8
+	if err := s.read(conn, &shared); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	c.size = s.size(s.framebuffer)
+	s.mu.Unlock()
+	init := vnc.ServerInit{
+		FBWidth:     uint16(c.size.X),
+		FBHeight:    uint16(c.size.Y),
+		PixelFormat: PixelFormat,
+		NameLength:  uint32(len(s.c.Name)),
+	}
+	if err := s.write(conn, init); err != nil {
+		return err
+	}
+	return s.write(conn, []byte(s.c.Name))
+}
+
+func (s *Server) authenticate(conn net.Conn, is33 bool) error {
+	challenge := make([]byte, 16)
+	if _, err := rand.Read(challenge); err != nil {
+		return err
+	}
+	if err := s.write(conn, challenge); err != nil {
+		return err
+	}
+	response := make([]byte, 16)
+	if err := s.read(conn, response); err != nil {
+		return err
+	}
+	expected, err := vncAuthEncode(s.c.Password, challenge)
+	if err != nil {
+		return err
+	}
+	if string(response) != string(expected) {
+		s.write(conn, uint32(1))
+		if !is33 {
+			s.writeReason(conn, "authentication failed")
+		}
+		return fmt.Errorf("authentication failed")
+	}
+	return s.write(conn, uint32(0))
+}
+
+// vncAuthEncode encrypts the challenge with the password
+// as described in RFC 6143 §7.2.2.
+func vncAuthEncode(password string, challenge []byte) ([]byte, error) {
+	key := make([]byte, 8)
+	copy(key, password)
+	// each key byte is bit reversed, this is not documented in the RFC
+	for i := range key {
+		key[i] = (key[i]&0x55)<<1 | (key[i]&0xAA)>>1
+		key[i] = (key[i]&0x33)<<2 | (key[i]&0xCC)>>2
+		key[i] = (key[i]&0x0F)<<4 | (key[i]&0xF0)>>4
+	}
+	cipher, err := des.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	encoded := make([]byte, len(challenge))
+	for i := 0; i < len(challenge); i += cipher.BlockSize() {
+		cipher.Encrypt(encoded[i:i+cipher.BlockSize()], challenge[i:i+cipher.BlockSize()])
+	}
+	return encoded, nil
+}
+
+// readMessage reads a single client message, returning an Event
+// for input messages and nil for all others.
+func (s *Server) readMessage(c *client) (*Event, error) {
+	conn := c.conn
+	time.Sleep(s.c.ReadDelay)
+	var msgType messages.ClientMessage
+	if err := s.read(conn, &msgType); err != nil {
+		return nil, err
+	}
+	switch msgType {
+	case messages.SetPixelFormat:
+		var msg struct {
+			_  [3]byte
+			PF vnc.PixelFormat
+		}
+		return nil, s.read(conn, &msg)
+	case messages.SetEncodings:
+		var msg struct {
+			_       [1]byte
+			NumEncs uint16
+		}
+		if err := s.read(conn, &msg); err != nil {
+			return nil, err
+		}
+		encs := make([]int32, msg.NumEncs)
+		if err := s.read(conn, encs); err != nil {
+			return nil, err
+		}
+		s.mu.Lock()
+		s.encodings = encs
+		s.mu.Unlock()
+		c.encodings = map[int32]bool{}
+		for _, enc := range encs {
+			c.encodings[enc] = true
+		}
+		return nil, nil
+	case messages.FramebufferUpdateRequest:
+		var msg struct {
+			Inc           rfbflags.RFBFlag
+			X, Y          uint16
+			Width, Height uint16
+		}
+		if err := s.read(conn, &msg); err != nil {
+			return nil, err
+		}
+		region := image.Rect(int(msg.X), int(msg.Y), int(msg.X)+int(msg.Width), int(msg.Y)+int(msg.Height))
+		return nil, s.requestUpdate(c, rfbflags.ToBool(msg.Inc), region)
+	case messages.KeyEvent:
+		var msg struct {
+			Down rfbflags.RFBFlag
+			_    [2]byte
+			Key  uint32
+		}
+		if err := s.read(conn, &msg); err != nil {
+			return nil, err
+		}
+		return &Event{Type: msgType, Key: msg.Key, Down: rfbflags.ToBool(msg.Down), Time: time.Now()}, nil
+	case messages.PointerEvent:
+		var msg struct {
+			Mask uint8
+			X, Y uint16
+		}
+		if err := s.read(conn, &msg); err != nil {
+			return nil, err
+		}
+		return &Event{Type: msgType, Mask: msg.Mask, X: msg.X, Y: msg.Y, Time: time.Now()}, nil
+	case messages.ClientCutText:
+		var msg struct {
+			_      [3]byte
+			Length uint32
+		}
+		if err := s.read(conn, &msg); err != nil {
+			return nil, err
+		}
+		text := make([]byte, msg.Length)
+		if err := s.read(conn, text); err != nil {
+			return nil, err
+		}
+		return &Event{Type: msgType, Text: string(text), Time: time.Now()}, nil
+	}
+	return nil, fmt.Errorf("unsupported client message type %v", msgType)
+}
+
+func (s *Server) read(conn net.Conn, data interface{}) error {
+	return binary.Read(conn, binary.BigEndian, data)
+}
+
+func (s *Server) write(conn net.Conn, data interface{}) error {
+	time.Sleep(s.c.WriteDelay)
+	return binary.Write(conn, binary.BigEndian, data)
+}
+
+func (s *Server) writeReason(conn net.Conn, reason string) error {
+	if err := s.write(conn, uint32(len(reason))); err != nil {
+		return err
+	}
+	return s.write(conn, []byte(reason))
+}
+
+// PixelFormat is the 32 bit true color pixel format the server reports.
+var PixelFormat = vnc.PixelFormat{
+	BPP:        32,
+	Depth:      24,
+	BigEndian:  rfbflags.RFBFalse,
+	TrueColor:  rfbflags.RFBTrue,
+	RedMax:     255,
+	GreenMax:   255,
+	BlueMax:    255,
+	RedShift:   16,
+	GreenShift: 8,
+	BlueShift:  0,
+}
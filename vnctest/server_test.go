@@ -0,0 +1,143 @@
+package vnctest
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/kward/go-vnc"
+	"github.com/kward/go-vnc/messages"
+	"github.com/sirupsen/logrus"
+)
+
+func newTestServer(t *testing.T, c Config) *Server {
+	logger := logrus.New()
+	logger.SetLevel(logrus.PanicLevel)
+	s := NewServer(logger, c)
+	if err := s.Listen(""); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func connect(s *Server, pw string) (*vnc.ClientConn, error) {
+	nc, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		return nil, err
+	}
+	return vnc.Connect(context.Background(), nc, vnc.NewClientConfig(pw))
+}
+
+func TestServer_handshake(t *testing.T) {
+	tests := []struct {
+		name    string
+		c       Config
+		pw      string
+		wantErr bool
+	}{
+		{"3.8 none", Config{}, "", false},
+		{"3.3 none", Config{ProtocolVersion: ProtocolVersion33}, "", false},
+		{"3.8 vnc auth", Config{Password: "test123"}, "test123", false},
+		{"3.3 vnc auth", Config{ProtocolVersion: ProtocolVersion33, Password: "test123"}, "test123", false},
+		{"3.8 wrong password", Config{Password: "test123"}, "wrong", true},
+		{"3.3 wrong password", Config{ProtocolVersion: ProtocolVersion33, Password: "test123"}, "wrong", true},
+		{"3.8 rejected", Config{RejectReason: "too many clients"}, "", true},
+		{"3.3 rejected", Config{ProtocolVersion: ProtocolVersion33, RejectReason: "too many clients"}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.c.Width, tt.c.Height, tt.c.Name = 1440, 900, "mac"
+			s := newTestServer(t, tt.c)
+			defer s.Close()
+			vc, err := connect(s, tt.pw)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Connect() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			defer vc.Close()
+			if vc.FramebufferWidth() != 1440 || vc.FramebufferHeight() != 900 {
+				t.Errorf("framebuffer = %vx%v, want 1440x900", vc.FramebufferWidth(), vc.FramebufferHeight())
+			}
+			if vc.DesktopName() != "mac" {
+				t.Errorf("desktop name = %q, want %q", vc.DesktopName(), "mac")
+			}
+		})
+	}
+}
+
+func TestServer_events(t *testing.T) {
+	s := newTestServer(t, Config{Width: 800, Height: 600})
+	defer s.Close()
+	vc, err := connect(s, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vc.Close()
+	vc.KeyEvent(0x61, true)
+	vc.KeyEvent(0x61, false)
+	vc.PointerEvent(1, 10, 20)
+	vc.ClientCutText("hello")
+
+	got, err := s.WaitEvents(4, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Event{
+		{Type: messages.KeyEvent, Key: 0x61, Down: true},
+		{Type: messages.KeyEvent, Key: 0x61, Down: false},
+		{Type: messages.PointerEvent, Mask: 1, X: 10, Y: 20},
+		{Type: messages.ClientCutText, Text: "hello"},
+	}
+	for i := range got {
+		got[i].Time = time.Time{}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("events = %v, want %v", got, want)
+	}
+	if len(s.Encodings()) == 0 {
+		t.Errorf("no encodings recorded")
+	}
+}
+
+func TestServer_disconnect(t *testing.T) {
+	s := newTestServer(t, Config{DisconnectAfter: 2})
+	defer s.Close()
+	vc, err := connect(s, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vc.Close()
+	vc.KeyEvent(0x61, true)
+	vc.KeyEvent(0x61, false)
+	if _, err := s.WaitEvents(2, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	// the closed connection surfaces as a write error eventually
+	deadline := time.Now().Add(time.Second)
+	for vc.KeyEvent(0x61, true) == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("no error writing to disconnected server")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestServer_writeDelay(t *testing.T) {
+	delay := 20 * time.Millisecond
+	s := newTestServer(t, Config{WriteDelay: delay})
+	defer s.Close()
+	start := time.Now()
+	vc, err := connect(s, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vc.Close()
+	// protocol version, security types and server init are written
+	if elapsed := time.Since(start); elapsed < 3*delay {
+		t.Errorf("handshake took %v, want at least %v", elapsed, 3*delay)
+	}
+}
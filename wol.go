@@ -0,0 +1,99 @@
+package i2vnc
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"time"
+)
+
+const (
+	defaultWolBroadcast = "255.255.255.255:9"
+	defaultWolWakeSec   = 30
+	// wolRetryInterval is waited between the connects to a waking remote
+	wolRetryInterval = 500 * time.Millisecond
+)
+
+// wolConfig wakes a sleeping remote with a Wake-on-LAN magic packet.
+type wolConfig struct {
+	// Mac is the MAC address of the remote, Wake-on-LAN is disabled if empty.
+	Mac string `yaml:"mac"`
+	// Broadcast is the address the magic packet is sent to,
+	// 255.255.255.255:9 if empty, port 9 if it has no port.
+	Broadcast string `yaml:"broadcast"`
+	// Always sends the magic packet before every connect,
+	// instead of only after a failed one.
+	Always bool `yaml:"always"`
+	// WakeSec is how long the connect is retried after sending
+	// the magic packet, 30 if unset.
+	WakeSec int `yaml:"wakeSec"`
+}
+
+func (c wolConfig) enabled() bool {
+	return c.Mac != ""
+}
+
+func (c wolConfig) validate() error {
+	if !c.enabled() {
+		return nil
+	}
+	if _, err := parseMAC(c.Mac); err != nil {
+		return err
+	}
+	if _, err := net.ResolveUDPAddr("udp", c.broadcast()); err != nil {
+		return fmt.Errorf("invalid wol broadcast address %q: %s", c.Broadcast, err)
+	}
+	if c.WakeSec < 0 {
+		return fmt.Errorf("wol wake time can't be negative")
+	}
+	return nil
+}
+
+func (c wolConfig) broadcast() string {
+	if c.Broadcast == "" {
+		return defaultWolBroadcast
+	}
+	if _, _, err := net.SplitHostPort(c.Broadcast); err != nil {
+		return net.JoinHostPort(c.Broadcast, "9")
+	}
+	return c.Broadcast
+}
+
+func (c wolConfig) wakeWindow() time.Duration {
+	if c.WakeSec == 0 {
+		return defaultWolWakeSec * time.Second
+	}
+	return time.Duration(c.WakeSec) * time.Second
+}
+
+func parseMAC(s string) (net.HardwareAddr, error) {
+	mac, err := net.ParseMAC(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid wol mac address %q: %s", s, err)
+	}
+	if len(mac) != 6 {
+		return nil, fmt.Errorf("invalid wol mac address %q: not a 48-bit address", s)
+	}
+	return mac, nil
+}
+
+// magicPacket is six 0xff bytes followed by the MAC address sixteen times.
+func magicPacket(mac net.HardwareAddr) []byte {
+	packet := bytes.Repeat([]byte{0xff}, 6)
+	return append(packet, bytes.Repeat(mac, 16)...)
+}
+
+// sendMagicPacket sends the magic packet waking the remote.
+func sendMagicPacket(c wolConfig) error {
+	mac, err := parseMAC(c.Mac)
+	if err != nil {
+		return err
+	}
+	conn, err := net.Dial("udp", c.broadcast())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write(magicPacket(mac))
+	return err
+}
@@ -0,0 +1,62 @@
+package i2vnc
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func Test_wolConfig_validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		c       wolConfig
+		wantErr bool
+	}{
+		{"disabled", wolConfig{}, false},
+		{"mac", wolConfig{Mac: "aa:bb:cc:dd:ee:ff"}, false},
+		{"broadcast without port", wolConfig{Mac: "aa:bb:cc:dd:ee:ff", Broadcast: "192.168.0.255"}, false},
+		{"invalid mac", wolConfig{Mac: "aa:bb:cc"}, true},
+		{"64-bit mac", wolConfig{Mac: "aa:bb:cc:dd:ee:ff:00:11"}, true},
+		{"invalid broadcast", wolConfig{Mac: "aa:bb:cc:dd:ee:ff", Broadcast: "192.168.0.255:port"}, true},
+		{"negative wake time", wolConfig{Mac: "aa:bb:cc:dd:ee:ff", WakeSec: -1}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.c.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_wolConfig_broadcast(t *testing.T) {
+	tests := []struct {
+		broadcast string
+		want      string
+	}{
+		{"", "255.255.255.255:9"},
+		{"192.168.0.255", "192.168.0.255:9"},
+		{"192.168.0.255:7", "192.168.0.255:7"},
+	}
+	for _, tt := range tests {
+		if got := (wolConfig{Broadcast: tt.broadcast}).broadcast(); got != tt.want {
+			t.Errorf("broadcast() of %q = %v, want %v", tt.broadcast, got, tt.want)
+		}
+	}
+}
+
+func Test_magicPacket(t *testing.T) {
+	mac, _ := net.ParseMAC("01:02:03:04:05:06")
+	packet := magicPacket(mac)
+	if len(packet) != 102 {
+		t.Fatalf("magicPacket() length = %v, want 102", len(packet))
+	}
+	if !bytes.Equal(packet[:6], bytes.Repeat([]byte{0xff}, 6)) {
+		t.Errorf("magicPacket() header = %x", packet[:6])
+	}
+	for i := 6; i < len(packet); i += 6 {
+		if !bytes.Equal(packet[i:i+6], mac) {
+			t.Errorf("magicPacket() repetition at %v = %x, want %x", i, packet[i:i+6], []byte(mac))
+		}
+	}
+}
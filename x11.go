@@ -3,7 +3,9 @@ package i2vnc
 import (
 	"fmt"
 	"strings"
+	"sync"
 
+	"github.com/BurntSushi/xgb/randr"
 	"github.com/BurntSushi/xgb/xproto"
 	"github.com/BurntSushi/xgbutil"
 	"github.com/BurntSushi/xgbutil/keybind"
@@ -14,42 +16,116 @@ import (
 )
 
 type X11Input struct {
-	l       *logrus.Entry
-	xu      *xgbutil.XUtil
-	r       Remote
-	c       Config
-	ci      configItem
-	e       *event
-	forever bool
+	*inputHandler
+	xu *xgbutil.XUtil
+	// xi2 is nil if the X server has no XInput2
+	xi2     *x11.XI2
+	devices map[uint16]x11.Device
+	// with XInput2 the relative motion is read from the raw events and the
+	// local pointer isn't warped, these are the last core pointer position,
+	// whether the last raw motion came from an absolute device,
+	// and the fractions of raw motion not sent yet
+	pointerX, pointerY int16
+	absoluteSource     bool
+	restX, restY       float64
+	// view is the window showing the remote in view mode, nil otherwise
+	view *x11.Viewer
+	// randr is nil if the X server has no RandR, the whole screen
+	// is a single monitor then
+	randr *x11.RandR
+	// monitor is the local monitor the pointer is kept on,
+	// the local screen is its size
+	monitor x11.Monitor
+	// monitorName is the output name of the monitor picked, if set
+	monitorName string
+	overlay     *x11.Overlay
+	// released are the passive grabs of the release hotkey while the grab
+	// is released, nil while grabbed
+	released []keyGrab
+	// passiveMode only grabs the hotkeys until one is pressed, the input
+	// is actively grabbed while active
+	passiveMode bool
+	active      bool
+	hotkeyGrabs []keyGrab
+	// posted are the funcs run on the event loop, and stopped is closed
+	// when it returns, both are nil while it isn't running
+	loopMu  sync.Mutex
+	posted  chan func()
+	stopped chan struct{}
 }
 
 func NewX11Input(logger *logrus.Logger, r Remote, c Config, forever bool) (*X11Input, error) {
+	return newX11Input(logger, r, c, forever, "")
+}
+
+// newX11Input connects to the given X display, an empty display uses $DISPLAY.
+func newX11Input(logger *logrus.Logger, r Remote, c Config, forever bool, display string) (*X11Input, error) {
 	l := logrus.NewEntry(logger)
 	// create X connection
 	l.Infof("connecting to X server")
-	xu, err := xgbutil.NewConn()
+	xu, err := xgbutil.NewConnDisplay(display)
 	if err != nil {
 		return nil, err
 	}
-	ci := configItem{}
-	e := newEvent(ci.getConfigMaps(), ci.ScrollSpeed)
-	return &X11Input{l, xu, r, c, ci, e, forever}, nil
+	i := &X11Input{xu: xu}
+	i.inputHandler = newInputHandler(l, i, r, c, forever)
+	if i.xi2, err = x11.NewXI2(display); err != nil {
+		l.WithError(err).Warn("XInput2 unavailable, falling back to pointer warping, smooth scrolling disabled")
+		i.xi2 = nil
+	}
+	if i.randr, err = x11.NewRandR(xu.Conn()); err != nil {
+		l.WithError(err).Warn("RandR unavailable, using the whole screen as a single monitor")
+		i.randr = nil
+	}
+	i.updateMonitor()
+	return i, nil
+}
+
+type grabConfig struct {
+	// Passive only grabs the hotkeys until one is pressed, leaving
+	// the local desktop usable, instead of grabbing the whole input.
+	Passive bool `yaml:"passive"`
+	// Monitor is the output name of the local monitor the pointer is kept on,
+	// like DP-1. The one the pointer is on, or the primary one, if unset.
+	Monitor string `yaml:"monitor"`
+}
+
+// SetMonitor keeps the pointer on the local monitor of the output name,
+// instead of the one the pointer is on.
+func (i *X11Input) SetMonitor(name string) {
+	i.monitorName = name
+	i.updateMonitor()
+}
+
+// SetPassive only grabs the hotkeys, instead of the whole input.
+// The input is grabbed once a hotkey is pressed, until it's released
+// or disconnected with a hotkey.
+func (i *X11Input) SetPassive(passive bool) {
+	i.passiveMode = passive
 }
 
 func (i *X11Input) Grab() error {
-	i.l.Infof("grabbing input")
+	if i.view != nil {
+		if i.passiveMode {
+			return fmt.Errorf("passive grab mode doesn't work in view mode")
+		}
+		return i.grabView()
+	}
 	// use current root window
 	w := i.xu.RootWin()
 
-	// grab keyboard and pointer
 	keybind.Initialize(i.xu)
-	if err := keybind.GrabKeyboard(i.xu, w); err != nil {
-		return fmt.Errorf("could not grab keyboard: %s", err)
-	}
 	mousebind.Initialize(i.xu)
-	if grabbed, err := mousebind.GrabPointer(i.xu, w, xproto.WindowNone,
-		xproto.CursorNone); !grabbed {
-		return fmt.Errorf("could not grab pointer: %s", err)
+	if i.passiveMode {
+		i.l.Infof("grabbing hotkeys")
+		if err := i.grabHotkeys(); err != nil {
+			return err
+		}
+	} else {
+		i.l.Infof("grabbing input")
+		if err := i.grabInput(); err != nil {
+			return err
+		}
 	}
 
 	// connect event handlers
@@ -58,15 +134,37 @@ func (i *X11Input) Grab() error {
 	xevent.ButtonPressFun(i.handleButtonPress).Connect(i.xu, w)
 	xevent.ButtonReleaseFun(i.handleButtonRelease).Connect(i.xu, w)
 	xevent.MotionNotifyFun(i.handleMotionNotify).Connect(i.xu, w)
+	if i.xi2 != nil {
+		// raw events are sent regardless of the grabs
+		err := i.xi2.SelectEvents(w, x11.XIAllMasterDevices, x11.XIRawButtonPress, x11.XIRawMotion)
+		if err != nil {
+			i.l.WithError(err).Warn("could not select XInput2 events, falling back to pointer warping, smooth scrolling disabled")
+			i.xi2.Close()
+			i.xi2 = nil
+		}
+	}
+	if i.randr != nil {
+		if err := i.randr.SelectScreenChange(w); err != nil {
+			i.l.WithError(err).Warn("could not select RandR events, monitor changes won't be noticed")
+		} else {
+			xevent.HookFun(i.handleScreenChange).Connect(i.xu)
+		}
+	}
 
+	if i.passiveMode {
+		i.notify(Status{})
+		i.l.Infof("waiting for a hotkey")
+		i.eventLoop()
+		return nil
+	}
 	// set the local pointer to the middle of local screen
-	i.warpPointer(int16(i.xu.Screen().WidthInPixels/2), int16(i.xu.Screen().HeightInPixels/2))
+	i.centerPointer()
 	// set the remote pointer to the middle of remote screen
 	i.r.SendPointerEvent("Motion", 0, i.e.remote.X, i.e.remote.Y, true)
 
+	i.notify(Status{Grabbed: true})
 	i.l.Infof("grabbed! press a hotkey to connect")
-	// start X event loop
-	xevent.Main(i.xu)
+	i.eventLoop()
 	return nil
 }
 
@@ -75,38 +173,334 @@ func (i *X11Input) Ungrab() error {
 	return nil
 }
 
-func (i *X11Input) Screen() Screen {
-	return Screen{i.xu.Screen().WidthInPixels, i.xu.Screen().HeightInPixels}
+// grabInput actively grabs the keyboard and pointer.
+func (i *X11Input) grabInput() error {
+	w := i.xu.RootWin()
+	if err := keybind.GrabKeyboard(i.xu, w); err != nil {
+		return fmt.Errorf("could not grab keyboard: %s", err)
+	}
+	if grabbed, err := mousebind.GrabPointer(i.xu, w, xproto.WindowNone,
+		xproto.CursorNone); !grabbed {
+		keybind.UngrabKeyboard(i.xu)
+		return fmt.Errorf("could not grab pointer: %s", err)
+	}
+	return nil
 }
 
-func (i *X11Input) switchRemote(cname string) error {
-	if err := i.r.Disconnect(); err != nil {
-		return err
+func (i *X11Input) passive() bool {
+	return i.passiveMode
+}
+
+// grabHotkeys passively grabs the hotkeys of the remotes and the global
+// ones, the first steps of the sequences. The release hotkeys only grab
+// the input again.
+func (i *X11Input) grabHotkeys() error {
+	i.ungrabKeys(i.hotkeyGrabs)
+	i.hotkeyGrabs = nil
+	var hotkeys []hotkeyConfig
+	for _, name := range i.remoteNames() {
+		if i.c[name].Hotkey != "" {
+			hotkeys = append(hotkeys, hotkeyConfig{Keys: i.c[name].Hotkey})
+		}
+	}
+	hotkeys = append(hotkeys, i.hotkeys...)
+	for _, h := range hotkeys {
+		grabs, err := i.grabKeys(sequenceSteps(h.Keys)[0])
+		if err != nil {
+			i.ungrabKeys(i.hotkeyGrabs)
+			i.hotkeyGrabs = nil
+			return err
+		}
+		for n := range grabs {
+			grabs[n].release = h.Action == ActionRelease
+		}
+		i.hotkeyGrabs = append(i.hotkeyGrabs, grabs...)
 	}
-	ci, err := i.c.getItem(cname)
+	return nil
+}
+
+// activate actively grabs the input after a passively grabbed key press.
+// The modifiers of the hotkey are held down, the hotkey is handled
+// unless it's a release hotkey.
+func (i *X11Input) activate(e xevent.KeyPressEvent) {
+	mods := e.State & keyGrabMods
+	for _, m := range xevent.IgnoreMods {
+		mods &^= m
+	}
+	var grab *keyGrab
+	for n, g := range i.hotkeyGrabs {
+		if g.key == e.Detail && g.mods == mods {
+			grab = &i.hotkeyGrabs[n]
+		}
+	}
+	if grab == nil {
+		return
+	}
+	if err := i.grabInput(); err != nil {
+		i.l.WithError(err).Error("could not grab input")
+		return
+	}
+	i.active = true
+	// the pointer is kept on the monitor it's on now
+	screen := i.Screen()
+	i.updateMonitor()
+	if s := i.Screen(); s != screen {
+		i.localResized(s)
+	}
+	i.centerPointer()
+	i.l.Infof("grabbed input")
+	i.notify(i.grabbedStatus())
+	if grab.release {
+		return
+	}
+	i.holdHotkey(grab.keys)
+	i.handleKeyEvent(e.State, e.Detail, true)
+}
+
+// deactivate ungrabs the input, leaving the hotkeys grabbed.
+func (i *X11Input) deactivate() {
+	if !i.active {
+		return
+	}
+	keybind.UngrabKeyboard(i.xu)
+	mousebind.UngrabPointer(i.xu)
+	i.active = false
+	i.l.Infof("ungrabbed input, waiting for a hotkey")
+}
+
+// keyGrabMods are the modifiers of the key event state,
+// without the pointer buttons.
+const keyGrabMods = xproto.ModMaskShift | xproto.ModMaskLock | xproto.ModMaskControl |
+	xproto.ModMask1 | xproto.ModMask2 | xproto.ModMask3 | xproto.ModMask4 | xproto.ModMask5
+
+// keyGrab is a passive grab of a key with modifiers on the root window.
+type keyGrab struct {
+	mods uint16
+	key  xproto.Keycode
+	// keys is the key combination grabbed
+	keys string
+	// release only grabs the input again, in passive grab mode
+	release bool
+}
+
+// grabKeys passively grabs the last key of the combination, with the
+// modifiers of the other keys, so its presses are seen without grabbing
+// the keyboard.
+func (i *X11Input) grabKeys(keys string) ([]keyGrab, error) {
+	defs, err := getConfigDefs(keys, true)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	var mods uint16
+	for _, def := range defs[:len(defs)-1] {
+		for _, kc := range keybind.StrToKeycodes(i.xu, def.Name) {
+			mods |= keybind.ModGet(i.xu, kc)
+		}
+	}
+	last := defs[len(defs)-1]
+	var grabs []keyGrab
+	for _, kc := range keybind.StrToKeycodes(i.xu, last.Name) {
+		if err := keybind.GrabChecked(i.xu, i.xu.RootWin(), mods, kc); err != nil {
+			i.ungrabKeys(grabs)
+			return nil, fmt.Errorf("could not grab %q: %s", keys, err)
+		}
+		grabs = append(grabs, keyGrab{mods: mods, key: kc, keys: keys})
 	}
-	if err := i.r.Connect(cname, ci.timeout); err != nil {
+	if len(grabs) == 0 {
+		return nil, fmt.Errorf("no keycode for %q", last.Name)
+	}
+	return grabs, nil
+}
+
+func (i *X11Input) ungrabKeys(grabs []keyGrab) {
+	for _, g := range grabs {
+		keybind.Ungrab(i.xu, i.xu.RootWin(), g.mods, g.key)
+	}
+}
+
+// release ungrabs the keyboard and pointer until the keys are pressed.
+func (i *X11Input) release(keys string) error {
+	if i.view != nil {
+		return fmt.Errorf("the grab can't be released in view mode")
+	}
+	// the release hotkey is grabbed with the other hotkeys
+	if i.passiveMode {
+		i.deactivate()
+		return nil
+	}
+	grabs, err := i.grabKeys(keys)
+	if err != nil {
 		return err
 	}
-	i.ci = ci
-	i.e = newEvent(ci.getConfigMaps(), ci.ScrollSpeed)
-	// set coords to middle of remote screen
-	remoteScreen := i.r.Screen()
-	i.e.setCoords(remoteScreen.X/2, remoteScreen.Y/2, i.Screen(), remoteScreen)
-	// set the remote pointer to the middle of remote screen
-	i.handlePointerEvent(0, i.e.getButtonForMotion(), int16(i.e.remote.X), int16(i.e.remote.Y), false)
+	keybind.UngrabKeyboard(i.xu)
+	mousebind.UngrabPointer(i.xu)
+	i.released = grabs
+	i.l.Infof("released the grab, press %q to grab again", keys)
+	return nil
+}
 
-	// i.r.SendPointerEvent("motion", 0, i.r.ScreenW()/2, i.r.ScreenH()/2, false)
+// panicUngrab ungrabs the keyboard and pointer, keeping the event loop running.
+func (i *X11Input) panicUngrab() error {
+	if i.view != nil {
+		return nil
+	}
+	i.ungrabKeys(i.released)
+	i.released = nil
+	i.ungrabKeys(i.hotkeyGrabs)
+	i.hotkeyGrabs = nil
+	keybind.UngrabKeyboard(i.xu)
+	mousebind.UngrabPointer(i.xu)
+	// the ungrab requests are sent before the remote is sent anything
+	i.xu.Sync()
 	return nil
 }
 
+// regrab grabs the keyboard and pointer again after a release.
+func (i *X11Input) regrab() {
+	i.ungrabKeys(i.released)
+	i.released = nil
+	w := i.xu.RootWin()
+	if err := keybind.GrabKeyboard(i.xu, w); err != nil {
+		i.l.WithError(err).Error("could not grab keyboard")
+	}
+	if grabbed, err := mousebind.GrabPointer(i.xu, w, xproto.WindowNone, xproto.CursorNone); !grabbed {
+		i.l.WithError(err).Error("could not grab pointer")
+	}
+	i.centerPointer()
+	i.l.Infof("grabbed again")
+	i.notify(i.grabbedStatus())
+}
+
+// lockState returns the local lock states from the keyboard LEDs,
+// the first three are the caps, num and scroll lock ones.
+func (i *X11Input) lockState() (Locks, error) {
+	reply, err := xproto.GetKeyboardControl(i.xu.Conn()).Reply()
+	if err != nil {
+		return Locks{}, err
+	}
+	return Locks{CapsLock: reply.LedMask&1 != 0, NumLock: reply.LedMask&2 != 0,
+		ScrollLock: reply.LedMask&4 != 0}, nil
+}
+
+func (i *X11Input) Screen() Screen {
+	if i.view != nil {
+		width, height := i.view.Size()
+		return Screen{width, height}
+	}
+	return Screen{i.monitor.Width, i.monitor.Height}
+}
+
+// updateMonitor picks the local monitor, the one named, the one
+// the pointer is on, or the primary one.
+func (i *X11Input) updateMonitor() {
+	m := x11.Monitor{Width: i.xu.Screen().WidthInPixels, Height: i.xu.Screen().HeightInPixels}
+	if i.randr != nil {
+		monitors, err := i.randr.Monitors(i.xu.RootWin())
+		if err != nil {
+			i.l.WithError(err).Warn("failed querying RandR monitors, using the whole screen")
+		} else {
+			var x, y int16
+			if p, err := xproto.QueryPointer(i.xu.Conn(), i.xu.RootWin()).Reply(); err == nil {
+				x, y = p.RootX, p.RootY
+			}
+			found, ok := x11.MonitorByName(monitors, i.monitorName)
+			if !ok {
+				if i.monitorName != "" {
+					i.l.Warnf("local monitor %q not found", i.monitorName)
+				}
+				found, ok = x11.FindMonitor(monitors, x, y)
+			}
+			if ok {
+				m = found
+			}
+			i.l.Infof("found %v local monitors, using %v", len(monitors), m)
+		}
+	}
+	i.monitor = m
+	if i.overlay != nil {
+		i.overlay.SetMonitor(m)
+	}
+}
+
+// handleScreenChange picks the local monitor again,
+// after the monitor layout changed.
+func (i *X11Input) handleScreenChange(xu *xgbutil.XUtil, ev interface{}) bool {
+	if _, ok := ev.(randr.ScreenChangeNotifyEvent); !ok {
+		return true
+	}
+	screen := i.Screen()
+	i.updateMonitor()
+	if s := i.Screen(); s != screen {
+		i.localResized(s)
+	}
+	if !i.e.absolute {
+		i.centerPointer()
+	}
+	return false
+}
+
 func (i *X11Input) warpPointer(x, y int16) {
 	xproto.WarpPointer(i.xu.Conn(), xproto.WindowNone, i.xu.RootWin(), 0, 0, 0, 0, x, y)
 }
 
+func (i *X11Input) centerPointer() {
+	i.pointerX, i.pointerY = i.center()
+	i.warpPointer(i.pointerX, i.pointerY)
+}
+
+// center returns the center of the local monitor, in root window coordinates.
+func (i *X11Input) center() (int16, int16) {
+	return i.monitor.X + int16(i.monitor.Width/2), i.monitor.Y + int16(i.monitor.Height/2)
+}
+
+// local turns root window coordinates into coordinates on the local monitor,
+// the coordinates of the view window are passed as they are.
+func (i *X11Input) local(x, y int16) (int16, int16) {
+	if i.view != nil {
+		return x, y
+	}
+	return int16(clampRange(int(x)-int(i.monitor.X), 0, int(i.monitor.Width)-1)),
+		int16(clampRange(int(y)-int(i.monitor.Y), 0, int(i.monitor.Height)-1))
+}
+
+// rawMotion reports whether the relative pointer motion is read
+// from the XInput2 raw events, instead of warping the local pointer.
+func (i *X11Input) rawMotion() bool {
+	return i.xi2 != nil && !i.e.absolute
+}
+
+// buttonCoords returns the coordinates to send a button event with,
+// with raw motion the local pointer position isn't a motion delta.
+func (i *X11Input) buttonCoords(x, y int16) (int16, int16) {
+	if i.rawMotion() {
+		return i.center()
+	}
+	return x, y
+}
+
+// moveBy sends a relative pointer motion of dx, dy local pixels.
+func (i *X11Input) moveBy(dx, dy float64) {
+	var x, y int
+	x, i.restX = accumulate(dx, i.restX)
+	y, i.restY = accumulate(dy, i.restY)
+	if x == 0 && y == 0 {
+		return
+	}
+	cx, cy := i.center()
+	lx, ly := i.local(cx+int16(x), cy+int16(y))
+	i.handlePointerEvent(0, i.e.getButtonForMotion(), lx, ly, i.e.getCurrentIsPress())
+}
+
 func (i *X11Input) handleKeyPress(xu *xgbutil.XUtil, e xevent.KeyPressEvent) {
+	// while released only the release hotkey is grabbed
+	if i.released != nil {
+		i.regrab()
+		return
+	}
+	if i.passiveMode && !i.active {
+		i.activate(e)
+		return
+	}
 	i.handleKeyEvent(e.State, e.Detail, true)
 }
 
@@ -115,28 +509,175 @@ func (i *X11Input) handleKeyRelease(xu *xgbutil.XUtil, e xevent.KeyReleaseEvent)
 }
 
 func (i *X11Input) handleButtonPress(xu *xgbutil.XUtil, e xevent.ButtonPressEvent) {
-	i.handlePointerEvent(e.State, uint8(e.Detail), e.EventX, e.EventY, true)
+	if i.smoothScroll() && isScrollButton(uint8(e.Detail)) {
+		return
+	}
+	x, y := i.local(i.buttonCoords(e.EventX, e.EventY))
+	i.handlePointerEvent(e.State, uint8(e.Detail), x, y, true)
 }
 
 func (i *X11Input) handleButtonRelease(xu *xgbutil.XUtil, e xevent.ButtonReleaseEvent) {
-	i.handlePointerEvent(e.State, uint8(e.Detail), e.EventX, e.EventY, false)
+	if i.smoothScroll() && isScrollButton(uint8(e.Detail)) {
+		return
+	}
+	x, y := i.local(i.buttonCoords(e.EventX, e.EventY))
+	i.handlePointerEvent(e.State, uint8(e.Detail), x, y, false)
 }
 
 func (i *X11Input) handleMotionNotify(xu *xgbutil.XUtil, e xevent.MotionNotifyEvent) {
+	if i.rawMotion() {
+		// absolute devices, like tablets, have no raw motion deltas,
+		// their motion is the change of the local pointer position
+		dx, dy := e.RootX-i.pointerX, e.RootY-i.pointerY
+		i.pointerX, i.pointerY = e.RootX, e.RootY
+		if i.absoluteSource {
+			i.moveBy(float64(dx), float64(dy))
+		}
+		return
+	}
 	// limit number of motion events,
 	// large number can make handler lag
 	e = x11.CompressMotionNotify(xu, e)
+	x, y := i.local(e.EventX, e.EventY)
 
 	// activate warp only if there are changes to prevX or prevY
 	// avoids the endless motionNotifyEvent loop
-	if e.EventX != int16(i.e.local.X) || e.EventY != int16(i.e.local.Y) {
+	// in absolute mode the local pointer moves freely
+	if !i.e.absolute && (x != int16(i.e.local.X) || y != int16(i.e.local.Y)) {
 		// keeps the cursor in the local screen center.
 		// needed for hitting the end on local screens while using a larger remote screen
-		i.warpPointer(int16(i.xu.Screen().WidthInPixels/2), int16(i.xu.Screen().HeightInPixels/2))
+		i.centerPointer()
 	}
 	// the current button and isPress must be sent along with
 	// motion events in order for drag to work
-	i.handlePointerEvent(e.State, i.e.getButtonForMotion(), e.EventX, e.EventY, i.e.getCurrentIsPress())
+	i.handlePointerEvent(e.State, i.e.getButtonForMotion(), x, y, i.e.getCurrentIsPress())
+}
+
+// smoothScroll reports whether scrolling is read from the XInput2 raw events,
+// instead of the wheel buttons.
+func (i *X11Input) smoothScroll() bool {
+	return i.xi2 != nil && i.ci.Scroll.Smooth
+}
+
+// eventLoop runs the X event loop until the input is ungrabbed. The XInput2
+// raw events are read from their own connection, they're handled
+// in between the X events.
+func (i *X11Input) eventLoop() {
+	var raw <-chan x11.RawEvent
+	if i.xi2 != nil {
+		raw = i.xi2.Events()
+	}
+	posted, stopped := make(chan func()), make(chan struct{})
+	i.loopMu.Lock()
+	i.posted, i.stopped = posted, stopped
+	i.loopMu.Unlock()
+	defer func() {
+		i.loopMu.Lock()
+		i.posted, i.stopped = nil, nil
+		i.loopMu.Unlock()
+		close(stopped)
+	}()
+	before, after, quit := xevent.MainPing(i.xu)
+	for {
+		select {
+		case <-before:
+			<-after
+		case f := <-posted:
+			f()
+		case re, ok := <-raw:
+			if !ok {
+				raw = nil
+				continue
+			}
+			i.handleRawEvent(re)
+		case <-quit:
+			return
+		}
+		// the event loop only notices quitting after its next X event
+		if xevent.Quitting(i.xu) {
+			return
+		}
+	}
+}
+
+// post runs f on the event loop, in between the X events.
+func (i *X11Input) post(f func()) bool {
+	i.loopMu.Lock()
+	posted, stopped := i.posted, i.stopped
+	i.loopMu.Unlock()
+	if posted == nil {
+		return false
+	}
+	select {
+	case posted <- f:
+		return true
+	case <-stopped:
+		return false
+	}
+}
+
+// handleRawEvent handles the XInput2 raw events.
+func (i *X11Input) handleRawEvent(re x11.RawEvent) {
+	// raw events are sent regardless of the grabs
+	if i.released != nil || i.passiveMode && !i.active {
+		return
+	}
+	device := i.device(re.Sourceid)
+	if re.Type == x11.XIRawMotion && i.rawMotion() {
+		i.absoluteSource = device.Absolute
+		dx, dy := re.RawValues[0], re.RawValues[1]
+		if !device.Absolute && (dx != 0 || dy != 0) {
+			i.moveBy(dx, dy)
+		}
+	}
+	if !i.smoothScroll() {
+		return
+	}
+	scroll := device.Scroll
+	switch re.Type {
+	case x11.XIRawButtonPress:
+		// devices with scroll valuators scroll through them,
+		// their wheel buttons are emulated
+		if len(scroll) == 0 && isScrollButton(uint8(re.Detail)) {
+			i.handleClick(uint8(re.Detail))
+		}
+	case x11.XIRawMotion:
+		var dx, dy float64
+		for number, value := range re.Values {
+			s, ok := scroll[number]
+			if !ok || s.Increment == 0 {
+				continue
+			}
+			switch s.Type {
+			case x11.ScrollTypeVertical:
+				dy += value / s.Increment
+			case x11.ScrollTypeHorizontal:
+				dx += value / s.Increment
+			}
+		}
+		if dx != 0 || dy != 0 {
+			i.handleScroll(dx, dy)
+		}
+	}
+}
+
+// device returns the XInput2 device, the devices are queried again
+// when it isn't known, as it might have been plugged in since.
+func (i *X11Input) device(id uint16) x11.Device {
+	if d, ok := i.devices[id]; ok {
+		return d
+	}
+	devices, err := i.xi2.QueryDevices()
+	if err != nil {
+		i.l.WithError(err).Warn("failed querying XInput2 devices")
+		return x11.Device{}
+	}
+	if _, ok := devices[id]; !ok {
+		// remember unknown devices, so they aren't queried on every event
+		devices[id] = x11.Device{ID: id}
+	}
+	i.devices = devices
+	return devices[id]
 }
 
 func (i *X11Input) keysymByState(state uint16, keycode xproto.Keycode) xproto.Keysym {
@@ -174,71 +715,5 @@ func (i *X11Input) keysymByState(state uint16, keycode xproto.Keycode) xproto.Ke
 func (i *X11Input) handleKeyEvent(state uint16, keycode xproto.Keycode, isPress bool) {
 	// DebugX11Event(i.l, "X11Input", state, keycode, 0, 0, 0, isPress)
 	keysym := i.keysymByState(state, keycode)
-	kdef, err := newEventDef(uint32(keysym), 0, true, isPress)
-	if err != nil {
-		i.l.WithError(err).Error("handleKeyEvent failed")
-		return
-	}
-	i.e.handle(*kdef)
-	if i.handleHotkeys() {
-		return
-	}
-	i.sendEvent()
-}
-
-func (i *X11Input) handlePointerEvent(state uint16, button uint8, x, y int16, isPress bool) {
-	// DebugX11Event(i.l, "X11Input", state, 0, button, x, y, isPress)
-	bdef, err := newEventDef(0, button, false, isPress)
-	if err != nil {
-		i.l.WithError(err).Error("handlePointerEvent failed")
-		return
-	}
-	i.e.handle(*bdef)
-
-	i.e.setCoords(uint16(x), uint16(y), i.Screen(), i.r.Screen())
-	i.sendEvent()
-}
-
-func (i *X11Input) sendEvent() {
-	for _, def := range i.e.resolve() {
-		if def.IsKey {
-			if err := i.r.SendKeyEvent(def.Name, def.Key, def.IsPress); err != nil {
-				i.l.Trace(err)
-			}
-		} else {
-			if err := i.r.SendPointerEvent(def.Name, def.Button, i.e.remote.X, i.e.remote.Y, def.IsPress); err != nil {
-				i.l.Trace(err)
-			}
-		}
-	}
-}
-
-func (i *X11Input) hotkeyPressed(cname, hotkey string) bool {
-	hotkeyDefs, err := getConfigDefs(hotkey, true)
-	if err != nil {
-		i.l.WithError(err).Warnf("failed getting hotkey for %q", cname)
-		return false
-	}
-	intersect := edIntersection(hotkeyDefs, i.e.resolve())
-	return len(intersect) == len(hotkeyDefs)
-}
-
-func (i *X11Input) handleHotkeys() bool {
-	for cname, ci := range i.c {
-		if i.hotkeyPressed(cname, ci.Hotkey) {
-			if !i.forever && i.r.IsConnected() && cname == i.ci.Name {
-				i.l.Infof("caught %q, disconnecting fom %q", ci.Hotkey, cname)
-				xevent.Quit(i.xu)
-				i.r.Disconnect()
-				return true
-			}
-			i.l.Infof("caught %q, switching to %q", ci.Hotkey, cname)
-			if err := i.switchRemote(cname); err != nil {
-				// fmt.Print("\a") // bell terminal ring
-				i.l.Warn(err)
-			}
-			return true
-		}
-	}
-	return false
+	i.handleKeysym(state, uint8(keycode), uint32(keysym), isPress)
 }
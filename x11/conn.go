@@ -0,0 +1,323 @@
+package x11
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/BurntSushi/xgb"
+)
+
+type displayName struct {
+	protocol string
+	socket   string
+	host     string
+	number   string
+	screen   int
+}
+
+// parseDisplay parses the display the same way xgb does,
+// an empty display uses $DISPLAY.
+func parseDisplay(display string) (displayName, error) {
+	var d displayName
+	if display == "" {
+		display = os.Getenv("DISPLAY")
+	}
+	if display == "" {
+		return d, errors.New("empty display string")
+	}
+	colon := strings.LastIndex(display, ":")
+	if colon < 0 {
+		return d, fmt.Errorf("bad display string: %v", display)
+	}
+	if display[0] == '/' {
+		d.socket = display[:colon]
+	} else if slash := strings.LastIndex(display, "/"); slash >= 0 {
+		d.protocol = display[:slash]
+		d.host = display[slash+1 : colon]
+	} else {
+		d.host = display[:colon]
+	}
+	d.number = display[colon+1:]
+	if dot := strings.LastIndex(d.number, "."); dot >= 0 {
+		screen, err := strconv.Atoi(d.number[dot+1:])
+		if err != nil {
+			return d, fmt.Errorf("bad display string: %v", display)
+		}
+		d.number, d.screen = d.number[:dot], screen
+	}
+	if n, err := strconv.Atoi(d.number); err != nil || n < 0 {
+		return d, fmt.Errorf("bad display string: %v", display)
+	}
+	return d, nil
+}
+
+func (d displayName) dial() (net.Conn, error) {
+	var nc net.Conn
+	var err error
+	switch {
+	case d.socket != "":
+		nc, err = net.Dial("unix", d.socket+":"+d.number)
+	case d.host != "":
+		protocol := d.protocol
+		if protocol == "" {
+			protocol = "tcp"
+		}
+		n, _ := strconv.Atoi(d.number)
+		nc, err = net.Dial(protocol, net.JoinHostPort(d.host, strconv.Itoa(6000+n)))
+	default:
+		nc, err = net.Dial("unix", "/tmp/.X11-unix/X"+d.number)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to display %v: %s", d.number, err)
+	}
+	return nc, nil
+}
+
+// readAuthority reads the authority for the display from the X authority file.
+func readAuthority(host, display string) (string, []byte, error) {
+	const (
+		familyLocal = 256
+		familyWild  = 65535
+	)
+	if host == "" || host == "localhost" {
+		var err error
+		if host, err = os.Hostname(); err != nil {
+			return "", nil, err
+		}
+	}
+	path := os.Getenv("XAUTHORITY")
+	if path == "" {
+		home := os.Getenv("HOME")
+		if home == "" {
+			return "", nil, errors.New("Xauthority not found: $XAUTHORITY, $HOME not set")
+		}
+		path = home + "/.Xauthority"
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return "", nil, err
+	}
+	defer f.Close()
+	for {
+		var family uint16
+		if err := binary.Read(f, binary.BigEndian, &family); err != nil {
+			return "", nil, err
+		}
+		var fields [4][]byte
+		for i := range fields {
+			var n uint16
+			if err := binary.Read(f, binary.BigEndian, &n); err != nil {
+				return "", nil, err
+			}
+			fields[i] = make([]byte, n)
+			if _, err := io.ReadFull(f, fields[i]); err != nil {
+				return "", nil, err
+			}
+		}
+		addr, disp, name, data := string(fields[0]), string(fields[1]), string(fields[2]), fields[3]
+		if (family == familyWild || family == familyLocal && addr == host) && (disp == "" || disp == display) {
+			return name, data, nil
+		}
+	}
+}
+
+// conn is a connection of its own to the X server, for the XInput2 events.
+// xgb reads every event as 32 bytes, but generic events carry more data
+// after that, which conn reads whole. Its requests are sent one at a time,
+// waiting for their reply.
+type conn struct {
+	nc net.Conn
+	// mu guards the requests and their sequence number
+	mu  sync.Mutex
+	seq uint16
+	// replies are the replies and errors, events the generic events,
+	// both are closed when the connection is
+	replies chan []byte
+	events  chan []byte
+}
+
+const (
+	messageError   = 0
+	messageReply   = 1
+	messageGeneric = 35
+
+	opcodeGetInputFocus  = 43
+	opcodeQueryExtension = 98
+)
+
+// dialConn connects to the X server of the display, an empty display uses $DISPLAY.
+func dialConn(display string) (*conn, error) {
+	d, err := parseDisplay(display)
+	if err != nil {
+		return nil, err
+	}
+	nc, err := d.dial()
+	if err != nil {
+		return nil, err
+	}
+	if err := setup(nc, d); err != nil {
+		nc.Close()
+		return nil, err
+	}
+	return newConn(nc), nil
+}
+
+// newConn reads the messages of the connection, after its setup.
+func newConn(nc net.Conn) *conn {
+	c := &conn{nc: nc, replies: make(chan []byte), events: make(chan []byte)}
+	generic := make(chan []byte)
+	go c.read(generic)
+	go queue(generic, c.events)
+	return c
+}
+
+// setup sends the connection setup request and reads its reply,
+// see the X protocol connection setup.
+func setup(nc net.Conn, d displayName) error {
+	authName, authData, err := readAuthority(d.host, d.number)
+	if err != nil {
+		authName, authData = "", nil
+	}
+	buf := make([]byte, 12+xgb.Pad(len(authName))+xgb.Pad(len(authData)))
+	buf[0] = 'l'
+	xgb.Put16(buf[2:], 11)
+	xgb.Put16(buf[6:], uint16(len(authName)))
+	xgb.Put16(buf[8:], uint16(len(authData)))
+	copy(buf[12:], authName)
+	copy(buf[12+xgb.Pad(len(authName)):], authData)
+	if _, err := nc.Write(buf); err != nil {
+		return err
+	}
+	// the setup reply has its length in 4 byte units after the 8 byte header
+	head := make([]byte, 8)
+	if _, err := io.ReadFull(nc, head); err != nil {
+		return err
+	}
+	reply := make([]byte, int(xgb.Get16(head[6:]))*4)
+	if _, err := io.ReadFull(nc, reply); err != nil {
+		return err
+	}
+	if head[0] == 0 {
+		reason := reply
+		if int(head[1]) < len(reason) {
+			reason = reason[:head[1]]
+		}
+		return fmt.Errorf("x protocol authentication refused: %s", reason)
+	}
+	return nil
+}
+
+// read reads the messages from the X server until the connection is closed.
+func (c *conn) read(generic chan<- []byte) {
+	defer close(c.replies)
+	defer close(generic)
+	for {
+		head := make([]byte, 32)
+		if _, err := io.ReadFull(c.nc, head); err != nil {
+			return
+		}
+		// replies and generic events have more data of the length
+		// in 4 byte units after the 32 byte header
+		msg := head
+		if head[0] == messageReply || head[0]&127 == messageGeneric {
+			msg = make([]byte, 32+int(xgb.Get32(head[4:]))*4)
+			copy(msg, head)
+			if _, err := io.ReadFull(c.nc, msg[32:]); err != nil {
+				return
+			}
+		}
+		switch {
+		case head[0] == messageError || head[0] == messageReply:
+			c.replies <- msg
+		case head[0]&127 == messageGeneric:
+			generic <- msg
+		}
+	}
+}
+
+// queue forwards the events from in to out, queueing them while out
+// isn't read, so the replies aren't held up by unread events.
+func queue(in <-chan []byte, out chan<- []byte) {
+	defer close(out)
+	var queued [][]byte
+	for {
+		var send chan<- []byte
+		var next []byte
+		if len(queued) > 0 {
+			send, next = out, queued[0]
+		}
+		select {
+		case msg, ok := <-in:
+			if !ok {
+				return
+			}
+			queued = append(queued, msg)
+		case send <- next:
+			queued = queued[1:]
+		}
+	}
+}
+
+// request sends the request and returns its reply. A request without
+// a reply is followed by a GetInputFocus request, whose reply tells
+// the request succeeded.
+func (c *conn) request(buf []byte, hasReply bool) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !hasReply {
+		buf = append(buf, opcodeGetInputFocus, 0, 1, 0)
+	}
+	if _, err := c.nc.Write(buf); err != nil {
+		return nil, err
+	}
+	c.seq++
+	seq := c.seq
+	if !hasReply {
+		c.seq++
+	}
+	var err error
+	for msg := range c.replies {
+		switch msgSeq := xgb.Get16(msg[2:]); {
+		case msg[0] == messageError && msgSeq == seq:
+			err = fmt.Errorf("x protocol error %v for request %v", msg[1], buf[0])
+			if hasReply {
+				return nil, err
+			}
+		case msg[0] == messageReply && msgSeq == c.seq:
+			if !hasReply {
+				return nil, err
+			}
+			return msg, nil
+		}
+	}
+	return nil, errors.New("x connection closed")
+}
+
+// queryExtension returns the major opcode of the extension,
+// see xproto.QueryExtension.
+func (c *conn) queryExtension(name string) (byte, error) {
+	buf := make([]byte, 8+xgb.Pad(len(name)))
+	buf[0] = opcodeQueryExtension
+	xgb.Put16(buf[2:], uint16(len(buf)/4))
+	xgb.Put16(buf[4:], uint16(len(name)))
+	copy(buf[8:], name)
+	reply, err := c.request(buf, true)
+	if err != nil {
+		return 0, err
+	}
+	if reply[8] == 0 {
+		return 0, fmt.Errorf("no %v extension found on the X server", name)
+	}
+	return reply[9], nil
+}
+
+func (c *conn) Close() error {
+	return c.nc.Close()
+}
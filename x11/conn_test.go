@@ -0,0 +1,86 @@
+package x11
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/BurntSushi/xgb"
+)
+
+func Test_parseDisplay(t *testing.T) {
+	tests := []struct {
+		display string
+		want    displayName
+		wantErr bool
+	}{
+		{":1", displayName{number: "1"}, false},
+		{":1.2", displayName{number: "1", screen: 2}, false},
+		{"host:2", displayName{host: "host", number: "2"}, false},
+		{"tcp/host:2.1", displayName{protocol: "tcp", host: "host", number: "2", screen: 1}, false},
+		{"/tmp/launch-12/:0", displayName{socket: "/tmp/launch-12/", number: "0"}, false},
+		{"host", displayName{}, true},
+		{":x", displayName{}, true},
+		{":1.x", displayName{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.display, func(t *testing.T) {
+			got, err := parseDisplay(tt.display)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseDisplay() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && got != tt.want {
+				t.Errorf("parseDisplay() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// message returns a 32 byte server message of the type and sequence number,
+// followed by extra bytes, with their length in the header.
+func message(typ byte, seq uint16, extra int) []byte {
+	buf := make([]byte, 32+extra)
+	buf[0] = typ
+	xgb.Put16(buf[2:], seq)
+	xgb.Put32(buf[4:], uint32(extra/4))
+	for i := 32; i < len(buf); i++ {
+		buf[i] = byte(i)
+	}
+	return buf
+}
+
+func Test_conn(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	c := newConn(client)
+	defer c.Close()
+
+	generic := message(messageGeneric, 1, 12)
+	errReply := message(messageError, 2, 0)
+	errReply[1] = 8
+	go func() {
+		// a reply with a generic event before it, the error of a request
+		// without a reply and the reply of the GetInputFocus following it
+		io.ReadFull(server, make([]byte, 4))
+		server.Write(generic)
+		server.Write(message(messageReply, 1, 8))
+		io.ReadFull(server, make([]byte, 8))
+		server.Write(errReply)
+		server.Write(message(messageReply, 3, 0))
+	}()
+	reply, err := c.request([]byte{1, 0, 1, 0}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := message(messageReply, 1, 8); !bytes.Equal(reply, want) {
+		t.Errorf("request() = %v, want %v", reply, want)
+	}
+	if _, err := c.request([]byte{2, 0, 1, 0}, false); err == nil {
+		t.Error("request() of a failing request without a reply succeeded")
+	}
+	// the generic event is read whole
+	if got := <-c.events; !bytes.Equal(got, generic) {
+		t.Errorf("generic event = %v, want %v", got, generic)
+	}
+}
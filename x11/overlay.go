@@ -0,0 +1,143 @@
+package x11
+
+import (
+	"sync"
+
+	"github.com/BurntSushi/xgb"
+	"github.com/BurntSushi/xgb/xproto"
+)
+
+const (
+	overlayFont    = "fixed"
+	overlayPadding = 6
+)
+
+// Overlay is an always on top window showing a single line of text,
+// centered at the top or bottom of the screen, or of a monitor.
+type Overlay struct {
+	c      *xgb.Conn
+	screen *xproto.ScreenInfo
+	win    xproto.Window
+	gc     xproto.Gcontext
+	bottom bool
+	// size of the font characters, the font is monospaced
+	charWidth, ascent, descent int
+
+	mu     sync.Mutex
+	text   string
+	bg, fg uint32
+	mapped bool
+	// monitor is the monitor the overlay is shown on, the whole screen if unset
+	monitor Monitor
+}
+
+// NewOverlay creates the overlay window, it's hidden until shown.
+// The window receives Expose events, which must be passed to Redraw.
+func NewOverlay(c *xgb.Conn, screen *xproto.ScreenInfo, bottom bool) (*Overlay, error) {
+	o := &Overlay{c: c, screen: screen, bottom: bottom}
+	font, err := xproto.NewFontId(c)
+	if err != nil {
+		return nil, err
+	}
+	if err := xproto.OpenFontChecked(c, font, uint16(len(overlayFont)), overlayFont).Check(); err != nil {
+		return nil, err
+	}
+	info, err := xproto.QueryFont(c, xproto.Fontable(font)).Reply()
+	if err != nil {
+		return nil, err
+	}
+	o.charWidth = int(info.MaxBounds.CharacterWidth)
+	o.ascent, o.descent = int(info.FontAscent), int(info.FontDescent)
+
+	if o.win, err = xproto.NewWindowId(c); err != nil {
+		return nil, err
+	}
+	err = xproto.CreateWindowChecked(c, screen.RootDepth, o.win, screen.Root,
+		0, 0, 1, 1, 0, xproto.WindowClassInputOutput, screen.RootVisual,
+		xproto.CwBackPixel|xproto.CwOverrideRedirect|xproto.CwEventMask,
+		[]uint32{screen.BlackPixel, 1, xproto.EventMaskExposure}).Check()
+	if err != nil {
+		return nil, err
+	}
+	if o.gc, err = xproto.NewGcontextId(c); err != nil {
+		return nil, err
+	}
+	err = xproto.CreateGCChecked(c, o.gc, xproto.Drawable(o.win), xproto.GcFont, []uint32{uint32(font)}).Check()
+	if err != nil {
+		return nil, err
+	}
+	xproto.CloseFont(c, font)
+	return o, nil
+}
+
+// Window is the overlay window.
+func (o *Overlay) Window() xproto.Window {
+	return o.win
+}
+
+// SetMonitor shows the overlay on the monitor from the next Show on.
+func (o *Overlay) SetMonitor(m Monitor) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.monitor = m
+}
+
+// Show shows the text with the background and foreground colors,
+// given as 0xRRGGBB, and raises the overlay above all other windows.
+func (o *Overlay) Show(text string, bg, fg uint32) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if len(text) > 255 {
+		text = text[:255]
+	}
+	o.text, o.bg, o.fg = text, bg, fg
+	width := len(text)*o.charWidth + 2*overlayPadding
+	height := o.ascent + o.descent + 2*overlayPadding
+	area := o.monitor
+	if area.Width == 0 || area.Height == 0 {
+		area = Monitor{Width: o.screen.WidthInPixels, Height: o.screen.HeightInPixels}
+	}
+	x := int(area.X) + (int(area.Width)-width)/2
+	y := int(area.Y) + overlayPadding
+	if o.bottom {
+		y = int(area.Y) + int(area.Height) - height - overlayPadding
+	}
+	xproto.ConfigureWindow(o.c, o.win,
+		xproto.ConfigWindowX|xproto.ConfigWindowY|xproto.ConfigWindowWidth|
+			xproto.ConfigWindowHeight|xproto.ConfigWindowStackMode,
+		[]uint32{uint32(x), uint32(y), uint32(width), uint32(height), xproto.StackModeAbove})
+	xproto.ChangeWindowAttributes(o.c, o.win, xproto.CwBackPixel, []uint32{bg})
+	if !o.mapped {
+		// drawn on the first Expose
+		xproto.MapWindow(o.c, o.win)
+		o.mapped = true
+		return
+	}
+	o.draw()
+}
+
+// Hide unmaps the overlay.
+func (o *Overlay) Hide() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.mapped {
+		xproto.UnmapWindow(o.c, o.win)
+		o.mapped = false
+	}
+}
+
+// Redraw draws the overlay again, after it was exposed.
+func (o *Overlay) Redraw() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.mapped {
+		o.draw()
+	}
+}
+
+func (o *Overlay) draw() {
+	xproto.ClearArea(o.c, false, o.win, 0, 0, 0, 0)
+	xproto.ChangeGC(o.c, o.gc, xproto.GcForeground|xproto.GcBackground, []uint32{o.fg, o.bg})
+	xproto.ImageText8(o.c, byte(len(o.text)), xproto.Drawable(o.win), o.gc,
+		overlayPadding, int16(overlayPadding+o.ascent), o.text)
+}
@@ -0,0 +1,120 @@
+package x11
+
+import (
+	"fmt"
+
+	"github.com/BurntSushi/xgb"
+	"github.com/BurntSushi/xgb/randr"
+	"github.com/BurntSushi/xgb/xproto"
+)
+
+// Monitor is a local monitor, the part of the root window a RandR CRTC shows.
+type Monitor struct {
+	// Name is the name of the output, like DP-1
+	Name          string
+	X, Y          int16
+	Width, Height uint16
+	Primary       bool
+}
+
+func (m Monitor) String() string {
+	return fmt.Sprintf("%v %vx%v+%v+%v", m.Name, m.Width, m.Height, m.X, m.Y)
+}
+
+// Contains reports whether the root window coordinates are on the monitor.
+func (m Monitor) Contains(x, y int16) bool {
+	return int(x) >= int(m.X) && int(x) < int(m.X)+int(m.Width) &&
+		int(y) >= int(m.Y) && int(y) < int(m.Y)+int(m.Height)
+}
+
+// RandR is a minimal RandR client for the monitor layout.
+type RandR struct {
+	c *xgb.Conn
+}
+
+// NewRandR initializes RandR on the connection,
+// it fails if the X server doesn't support at least RandR 1.3.
+func NewRandR(c *xgb.Conn) (*RandR, error) {
+	if err := randr.Init(c); err != nil {
+		return nil, err
+	}
+	reply, err := randr.QueryVersion(c, 1, 3).Reply()
+	if err != nil {
+		return nil, err
+	}
+	if reply.MajorVersion < 1 || reply.MajorVersion == 1 && reply.MinorVersion < 3 {
+		return nil, fmt.Errorf("RandR %v.%v is too old, 1.3 is needed", reply.MajorVersion, reply.MinorVersion)
+	}
+	return &RandR{c}, nil
+}
+
+// SelectScreenChange selects the ScreenChangeNotify events on the root window,
+// which are sent when the monitor layout changes.
+func (r *RandR) SelectScreenChange(root xproto.Window) error {
+	return randr.SelectInputChecked(r.c, root, randr.NotifyMaskScreenChange).Check()
+}
+
+// Monitors returns the active monitors of the root window.
+func (r *RandR) Monitors(root xproto.Window) ([]Monitor, error) {
+	res, err := randr.GetScreenResourcesCurrent(r.c, root).Reply()
+	if err != nil {
+		return nil, err
+	}
+	primary, err := randr.GetOutputPrimary(r.c, root).Reply()
+	if err != nil {
+		return nil, err
+	}
+	var monitors []Monitor
+	for _, crtc := range res.Crtcs {
+		info, err := randr.GetCrtcInfo(r.c, crtc, res.ConfigTimestamp).Reply()
+		if err != nil {
+			return nil, err
+		}
+		// disabled CRTCs have no mode
+		if info.Mode == 0 || len(info.Outputs) == 0 {
+			continue
+		}
+		m := Monitor{X: info.X, Y: info.Y, Width: info.Width, Height: info.Height}
+		for _, output := range info.Outputs {
+			if output == primary.Output {
+				m.Primary = true
+			}
+		}
+		out, err := randr.GetOutputInfo(r.c, info.Outputs[0], res.ConfigTimestamp).Reply()
+		if err != nil {
+			return nil, err
+		}
+		m.Name = string(out.Name)
+		monitors = append(monitors, m)
+	}
+	return monitors, nil
+}
+
+// MonitorByName returns the monitor of the output name.
+func MonitorByName(monitors []Monitor, name string) (Monitor, bool) {
+	for _, m := range monitors {
+		if m.Name == name {
+			return m, true
+		}
+	}
+	return Monitor{}, false
+}
+
+// FindMonitor returns the monitor at the root window coordinates,
+// or the primary monitor, or the first one.
+func FindMonitor(monitors []Monitor, x, y int16) (Monitor, bool) {
+	for _, m := range monitors {
+		if m.Contains(x, y) {
+			return m, true
+		}
+	}
+	for _, m := range monitors {
+		if m.Primary {
+			return m, true
+		}
+	}
+	if len(monitors) > 0 {
+		return monitors[0], true
+	}
+	return Monitor{}, false
+}
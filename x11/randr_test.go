@@ -0,0 +1,40 @@
+package x11
+
+import "testing"
+
+func TestFindMonitor(t *testing.T) {
+	left := Monitor{Name: "DP-1", Width: 1920, Height: 1080}
+	right := Monitor{Name: "DP-2", X: 1920, Width: 2560, Height: 1440, Primary: true}
+	tests := []struct {
+		name     string
+		monitors []Monitor
+		x, y     int16
+		want     Monitor
+		wantOk   bool
+	}{
+		{"none", nil, 0, 0, Monitor{}, false},
+		{"pointer on left", []Monitor{left, right}, 100, 100, left, true},
+		{"pointer on right", []Monitor{left, right}, 1920, 1200, right, true},
+		{"pointer in gap uses primary", []Monitor{left, right}, 100, 1200, right, true},
+		{"no primary uses first", []Monitor{left, {Name: "DP-2", X: 1920, Width: 2560, Height: 1440}}, 100, 1200, left, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := FindMonitor(tt.monitors, tt.x, tt.y)
+			if got != tt.want || ok != tt.wantOk {
+				t.Errorf("FindMonitor() = %v, %v, want %v, %v", got, ok, tt.want, tt.wantOk)
+			}
+		})
+	}
+}
+
+func TestMonitorByName(t *testing.T) {
+	left := Monitor{Name: "DP-1", Width: 1920, Height: 1080}
+	right := Monitor{Name: "DP-2", X: 1920, Width: 2560, Height: 1440, Primary: true}
+	if got, ok := MonitorByName([]Monitor{left, right}, "DP-1"); !ok || got != left {
+		t.Errorf("MonitorByName(DP-1) = %v, %v, want %v", got, ok, left)
+	}
+	if got, ok := MonitorByName([]Monitor{left, right}, "HDMI-1"); ok {
+		t.Errorf("MonitorByName(HDMI-1) = %v, want none", got)
+	}
+}
@@ -50,7 +50,7 @@ func CompressMotionNotify(xu *xgbutil.XUtil, ev xevent.MotionNotifyEvent) xevent
 				ev.Root == mn.Root && ev.SameScreen == mn.SameScreen {
 
 				// Set the most recent/valid motion notify event.
-				lastE = xevent.MotionNotifyEvent{&mn}
+				lastE = xevent.MotionNotifyEvent{MotionNotifyEvent: &mn}
 
 				// We cheat and use the stack semantics of defer to dequeue
 				// most recent motion notify events first, so that the indices
@@ -0,0 +1,128 @@
+package x11
+
+import (
+	"image"
+	"sync"
+
+	"github.com/BurntSushi/xgb"
+	"github.com/BurntSushi/xgb/xproto"
+)
+
+// putImageHeader is the size of the PutImage request without the image data.
+const putImageHeader = 24
+
+// Viewer is a window showing an image unscaled at its top left. The image is
+// drawn as a 24 bit depth, 32 bits per pixel ZPixmap, the format of most screens.
+type Viewer struct {
+	c      *xgb.Conn
+	screen *xproto.ScreenInfo
+	win    xproto.Window
+	gc     xproto.Gcontext
+	// maximum PutImage data length
+	maxData int
+
+	mu sync.Mutex
+	// img is a copy of the image shown, for redrawing exposed areas
+	img *image.RGBA
+}
+
+// NewViewer creates and maps the viewer window, which receives the key,
+// button, motion and Expose events. Expose events must be passed to Redraw.
+func NewViewer(c *xgb.Conn, screen *xproto.ScreenInfo, width, height uint16) (*Viewer, error) {
+	v := &Viewer{
+		c:       c,
+		screen:  screen,
+		maxData: int(xproto.Setup(c).MaximumRequestLength)*4 - putImageHeader,
+		img:     image.NewRGBA(image.Rect(0, 0, int(width), int(height))),
+	}
+	var err error
+	if v.win, err = xproto.NewWindowId(c); err != nil {
+		return nil, err
+	}
+	mask := uint32(xproto.EventMaskKeyPress | xproto.EventMaskKeyRelease |
+		xproto.EventMaskButtonPress | xproto.EventMaskButtonRelease |
+		xproto.EventMaskPointerMotion | xproto.EventMaskExposure)
+	err = xproto.CreateWindowChecked(c, screen.RootDepth, v.win, screen.Root,
+		0, 0, width, height, 0, xproto.WindowClassInputOutput, screen.RootVisual,
+		xproto.CwBackPixel|xproto.CwEventMask, []uint32{screen.BlackPixel, mask}).Check()
+	if err != nil {
+		return nil, err
+	}
+	if v.gc, err = xproto.NewGcontextId(c); err != nil {
+		return nil, err
+	}
+	if err := xproto.CreateGCChecked(c, v.gc, xproto.Drawable(v.win), 0, nil).Check(); err != nil {
+		return nil, err
+	}
+	return v, xproto.MapWindowChecked(c, v.win).Check()
+}
+
+// Window is the viewer window.
+func (v *Viewer) Window() xproto.Window {
+	return v.win
+}
+
+// Size is the size of the image shown.
+func (v *Viewer) Size() (uint16, uint16) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return uint16(v.img.Bounds().Dx()), uint16(v.img.Bounds().Dy())
+}
+
+// SetTitle sets the window title.
+func (v *Viewer) SetTitle(title string) {
+	xproto.ChangeProperty(v.c, xproto.PropModeReplace, v.win, xproto.AtomWmName,
+		xproto.AtomString, 8, uint32(len(title)), []byte(title))
+}
+
+// Draw shows the rectangle r of the image, the window
+// is resized when the image size changes.
+func (v *Viewer) Draw(img *image.RGBA, r image.Rectangle) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if img.Bounds() != v.img.Bounds() {
+		v.img = image.NewRGBA(img.Bounds())
+		r = img.Bounds()
+		xproto.ConfigureWindow(v.c, v.win, xproto.ConfigWindowWidth|xproto.ConfigWindowHeight,
+			[]uint32{uint32(r.Dx()), uint32(r.Dy())})
+	}
+	r = r.Intersect(v.img.Bounds())
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		copy(v.img.Pix[v.img.PixOffset(r.Min.X, y):v.img.PixOffset(r.Max.X, y)],
+			img.Pix[img.PixOffset(r.Min.X, y):img.PixOffset(r.Max.X, y)])
+	}
+	v.put(r)
+}
+
+// Redraw draws the rectangle r again, after it was exposed.
+func (v *Viewer) Redraw(r image.Rectangle) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.put(r.Intersect(v.img.Bounds()))
+}
+
+// put sends the rectangle of the image in as many
+// PutImage requests as the maximum request length needs.
+func (v *Viewer) put(r image.Rectangle) {
+	if r.Empty() {
+		return
+	}
+	rowBytes := r.Dx() * 4
+	rows := v.maxData / rowBytes
+	if rows < 1 {
+		rows = 1
+	}
+	for y := r.Min.Y; y < r.Max.Y; y += rows {
+		strip := image.Rect(r.Min.X, y, r.Max.X, y+rows).Intersect(r)
+		data := make([]byte, 0, strip.Dx()*strip.Dy()*4)
+		for sy := strip.Min.Y; sy < strip.Max.Y; sy++ {
+			row := v.img.Pix[v.img.PixOffset(strip.Min.X, sy):v.img.PixOffset(strip.Max.X, sy)]
+			for i := 0; i < len(row); i += 4 {
+				data = append(data, row[i+2], row[i+1], row[i], 0)
+			}
+		}
+		xproto.PutImage(v.c, xproto.ImageFormatZPixmap, xproto.Drawable(v.win), v.gc,
+			uint16(strip.Dx()), uint16(strip.Dy()), int16(strip.Min.X), int16(strip.Min.Y),
+			0, v.screen.RootDepth, data)
+	}
+}
@@ -0,0 +1,249 @@
+package x11
+
+import (
+	"fmt"
+
+	"github.com/BurntSushi/xgb"
+	"github.com/BurntSushi/xgb/xproto"
+)
+
+const (
+	XIRawButtonPress   = 15
+	XIRawButtonRelease = 16
+	XIRawMotion        = 17
+
+	XIAllDevices       = 0
+	XIAllMasterDevices = 1
+
+	// XIPointerEmulated is set on events emulated from other events,
+	// like the wheel buttons emulated from smooth scrolling.
+	XIPointerEmulated = 1 << 16
+
+	ScrollTypeVertical   = 1
+	ScrollTypeHorizontal = 2
+
+	xiSelectEvents = 46
+	xiQueryVersion = 47
+	xiQueryDevice  = 48
+
+	xiRawKeyPress   = 13
+	xiValuatorClass = 2
+	xiScrollClass   = 3
+	xiModeAbsolute  = 1
+)
+
+// XI2 is a minimal XInput2 client for the raw device events, on a connection
+// of its own. Its events aren't ordered with the events of other connections.
+type XI2 struct {
+	c      *conn
+	opcode byte
+	events chan RawEvent
+}
+
+// NewXI2 connects to the X server of the display and initializes XInput 2.2,
+// it fails if the X server doesn't support at least XInput 2.1.
+// An empty display uses $DISPLAY.
+func NewXI2(display string) (*XI2, error) {
+	c, err := dialConn(display)
+	if err != nil {
+		return nil, err
+	}
+	opcode, err := c.queryExtension("XInputExtension")
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	x := &XI2{c: c, opcode: opcode, events: make(chan RawEvent)}
+	buf := x.request(xiQueryVersion, 4)
+	xgb.Put16(buf[4:], 2)
+	xgb.Put16(buf[6:], 2)
+	data, err := c.request(buf, true)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	major, minor := xgb.Get16(data[8:]), xgb.Get16(data[10:])
+	if major < 2 || major == 2 && minor < 1 {
+		c.Close()
+		return nil, fmt.Errorf("XInput %v.%v is too old, 2.1 is needed", major, minor)
+	}
+	go x.readEvents()
+	return x, nil
+}
+
+// Events returns the raw events selected, it's closed with the connection.
+func (x *XI2) Events() <-chan RawEvent {
+	return x.events
+}
+
+func (x *XI2) readEvents() {
+	defer close(x.events)
+	for data := range x.c.events {
+		if data[1] != x.opcode {
+			continue
+		}
+		if e, ok := parseRawEvent(data); ok {
+			x.events <- e
+		}
+	}
+}
+
+func (x *XI2) Close() error {
+	return x.c.Close()
+}
+
+// SelectEvents selects the XInput2 event types on the window
+// for the device, or XIAllDevices or XIAllMasterDevices.
+func (x *XI2) SelectEvents(w xproto.Window, deviceid uint16, types ...int) error {
+	var mask []byte
+	for _, t := range types {
+		for len(mask) <= t/8 {
+			mask = append(mask, 0, 0, 0, 0)
+		}
+		mask[t/8] |= 1 << uint(t%8)
+	}
+	buf := x.request(xiSelectEvents, 12+len(mask))
+	xgb.Put32(buf[4:], uint32(w))
+	xgb.Put16(buf[8:], 1)
+	xgb.Put16(buf[12:], deviceid)
+	xgb.Put16(buf[14:], uint16(len(mask)/4))
+	copy(buf[16:], mask)
+	_, err := x.c.request(buf, false)
+	return err
+}
+
+// ScrollValuator is a device valuator reporting smooth scrolling,
+// Increment is the valuator distance of one wheel click.
+type ScrollValuator struct {
+	Type      uint16
+	Increment float64
+}
+
+// Device is an input device and its scroll valuators by valuator number.
+// Absolute devices, like tablets, report positions instead of motion deltas.
+type Device struct {
+	ID       uint16
+	Name     string
+	Absolute bool
+	Scroll   map[uint16]ScrollValuator
+}
+
+// QueryDevices returns all input devices by id.
+func (x *XI2) QueryDevices() (map[uint16]Device, error) {
+	buf := x.request(xiQueryDevice, 4)
+	xgb.Put16(buf[4:], XIAllDevices)
+	data, err := x.c.request(buf, true)
+	if err != nil {
+		return nil, err
+	}
+	return parseDevices(data)
+}
+
+func parseDevices(data []byte) (map[uint16]Device, error) {
+	devices := map[uint16]Device{}
+	n := int(xgb.Get16(data[8:]))
+	b := 32
+	for ; n > 0; n-- {
+		if len(data) < b+12 {
+			return nil, fmt.Errorf("short XIQueryDevice reply")
+		}
+		d := Device{ID: xgb.Get16(data[b:]), Scroll: map[uint16]ScrollValuator{}}
+		classes := int(xgb.Get16(data[b+6:]))
+		nameLen := int(xgb.Get16(data[b+8:]))
+		if len(data) < b+12+nameLen {
+			return nil, fmt.Errorf("short XIQueryDevice reply")
+		}
+		d.Name = string(data[b+12 : b+12+nameLen])
+		b += 12 + xgb.Pad(nameLen)
+		for ; classes > 0; classes-- {
+			if len(data) < b+4 {
+				return nil, fmt.Errorf("short XIQueryDevice reply")
+			}
+			classType, classLen := xgb.Get16(data[b:]), int(xgb.Get16(data[b+2:]))*4
+			if classLen < 4 || len(data) < b+classLen {
+				return nil, fmt.Errorf("bad XIQueryDevice class length")
+			}
+			// the first valuator is the x axis
+			if classType == xiValuatorClass && classLen >= 44 && xgb.Get16(data[b+6:]) == 0 {
+				d.Absolute = data[b+40] == xiModeAbsolute
+			}
+			if classType == xiScrollClass && classLen >= 24 {
+				d.Scroll[xgb.Get16(data[b+6:])] = ScrollValuator{
+					Type:      xgb.Get16(data[b+8:]),
+					Increment: fp3232(data[b+16:]),
+				}
+			}
+			b += classLen
+		}
+		devices[d.ID] = d
+	}
+	return devices, nil
+}
+
+// RawEvent is an XInput2 raw device event.
+type RawEvent struct {
+	Type     uint16
+	Deviceid uint16
+	Sourceid uint16
+	Time     uint32
+	Detail   uint32
+	Flags    uint32
+	// Values are the valuator values by valuator number,
+	// RawValues the same before any acceleration was applied.
+	Values    map[uint16]float64
+	RawValues map[uint16]float64
+}
+
+func parseRawEvent(data []byte) (RawEvent, bool) {
+	if len(data) < 32 {
+		return RawEvent{}, false
+	}
+	e := RawEvent{
+		Type:      xgb.Get16(data[8:]),
+		Deviceid:  xgb.Get16(data[10:]),
+		Time:      xgb.Get32(data[12:]),
+		Detail:    xgb.Get32(data[16:]),
+		Sourceid:  xgb.Get16(data[20:]),
+		Flags:     xgb.Get32(data[24:]),
+		Values:    map[uint16]float64{},
+		RawValues: map[uint16]float64{},
+	}
+	if e.Type < xiRawKeyPress || e.Type > XIRawMotion {
+		return RawEvent{}, false
+	}
+	maskLen := int(xgb.Get16(data[22:])) * 4
+	if len(data) < 32+maskLen {
+		return RawEvent{}, false
+	}
+	mask := data[32 : 32+maskLen]
+	var numbers []uint16
+	for i := 0; i < maskLen*8; i++ {
+		if mask[i/8]&(1<<uint(i%8)) != 0 {
+			numbers = append(numbers, uint16(i))
+		}
+	}
+	values := 32 + maskLen
+	raw := values + len(numbers)*8
+	if len(data) < raw+len(numbers)*8 {
+		return RawEvent{}, false
+	}
+	for i, n := range numbers {
+		e.Values[n] = fp3232(data[values+i*8:])
+		e.RawValues[n] = fp3232(data[raw+i*8:])
+	}
+	return e, true
+}
+
+func fp3232(b []byte) float64 {
+	return float64(int32(xgb.Get32(b))) + float64(xgb.Get32(b[4:]))/(1<<32)
+}
+
+// request returns a request of the XInput2 minor opcode,
+// with length bytes after the 4 byte header.
+func (x *XI2) request(minor byte, length int) []byte {
+	buf := make([]byte, 4+xgb.Pad(length))
+	buf[0] = x.opcode
+	buf[1] = minor
+	xgb.Put16(buf[2:], uint16(len(buf)/4))
+	return buf
+}
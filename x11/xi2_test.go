@@ -0,0 +1,119 @@
+package x11
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/BurntSushi/xgb"
+)
+
+func putFP3232(b []byte, v float64) {
+	i := int32(v)
+	if float64(i) > v {
+		i--
+	}
+	xgb.Put32(b, uint32(i))
+	xgb.Put32(b[4:], uint32((v-float64(i))*(1<<32)))
+}
+
+func Test_parseRawEvent(t *testing.T) {
+	// valuators 0 and 3 of a raw motion event
+	data := make([]byte, 32+4+2*8+2*8)
+	data[0] = 35
+	xgb.Put16(data[8:], XIRawMotion)
+	xgb.Put16(data[10:], 2)
+	xgb.Put32(data[12:], 1234)
+	xgb.Put16(data[20:], 9)
+	xgb.Put16(data[22:], 1)
+	xgb.Put32(data[24:], XIPointerEmulated)
+	data[32] = 1<<0 | 1<<3
+	putFP3232(data[36:], 1.5)
+	putFP3232(data[44:], -15)
+	putFP3232(data[52:], 1)
+	putFP3232(data[60:], -7.25)
+
+	got, ok := parseRawEvent(data)
+	if !ok {
+		t.Fatal("parseRawEvent() not ok")
+	}
+	want := RawEvent{
+		Type:      XIRawMotion,
+		Deviceid:  2,
+		Sourceid:  9,
+		Time:      1234,
+		Flags:     XIPointerEmulated,
+		Values:    map[uint16]float64{0: 1.5, 3: -15},
+		RawValues: map[uint16]float64{0: 1, 3: -7.25},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseRawEvent() = %+v, want %+v", got, want)
+	}
+
+	if _, ok := parseRawEvent(data[:40]); ok {
+		t.Error("parseRawEvent() of a short event is ok")
+	}
+	xgb.Put16(data[8:], 6)
+	if _, ok := parseRawEvent(data); ok {
+		t.Error("parseRawEvent() of a motion event is ok")
+	}
+}
+
+func Test_parseDevices(t *testing.T) {
+	device := func(id uint16, name string, classes ...[]byte) []byte {
+		b := make([]byte, 12+xgb.Pad(len(name)))
+		xgb.Put16(b, id)
+		xgb.Put16(b[6:], uint16(len(classes)))
+		xgb.Put16(b[8:], uint16(len(name)))
+		copy(b[12:], name)
+		for _, c := range classes {
+			b = append(b, c...)
+		}
+		return b
+	}
+	scroll := func(number, scrollType uint16, increment float64) []byte {
+		b := make([]byte, 24)
+		xgb.Put16(b, xiScrollClass)
+		xgb.Put16(b[2:], 6)
+		xgb.Put16(b[6:], number)
+		xgb.Put16(b[8:], scrollType)
+		putFP3232(b[16:], increment)
+		return b
+	}
+	valuator := func(number uint16, mode byte) []byte {
+		b := make([]byte, 44)
+		xgb.Put16(b, xiValuatorClass)
+		xgb.Put16(b[2:], 11)
+		xgb.Put16(b[6:], number)
+		b[40] = mode
+		return b
+	}
+	button := make([]byte, 12)
+	xgb.Put16(button, 1)
+	xgb.Put16(button[2:], 3)
+
+	data := make([]byte, 32)
+	xgb.Put16(data[8:], 3)
+	data = append(data, device(2, "Virtual core pointer", button, valuator(0, 0), valuator(1, 0))...)
+	data = append(data, device(9, "Touchpad", button, valuator(0, 0), valuator(1, 0),
+		scroll(2, ScrollTypeHorizontal, 15), scroll(3, ScrollTypeVertical, -0.5))...)
+	data = append(data, device(10, "Tablet", valuator(0, xiModeAbsolute), valuator(1, xiModeAbsolute))...)
+
+	got, err := parseDevices(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[uint16]Device{
+		2: {ID: 2, Name: "Virtual core pointer", Scroll: map[uint16]ScrollValuator{}},
+		9: {ID: 9, Name: "Touchpad", Scroll: map[uint16]ScrollValuator{
+			2: {ScrollTypeHorizontal, 15},
+			3: {ScrollTypeVertical, -0.5},
+		}},
+		10: {ID: 10, Name: "Tablet", Absolute: true, Scroll: map[uint16]ScrollValuator{}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseDevices() = %+v, want %+v", got, want)
+	}
+	if _, err := parseDevices(data[:len(data)-8]); err == nil {
+		t.Error("parseDevices() of a short reply succeeded")
+	}
+}
@@ -0,0 +1,400 @@
+package i2vnc
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/BurntSushi/xgb/xproto"
+	"github.com/BurntSushi/xgb/xtest"
+	"github.com/BurntSushi/xgbutil"
+	"github.com/BurntSushi/xgbutil/keybind"
+	"github.com/sirupsen/logrus"
+)
+
+const x11WaitTimeout = 5 * time.Second
+
+// startXvfb starts a virtual X server sized like the local test screen
+// and returns its display, the test is skipped if Xvfb isn't installed.
+func startXvfb(t *testing.T) string {
+	if testing.Short() {
+		t.Skip("skipping Xvfb test in short mode")
+	}
+	path, err := exec.LookPath("Xvfb")
+	if err != nil {
+		t.Skip("Xvfb not installed")
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	screen := fmt.Sprintf("%vx%vx24", testLocalScreen.X, testLocalScreen.Y)
+	cmd := exec.Command(path, "-displayfd", "3", "-screen", "0", screen, "-nolisten", "tcp")
+	cmd.ExtraFiles = []*os.File{w}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+	// Xvfb writes the display number once it accepts connections
+	line, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil {
+		t.Fatalf("failed starting Xvfb: %v", err)
+	}
+	return ":" + strings.TrimSpace(line)
+}
+
+// x11Harness runs X11Input against a MockRemote on Xvfb
+// and synthesizes input through XTEST.
+type x11Harness struct {
+	t    *testing.T
+	i    *X11Input
+	r    *MockRemote
+	xu   *xgbutil.XUtil
+	done chan error
+}
+
+func newX11Harness(t *testing.T, c Config, forever bool) *x11Harness {
+	h := newX11HarnessInput(t, c, forever)
+	h.start()
+	h.waitGrabbed()
+	return h
+}
+
+// newX11HarnessInput returns the harness without grabbing the input,
+// so the input can be set up before starting it.
+func newX11HarnessInput(t *testing.T, c Config, forever bool) *x11Harness {
+	display := startXvfb(t)
+	logger := logrus.New()
+	logger.SetLevel(logrus.PanicLevel)
+	for name, ci := range c {
+		ci.Name = name
+		c[name] = ci
+	}
+	r := NewMockRemote(logrus.NewEntry(logger), testRemoteScreen)
+	i, err := newX11Input(logger, r, c, forever, display)
+	if err != nil {
+		t.Fatal(err)
+	}
+	xu, err := xgbutil.NewConnDisplay(display)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := xtest.Init(xu.Conn()); err != nil {
+		t.Fatal(err)
+	}
+	keybind.Initialize(xu)
+	h := &x11Harness{t, i, r, xu, make(chan error, 1)}
+	t.Cleanup(func() {
+		i.Ungrab()
+		xu.Conn().Close()
+	})
+	return h
+}
+
+// start runs Grab until the input is ungrabbed.
+func (h *x11Harness) start() {
+	go func() { h.done <- h.i.Grab() }()
+}
+
+// waitGrabbed waits until X11Input holds the keyboard and pointer grabs,
+// by trying to take them from the XTEST connection.
+func (h *x11Harness) waitGrabbed() {
+	conn, root := h.xu.Conn(), h.xu.RootWin()
+	h.waitFor("input grab", func() bool {
+		kb, err := xproto.GrabKeyboard(conn, false, root, xproto.TimeCurrentTime,
+			xproto.GrabModeAsync, xproto.GrabModeAsync).Reply()
+		if err != nil {
+			return false
+		}
+		if kb.Status == xproto.GrabStatusSuccess {
+			xproto.UngrabKeyboard(conn, xproto.TimeCurrentTime)
+			return false
+		}
+		p, err := xproto.GrabPointer(conn, false, root, 0, xproto.GrabModeAsync,
+			xproto.GrabModeAsync, xproto.WindowNone, xproto.CursorNone, xproto.TimeCurrentTime).Reply()
+		if err != nil {
+			return false
+		}
+		if p.Status == xproto.GrabStatusSuccess {
+			xproto.UngrabPointer(conn, xproto.TimeCurrentTime)
+			return false
+		}
+		return true
+	})
+}
+
+// waitUngrabbed waits until X11Input releases the keyboard grab,
+// by taking it from the XTEST connection.
+func (h *x11Harness) waitUngrabbed() {
+	conn, root := h.xu.Conn(), h.xu.RootWin()
+	h.waitFor("input ungrab", func() bool {
+		kb, err := xproto.GrabKeyboard(conn, false, root, xproto.TimeCurrentTime,
+			xproto.GrabModeAsync, xproto.GrabModeAsync).Reply()
+		if err != nil || kb.Status != xproto.GrabStatusSuccess {
+			return false
+		}
+		xproto.UngrabKeyboard(conn, xproto.TimeCurrentTime)
+		return true
+	})
+}
+
+func (h *x11Harness) waitFor(what string, cond func() bool) {
+	deadline := time.Now().Add(x11WaitTimeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			h.t.Fatalf("timed out waiting for %v", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// waitEvents waits for n remote events besides plain motion
+// and returns them.
+func (h *x11Harness) waitEvents(n int) []RemoteEvent {
+	h.waitFor(fmt.Sprintf("%v remote events", n), func() bool {
+		return len(withoutMotion(h.r.Events())) >= n
+	})
+	return withoutMotion(stripTime(h.r.Events()))
+}
+
+func (h *x11Harness) fakeInput(eventType, detail byte, x, y int16) {
+	err := xtest.FakeInputChecked(h.xu.Conn(), eventType, detail, 0, h.xu.RootWin(), x, y, 0).Check()
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	h.xu.Sync()
+}
+
+func (h *x11Harness) key(name string, isPress bool) {
+	keycodes := keybind.StrToKeycodes(h.xu, name)
+	if len(keycodes) == 0 {
+		h.t.Fatalf("no keycode for %q", name)
+	}
+	eventType := byte(xproto.KeyPress)
+	if !isPress {
+		eventType = xproto.KeyRelease
+	}
+	h.fakeInput(eventType, byte(keycodes[0]), 0, 0)
+}
+
+func (h *x11Harness) tap(names ...string) {
+	for _, name := range names {
+		h.key(name, true)
+		h.key(name, false)
+	}
+}
+
+func (h *x11Harness) button(button byte, isPress bool) {
+	eventType := byte(xproto.ButtonPress)
+	if !isPress {
+		eventType = xproto.ButtonRelease
+	}
+	h.fakeInput(eventType, button, 0, 0)
+}
+
+func (h *x11Harness) motion(x, y int16) {
+	h.fakeInput(xproto.MotionNotify, 0, x, y)
+}
+
+func (h *x11Harness) connect(hotkey, cname string) {
+	h.tap(hotkey)
+	h.waitFor(fmt.Sprintf("connection to %q", cname), func() bool {
+		return h.r.IsConnected() && h.r.Connected() == cname
+	})
+	h.waitFor("hotkey release", func() bool {
+		for _, re := range h.r.Events() {
+			if re.Name == hotkey && !re.IsPress {
+				return true
+			}
+		}
+		return false
+	})
+	h.r.Reset()
+}
+
+// withoutMotion filters out plain motion events, which the pointer
+// warping can produce at any time.
+func withoutMotion(events []RemoteEvent) []RemoteEvent {
+	var filtered []RemoteEvent
+	for _, re := range events {
+		if re.Name != "Motion" {
+			filtered = append(filtered, re)
+		}
+	}
+	return filtered
+}
+
+func TestX11Input_keys(t *testing.T) {
+	h := newX11Harness(t, Config{"mac": {
+		Hotkey: "F9",
+		Keymap: map[string]string{"Alt_L": "Meta_L", "Home": "Super_R+Left"},
+	}}, false)
+	h.connect("F9", "mac")
+
+	h.tap("a", "Alt_L", "Home")
+	want := []RemoteEvent{
+		keyEv("a", true), keyEv("a", false),
+		keyEv("Meta_L", true), keyEv("Meta_L", false),
+		keyEv("Super_R", true), keyEv("Left", true),
+		keyEv("Left", false), keyEv("Super_R", false),
+	}
+	if got := h.waitEvents(len(want)); !reflect.DeepEqual(got, want) {
+		t.Errorf("events = %v, want %v", got, want)
+	}
+}
+
+func TestX11Input_hotkeys(t *testing.T) {
+	h := newX11Harness(t, Config{
+		"mac":   {Hotkey: "F9"},
+		"linux": {Hotkey: "F10"},
+	}, false)
+	h.connect("F9", "mac")
+	h.connect("F10", "linux")
+	if got, want := h.r.Connects(), []string{"mac", "linux"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("connects = %v, want %v", got, want)
+	}
+
+	// pressing the hotkey of the current remote disconnects and ungrabs
+	h.key("F10", true)
+	select {
+	case err := <-h.done:
+		if err != nil {
+			t.Errorf("Grab() error = %v", err)
+		}
+	case <-time.After(x11WaitTimeout):
+		t.Fatal("timed out waiting for Grab to return")
+	}
+	if h.r.IsConnected() {
+		t.Error("remote still connected")
+	}
+}
+
+func TestX11Input_pointer(t *testing.T) {
+	h := newX11Harness(t, Config{"mac": {Hotkey: "F9"}}, false)
+	h.connect("F9", "mac")
+	center := Screen{testLocalScreen.X / 2, testLocalScreen.Y / 2}
+	remoteCenter := Screen{testRemoteScreen.X / 2, testRemoteScreen.Y / 2}
+
+	h.motion(int16(center.X)+10, int16(center.Y)+5)
+	want := pointerEv("Motion", remoteCenter.X+10, remoteCenter.Y+5, false)
+	h.waitFor("pointer motion", func() bool {
+		events := stripTime(h.r.Events())
+		return len(events) > 0 && events[len(events)-1] == want
+	})
+	if h.i.xi2 == nil {
+		// without XInput2 the local pointer is warped back to the center
+		h.waitFor("pointer warp", func() bool {
+			p, err := xproto.QueryPointer(h.xu.Conn(), h.xu.RootWin()).Reply()
+			return err == nil && p.RootX == int16(center.X) && p.RootY == int16(center.Y)
+		})
+	}
+
+	h.r.Reset()
+	h.button(1, true)
+	h.button(1, false)
+	wantButtons := []RemoteEvent{
+		pointerEv("Button_Left", want.X, want.Y, true),
+		pointerEv("Button_Left", want.X, want.Y, false),
+	}
+	if got := h.waitEvents(len(wantButtons)); !reflect.DeepEqual(got, wantButtons) {
+		t.Errorf("events = %v, want %v", got, wantButtons)
+	}
+}
+
+func TestX11Input_smoothScroll(t *testing.T) {
+	h := newX11Harness(t, Config{"mac": {
+		Hotkey: "F9",
+		Scroll: scrollConfig{Smooth: true, Natural: true},
+	}}, false)
+	if h.i.xi2 == nil {
+		t.Skip("XInput2 unavailable")
+	}
+	h.connect("F9", "mac")
+	remoteCenter := Screen{testRemoteScreen.X / 2, testRemoteScreen.Y / 2}
+
+	// the XTEST device has no scroll valuators, its wheel clicks
+	// are taken from the raw events instead of the core ones
+	h.button(4, true)
+	h.button(4, false)
+	want := []RemoteEvent{
+		pointerEv("Button_Down", remoteCenter.X, remoteCenter.Y, true),
+		pointerEv("Button_Down", remoteCenter.X, remoteCenter.Y, false),
+	}
+	if got := h.waitEvents(len(want)); !reflect.DeepEqual(got, want) {
+		t.Errorf("events = %v, want %v", got, want)
+	}
+}
+
+func TestX11Input_passive(t *testing.T) {
+	h := newX11HarnessInput(t, Config{"mac": {Hotkey: "Control_L+F9"}}, false)
+	h.i.SetPassive(true)
+	h.start()
+	hotkey := func() {
+		h.key("Control_L", true)
+		h.tap("F9")
+		h.key("Control_L", false)
+	}
+	// only the hotkey is grabbed, until it's pressed
+	h.waitUngrabbed()
+	h.waitFor("connection to \"mac\"", func() bool {
+		hotkey()
+		time.Sleep(50 * time.Millisecond)
+		return h.r.IsConnected()
+	})
+	h.waitGrabbed()
+	h.waitFor("hotkey release", func() bool {
+		for _, re := range h.r.Events() {
+			if re.Name == "Control_L" && !re.IsPress {
+				return true
+			}
+		}
+		return false
+	})
+	h.r.Reset()
+	h.tap("a")
+	want := []RemoteEvent{keyEv("a", true), keyEv("a", false)}
+	if got := h.waitEvents(len(want)); !reflect.DeepEqual(got, want) {
+		t.Errorf("events = %v, want %v", got, want)
+	}
+
+	// pressing the hotkey again disconnects and waits for the hotkey
+	hotkey()
+	h.waitFor("disconnect", func() bool { return !h.r.IsConnected() })
+	h.waitUngrabbed()
+	select {
+	case err := <-h.done:
+		t.Fatalf("Grab() returned %v", err)
+	default:
+	}
+	hotkey()
+	h.waitFor("reconnection", func() bool { return h.r.IsConnected() })
+	if got, want := h.r.Connects(), []string{"mac", "mac"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("connects = %v, want %v", got, want)
+	}
+}
+
+func TestX11Input_passiveUnconnected(t *testing.T) {
+	h := newX11HarnessInput(t, Config{"mac": {Hotkey: "F9"}}, false)
+	h.i.SetPassive(true)
+	h.r.SetConnectError(errors.New("refused"))
+	h.start()
+	h.waitUngrabbed()
+	// the input is given back when the switch fails
+	h.tap("F9")
+	h.waitFor("connect attempt", func() bool { return len(h.r.Connects()) > 0 })
+	h.waitUngrabbed()
+	if h.r.IsConnected() {
+		t.Fatal("connected despite the connect error")
+	}
+}